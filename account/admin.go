@@ -0,0 +1,305 @@
+package account
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+	"github.com/gorilla/sessions"
+)
+
+// AdminRole is the role required for the admin console under /admin.
+const AdminRole = "admin"
+
+const adminPageSize = 50
+
+type adminForm struct {
+	Token  string `schema:"csrf_token"`
+	Reason string `schema:"reason"`
+	Days   int    `schema:"days"`
+}
+
+type adminAuth struct {
+	Type       string
+	AuthID     int64
+	Expiration time.Time
+}
+
+type adminUsersContext struct {
+	Form     *adminForm
+	Query    string
+	Page     int
+	Users    []*User
+	HasPrev  bool
+	HasNext  bool
+	PrevPage int
+	NextPage int
+}
+
+type adminUserContext struct {
+	Form        *adminForm
+	Base        string
+	User        *User
+	Auths       []*adminAuth
+	Sessions    []*userSession
+	Roles       []string
+	Message     string
+	NewPassword string
+	// CanImpersonate is set when the admin viewing the page may log in as
+	// the user.
+	CanImpersonate bool
+}
+
+// Actions lists what the admin can do to the user with a single click.
+// Suspending takes a reason and has a form of its own.
+func (c *adminUserContext) Actions() []string {
+	as := []string{"reset_password", "logout"}
+	if !c.User.EmailVerified {
+		as = append(as, "verify_email")
+	}
+	if c.User.Suspended() {
+		as = append(as, "unsuspend")
+	}
+	if c.CanImpersonate {
+		as = append(as, "impersonate")
+	}
+	return append(as, "delete")
+}
+
+func (c *adminUsersContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+func (c *adminUserContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+// searchUsers returns one page of users whose email contains q, and whether
+// there are more.
+func searchUsers(db *sql.DB, q string, page int) ([]*User, bool, error) {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q) + "%"
+	rows, err := db.Query(
+		`SELECT id, email, email_verified, `+suspensionColumns+` FROM Users WHERE email LIKE ? ESCAPE '\' ORDER BY id LIMIT ? OFFSET ?`,
+		pattern, adminPageSize+1, page*adminPageSize)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	var us []*User
+	for rows.Next() {
+		u := &User{}
+		var sr suspensionRow
+		err := rows.Scan(&u.ID, &u.Email, &u.EmailVerified,
+			&sr.suspended, &sr.reason, &sr.actorID, &sr.until)
+		if err != nil {
+			return nil, false, err
+		}
+		u.suspension = sr.suspension()
+		us = append(us, u)
+	}
+	if len(us) > adminPageSize {
+		return us[:adminPageSize], true, rows.Err()
+	}
+	return us, false, rows.Err()
+}
+
+type adminHandler struct {
+	db    *sql.DB
+	s     sessions.Store
+	hooks hooks
+	base  string
+}
+
+func newAdminHandler(db *sql.DB, s sessions.Store, hs hooks, base string) *adminHandler {
+	return &adminHandler{db, s, hs, base}
+}
+
+func (a adminHandler) users(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 0 {
+		page = 0
+	}
+	us, more, err := searchUsers(a.db, q, page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateHandler("admin_users.html", &adminUsersContext{
+		Form:     &adminForm{},
+		Query:    q,
+		Page:     page,
+		Users:    us,
+		HasPrev:  page > 0,
+		HasNext:  more,
+		PrevPage: page - 1,
+		NextPage: page + 1}, w, r)
+}
+
+func (a adminHandler) userContext(id int64) (*adminUserContext, error) {
+	u, err := loadUserByID(a.db, id)
+	if err != nil {
+		return nil, err
+	}
+	c := &adminUserContext{Form: &adminForm{}, Base: a.base, User: u}
+	aus, err := loadAuthUsers(a.db, u)
+	if err != nil {
+		return nil, err
+	}
+	for _, au := range aus {
+		c.Auths = append(c.Auths, &adminAuth{
+			Type:       au.authType,
+			AuthID:     au.authID,
+			Expiration: au.tokenExpiration})
+	}
+	if c.Sessions, err = loadUserSessions(a.db, u.ID); err != nil {
+		return nil, err
+	}
+	if c.Roles, err = loadUserRoles(a.db, u.ID); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// renderUser shows the user named in the route, answering 404 for unknown
+// ids.
+func (a adminHandler) renderUser(w http.ResponseWriter, r *http.Request, id int64, msg, password string) {
+	c, err := a.userContext(id)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Message = msg
+	c.NewPassword = password
+	if admin, _ := UserFromRequest(a.s, r); admin != nil && admin.ID != id && !c.User.Suspended() {
+		perms, err := loadUserPermissions(a.db, admin.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c.CanImpersonate = perms.Has(ImpersonatePermission)
+	}
+	templateHandler("admin_user.html", c, w, r)
+}
+
+func (a adminHandler) user(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	a.renderUser(w, r, id, "", "")
+}
+
+func (a adminHandler) action(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	admin, err := UserFromRequest(a.s, r)
+	if err != nil || admin == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	u, err := loadUserByID(a.db, id)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var msg, password string
+	action := mux.Vars(r)["action"]
+	meta := map[string]string{"action": action}
+	switch action {
+	case "reset_password":
+		if err = a.hooks.run(passwordChangeHook, u, r); err != nil {
+			break
+		}
+		if password, err = randomSecret(""); err == nil {
+			password = password[:16]
+			if err = u.changePassword(a.db, password); err == nil {
+				err = deleteUserSessions(a.db, u.ID)
+			}
+		}
+		msg = "Password reset, the user has been logged out"
+	case "logout":
+		err = deleteUserSessions(a.db, u.ID)
+		msg = "User logged out everywhere"
+	case "verify_email":
+		err = setEmailVerified(a.db, u.ID)
+		msg = "Email marked as verified"
+	case "unsuspend":
+		err = liftSuspension(a.db, u.ID)
+		msg = "Suspension lifted"
+	case "impersonate":
+		perms, err := loadUserPermissions(a.db, admin.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !perms.Has(ImpersonatePermission) {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		if u.ID == admin.ID || u.Suspended() {
+			msg = "You can not impersonate this account"
+			meta = nil
+			break
+		}
+		if err := startImpersonation(a.db, a.s, w, r, admin, u); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	case "suspend", "delete":
+		if u.ID == admin.ID {
+			msg = "You can not " + action + " your own account"
+			meta = nil
+			break
+		}
+		if action == "delete" {
+			if err = a.hooks.run(deleteHook, u, r); err != nil {
+				break
+			}
+			if err = deleteUser(a.db, u.ID); err == nil {
+				audit(a.db, r, admin.ID, u.ID, auditAdminAction, meta)
+				a.hooks.notify(afterDeleteHook, u, r)
+				http.Redirect(w, r, a.base+"/users", http.StatusFound)
+				return
+			}
+			break
+		}
+		f := &adminForm{}
+		if err = r.ParseForm(); err != nil {
+			break
+		}
+		if err = schema.NewDecoder().Decode(f, r.PostForm); err != nil {
+			break
+		}
+		var until time.Time
+		if f.Days > 0 {
+			until = time.Now().AddDate(0, 0, f.Days)
+		}
+		err = suspendUser(a.db, u.ID, admin.ID, strings.TrimSpace(f.Reason), until)
+		meta["reason"] = strings.TrimSpace(f.Reason)
+		msg = "Account suspended"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if v, ok := err.(*vetoError); ok {
+		msg = v.Error()
+		meta = nil
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if meta != nil {
+		audit(a.db, r, admin.ID, u.ID, auditAdminAction, meta)
+	}
+	a.renderUser(w, r, u.ID, msg, password)
+}
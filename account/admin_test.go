@@ -0,0 +1,150 @@
+package account
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSearchUsers(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < adminPageSize+5; i++ {
+		if err := newUser(fmt.Sprintf("user%v@example.com", i)).insert(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := newUser("100%_real@other.com").insert(db); err != nil {
+		t.Fatal(err)
+	}
+
+	us, more, err := searchUsers(db, "example", 0)
+	if err != nil || len(us) != adminPageSize || !more {
+		t.Errorf("Expected full first page, got %v %v %v", len(us), more, err)
+	}
+	us, more, err = searchUsers(db, "example", 1)
+	if err != nil || len(us) != 5 || more {
+		t.Errorf("Expected last page of 5, got %v %v %v", len(us), more, err)
+	}
+	us, _, err = searchUsers(db, "%_", 0)
+	if err != nil || len(us) != 1 {
+		t.Errorf("Expected wildcards to match literally, got %v %v", len(us), err)
+	}
+}
+
+func TestSuspendAndDeleteUser(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("some@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal("Failed to insert user")
+	}
+	if err := newAuthUser(u, 42, "facebook", "tok", time.Now()).insert(db); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO Sessions (session_key, user_id) VALUES ('k', ?)", u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := suspendUser(db, u.ID, 1, "spam", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadUserBySession(db, "k", u.ID); err != sql.ErrNoRows {
+		t.Errorf("Expected suspending to end sessions, got %v", err)
+	}
+	u2, _ := loadUserByID(db, u.ID)
+	if s := u2.Suspension(); s == nil || s.Reason != "spam" || s.ActorID != 1 || !s.Indefinite() {
+		t.Errorf("Expected indefinite suspension, got %+v", s)
+	}
+
+	if err := suspendUser(db, u.ID, 1, "spam", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if u2, _ := loadUserByEmail(db, u.Email); u2.Suspended() {
+		t.Error("Expected expired suspension to be lifted")
+	}
+
+	if err := deleteUser(db, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadUserByAuth(db, 42, "facebook"); err != sql.ErrNoRows {
+		t.Errorf("Expected linked account to be deleted, got %v", err)
+	}
+}
+
+func TestMigrateDisabledUsers(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	if migrated, err := MigrateDisabledUsers(db); err != nil || migrated {
+		t.Fatalf("Expected nothing to migrate, got %v %v", migrated, err)
+	}
+	u := newUser("some@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	// Take Users back to when users were disabled.
+	for _, q := range []string{
+		"ALTER TABLE Users DROP COLUMN suspension_reason",
+		"ALTER TABLE Users DROP COLUMN suspended_by",
+		"ALTER TABLE Users DROP COLUMN suspended_until",
+		"ALTER TABLE Users RENAME COLUMN suspended TO disabled",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("UPDATE Users SET disabled = 1 WHERE id = ?", u.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if migrated, err := MigrateDisabledUsers(db); err != nil || !migrated {
+		t.Fatalf("Expected the disabled column to be migrated, got %v %v", migrated, err)
+	}
+	if u, err = loadUserByID(db, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if s := u.Suspension(); s == nil || !s.Indefinite() {
+		t.Errorf("Expected the disabled user to be suspended, got %+v", s)
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "test")
+	audit(db, r, 0, 1, auditLoginFailed, nil)
+	audit(db, r, 1, 1, auditLogin, map[string]string{"method": "password"})
+	audit(db, r, 2, 3, auditAdminAction, map[string]string{"action": "logout"})
+
+	es, more, err := loadAuditEvents(db, &auditQuery{UserID: 1})
+	if err != nil || more || len(es) != 2 {
+		t.Fatalf("Expected 2 events for user 1, got %v %v %v", len(es), more, err)
+	}
+	if e := es[0]; e.Type != auditLogin || e.Metadata["method"] != "password" ||
+		e.IP != "192.0.2.1" || e.UserAgent != "test" {
+		t.Errorf("Expected newest login event first, got %+v", e)
+	}
+	if es, _, _ := loadAuditEvents(db, &auditQuery{ActorID: 2, Type: auditAdminAction}); len(es) != 1 {
+		t.Errorf("Expected 1 admin action by user 2, got %v", len(es))
+	}
+}
@@ -0,0 +1,284 @@
+package account
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+)
+
+type apiError struct {
+	Error  string            `json:"error"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+type apiUser struct {
+	ID       int64  `json:"id"`
+	Email    string `json:"email"`
+	Username string `json:"username,omitempty"`
+}
+
+type apiProvider struct {
+	Type string `json:"type"`
+	ID   int64  `json:"id"`
+}
+
+type apiSignupRequest struct {
+	Email     string `json:"email"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Password2 string `json:"password2"`
+	// Invite is required when signup is invite only.
+	Invite string `json:"invite"`
+}
+
+// apiLoginRequest identifies the user by email address or username.
+type apiLoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type apiChangePasswordRequest struct {
+	OldPassword        string `json:"oldPassword"`
+	NewPassword        string `json:"newPassword"`
+	ConfirmNewPassword string `json:"confirmNewPassword"`
+}
+
+func newAPIUser(u *User) *apiUser {
+	return &apiUser{ID: u.ID, Email: u.Email, Username: u.Username}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string, fields map[string]string) {
+	writeJSON(w, status, &apiError{Error: msg, Fields: fields})
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json: "+err.Error(), nil)
+		return false
+	}
+	return true
+}
+
+// requireJSONMiddleware stands in for nosurf on the api routes.  Browsers
+// will not send a cross-origin request with a json body without a CORS
+// preflight, so insisting on the content type keeps other sites from
+// replaying the session cookie against state changing endpoints.
+func requireJSONMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+		default:
+			ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if ct != "application/json" {
+				writeJSONError(w, http.StatusUnsupportedMediaType,
+					"content type must be application/json", nil)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// apiRequireUser is RequireUserMiddleware for json clients: instead of
+// redirecting to the login page it answers 401.  As with
+// RequireUserMiddleware, tokens need the scope matching the request method
+// and OAuth client tokens are refused.
+func (am AccountManager) apiRequireUser(h func(http.ResponseWriter, *http.Request, *User)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, r, err := am.authenticate(r)
+		if isInvalidTokenError(err) {
+			writeJSONError(w, http.StatusUnauthorized, err.Error(), nil)
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+			return
+		}
+		if u == nil {
+			writeJSONError(w, http.StatusUnauthorized, "user not logged in", nil)
+			return
+		}
+		if OAuthClientID(r) != "" {
+			writeJSONError(w, http.StatusForbidden, errOAuthClientToken.Error(), nil)
+			return
+		}
+		if scope := methodScope(r); !HasScope(r, scope) {
+			writeJSONError(w, http.StatusForbidden, "token lacks "+scope+" scope", nil)
+			return
+		}
+		h(w, r, u)
+	})
+}
+
+func (am *AccountManager) createAPIRoutes(sr *mux.Router) {
+	c := alice.New(requireJSONMiddleware)
+	sr.Methods("POST").Path("/signup").Handler(c.ThenFunc(am.apiSignup))
+	sr.Methods("POST").Path("/login").Handler(c.ThenFunc(am.apiLogin))
+	sr.Methods("POST").Path("/logout").Handler(c.ThenFunc(am.apiLogout))
+	sr.Methods("POST").Path("/token").Handler(c.ThenFunc(am.apiToken))
+	sr.Methods("GET").Path("/user").Handler(c.Then(am.apiRequireUser(am.apiCurrentUser)))
+	sr.Methods("POST").Path("/change_password").Handler(c.Then(am.apiRequireUser(am.apiChangePassword)))
+	sr.Methods("GET").Path("/providers").Handler(c.Then(am.apiRequireUser(am.apiProviders)))
+	sr.Methods("GET").Path("/export").Handler(c.Then(am.apiRequireUser(am.apiExport)))
+}
+
+func (am AccountManager) apiSignup(w http.ResponseWriter, r *http.Request) {
+	req := &apiSignupRequest{}
+	if !decodeJSON(w, r, req) {
+		return
+	}
+
+	f := newSignupForm()
+	f.Email = req.Email
+	f.Username = req.Username
+	f.Password = req.Password
+	f.Password2 = req.Password2
+	if !f.validate() || !am.signupPolicy.checkForm(f) {
+		writeJSONError(w, http.StatusBadRequest, "invalid signup", f.Errors)
+		return
+	}
+
+	u, err := f.createUser(am.db)
+	if err != nil {
+		if err == errUsernameTaken {
+			writeJSONError(w, http.StatusConflict, "invalid signup",
+				map[string]string{"Username": "That username is taken"})
+			return
+		}
+		if isExistingUserError(err) {
+			writeJSONError(w, http.StatusConflict, "invalid signup",
+				map[string]string{"Email": "User already exists"})
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	audit(am.db, r, u.ID, u.ID, auditSignup, nil)
+	r = withInvitation(r, req.Invite)
+	if err := am.hooks.run(signupHook, u, r); err != nil {
+		if err := undoSignup(am.db, u.ID); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+			return
+		}
+		writeJSONError(w, http.StatusForbidden, err.Error(), nil)
+		return
+	}
+	am.hooks.notify(afterSignupHook, u, r)
+	if err := u.saveToSession(am.db, am.store, w, r); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAPIUser(u))
+}
+
+func (am AccountManager) apiLogin(w http.ResponseWriter, r *http.Request) {
+	req := &apiLoginRequest{}
+	if !decodeJSON(w, r, req) {
+		return
+	}
+
+	u, err := loadUserByLogin(am.db, req.Email)
+	if err != nil {
+		audit(am.db, r, 0, 0, auditLoginFailed, map[string]string{"email": req.Email})
+		writeJSONError(w, http.StatusUnauthorized, "Invalid username/password", nil)
+		return
+	}
+	cp, err := u.isCorrectPassword(am.db, req.Password)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	if !cp {
+		audit(am.db, r, 0, u.ID, auditLoginFailed, nil)
+		writeJSONError(w, http.StatusUnauthorized, "Invalid username/password", nil)
+		return
+	}
+	if u.Suspended() {
+		audit(am.db, r, u.ID, u.ID, auditLoginBlocked, nil)
+		writeJSONError(w, http.StatusForbidden, "This account has been suspended", nil)
+		return
+	}
+	if err := am.hooks.run(loginHook, u, r); err != nil {
+		writeJSONError(w, http.StatusForbidden, err.Error(), nil)
+		return
+	}
+	if err := cancelDeletion(am.db, r, u); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	if err := u.saveToSession(am.db, am.store, w, r); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	audit(am.db, r, u.ID, u.ID, auditLogin, map[string]string{"method": "password"})
+	writeJSON(w, http.StatusOK, newAPIUser(u))
+}
+
+func (am AccountManager) apiLogout(w http.ResponseWriter, r *http.Request) {
+	if err := endSession(am.db, am.store, am.hooks, w, r); err != nil {
+		if v, ok := err.(*vetoError); ok {
+			writeJSONError(w, http.StatusForbidden, v.Error(), nil)
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (am AccountManager) apiCurrentUser(w http.ResponseWriter, r *http.Request, u *User) {
+	writeJSON(w, http.StatusOK, newAPIUser(u))
+}
+
+func (am AccountManager) apiChangePassword(w http.ResponseWriter, r *http.Request, u *User) {
+	if impersonatorFromRequest(r) != nil {
+		writeJSONError(w, http.StatusForbidden, errImpersonating.Error(), nil)
+		return
+	}
+	req := &apiChangePasswordRequest{}
+	if !decodeJSON(w, r, req) {
+		return
+	}
+
+	field, msg, err := updatePassword(am.db, u, &ChangePasswordForm{
+		OldPassword:        req.OldPassword,
+		NewPassword:        req.NewPassword,
+		ConfirmNewPassword: req.ConfirmNewPassword}, am.hooks, r)
+	if v, ok := err.(*vetoError); ok {
+		writeJSONError(w, http.StatusForbidden, v.Error(), nil)
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	if len(msg) != 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid password change",
+			map[string]string{field: msg})
+		return
+	}
+	audit(am.db, r, u.ID, u.ID, auditPasswordChange, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (am AccountManager) apiProviders(w http.ResponseWriter, r *http.Request, u *User) {
+	aus, err := loadAuthUsers(am.db, u)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	ps := []*apiProvider{}
+	for _, au := range aus {
+		ps = append(ps, &apiProvider{Type: au.authType, ID: au.authID})
+	}
+	writeJSON(w, http.StatusOK, ps)
+}
@@ -0,0 +1,82 @@
+package account
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+func TestAPISignupLoginUser(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	am := NewAccountManager(sessions.NewCookieStore([]byte("secret")), db,
+		"http://localhost", NewFacebookClient("", ""))
+	mx := mux.NewRouter()
+	if err := am.CreateRoutes(mx.PathPrefix("/account").Subrouter()); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/account/api/v1"+path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mx.ServeHTTP(w, r)
+		return w
+	}
+
+	w := post("/signup", `{"email": "bad", "password": "foobar", "password2": "foobar"}`)
+	e := &apiError{}
+	json.NewDecoder(w.Body).Decode(e)
+	if w.Code != http.StatusBadRequest || e.Fields["Email"] == "" {
+		t.Errorf("Expected email field error, got %v %v", w.Code, e)
+	}
+
+	w = post("/signup", `{"email": "a@b.com", "password": "foobar", "password2": "foobar"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected signup to succeed, got %v %v", w.Code, w.Body)
+	}
+
+	w = post("/signup", `{"email": "a@b.com", "password": "foobar", "password2": "foobar"}`)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected duplicate signup to conflict, got %v", w.Code)
+	}
+
+	w = post("/login", `{"email": "a@b.com", "password": "wrong"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected bad login to be rejected, got %v", w.Code)
+	}
+
+	w = post("/login", `{"email": "a@b.com", "password": "foobar"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected login to succeed, got %v %v", w.Code, w.Body)
+	}
+
+	r := httptest.NewRequest("GET", "/account/api/v1/user", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	mx.ServeHTTP(w, r)
+	au := &apiUser{}
+	json.NewDecoder(w.Body).Decode(au)
+	if w.Code != http.StatusOK || au.Email != "a@b.com" {
+		t.Errorf("Expected current user, got %v %v", w.Code, au)
+	}
+
+	r = httptest.NewRequest("POST", "/account/api/v1/login", strings.NewReader("email=a@b.com"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	mx.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected form post to be refused, got %v", w.Code)
+	}
+}
@@ -0,0 +1,352 @@
+package account
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/schema"
+	"github.com/gorilla/sessions"
+)
+
+const apiTokenPrefix = "gw_"
+
+// Scopes a personal API token may be granted.  Users logged in with the
+// session cookie implicitly hold all of them.
+var apiTokenScopes = []string{
+	"read",
+	"write",
+}
+
+var errInvalidAPIToken = errors.New("invalid or expired api token")
+
+type apiToken struct {
+	ID         int64
+	UserID     int64
+	Name       string
+	Scopes     []string
+	Created    time.Time
+	Expiration time.Time
+	hash       string
+}
+
+func newAPIToken(userID int64, name string, scopes []string, expiration time.Time) (*apiToken, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return &apiToken{
+		UserID:     userID,
+		Name:       name,
+		Scopes:     scopes,
+		Expiration: expiration,
+		hash:       hashSecret(secret)}, secret, nil
+}
+
+// Tokens carry 256 bits of entropy, so a plain digest is enough and lets the
+// token be looked up directly by its hash.
+func hashSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func (t *apiToken) insert(db *sql.DB) error {
+	var exp int64
+	if !t.Expiration.IsZero() {
+		exp = t.Expiration.Unix()
+	}
+	r, err := db.Exec(
+		"INSERT INTO ApiTokens (user_id, name, scopes, token_hash, expiration) VALUES ($1, $2, $3, $4, $5)",
+		t.UserID,
+		t.Name,
+		strings.Join(t.Scopes, " "),
+		t.hash,
+		exp)
+	if err != nil {
+		return err
+	}
+	t.ID, err = r.LastInsertId()
+	return err
+}
+
+func (t *apiToken) IsExpired() bool {
+	return !t.Expiration.IsZero() && time.Now().After(t.Expiration)
+}
+
+func (t *apiToken) hasScope(scope string) bool {
+	return hasScope(t.Scopes, scope)
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func scanAPIToken(row interface {
+	Scan(...interface{}) error
+}) (*apiToken, error) {
+	t := &apiToken{}
+	var scopes string
+	var exp int64
+	err := row.Scan(&t.ID, &t.UserID, &t.Name, &scopes, &t.hash, &exp, &t.Created)
+	if err != nil {
+		return nil, err
+	}
+	t.Scopes = strings.Fields(scopes)
+	if exp != 0 {
+		t.Expiration = time.Unix(exp, 0)
+	}
+	return t, nil
+}
+
+func loadAPITokens(db *sql.DB, userID int64) ([]*apiToken, error) {
+	rows, err := db.Query(
+		"SELECT id, user_id, name, scopes, token_hash, expiration, created FROM ApiTokens WHERE user_id = ? ORDER BY id",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ts []*apiToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	return ts, rows.Err()
+}
+
+func deleteAPIToken(db *sql.DB, userID, id int64) error {
+	_, err := db.Exec("DELETE FROM ApiTokens WHERE id = ? AND user_id = ?", id, userID)
+	return err
+}
+
+// loadUserByAPIToken resolves the secret presented by a client to its owner.
+func loadUserByAPIToken(db *sql.DB, secret string) (*User, *apiToken, error) {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return nil, nil, errInvalidAPIToken
+	}
+	t, err := scanAPIToken(db.QueryRow(
+		"SELECT id, user_id, name, scopes, token_hash, expiration, created FROM ApiTokens WHERE token_hash = ?",
+		hashSecret(secret)))
+	if err == sql.ErrNoRows {
+		return nil, nil, errInvalidAPIToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if t.IsExpired() {
+		return nil, nil, errInvalidAPIToken
+	}
+	u, err := loadUserByID(db, t.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, t, nil
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header, or
+// the empty string if the request does not carry one.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// HasScope reports whether the request may act with the given api token
+// or OAuth scope.  Requests authenticated by the session cookie have every
+// scope.
+func HasScope(r *http.Request, scope string) bool {
+	scopes, ok := r.Context().Value(scopesContextKey).([]string)
+	if !ok {
+		return true
+	}
+	return hasScope(scopes, scope)
+}
+
+type apiTokensForm struct {
+	Name          string
+	Scopes        []string
+	ExpiresInDays int
+	Token         string `schema:"csrf_token"`
+}
+
+type apiTokenDeleteForm struct {
+	ID    int64
+	Token string `schema:"csrf_token"`
+}
+
+type apiTokensContext struct {
+	Form      *apiTokensForm
+	Tokens    []*apiToken
+	AllScopes []string
+	NewToken  string
+	Error     string
+}
+
+func newAPITokensContext(db *sql.DB, u *User) (*apiTokensContext, error) {
+	ts, err := loadAPITokens(db, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &apiTokensContext{
+		Form:      &apiTokensForm{},
+		Tokens:    ts,
+		AllScopes: apiTokenScopes}, nil
+}
+
+func (c *apiTokensContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+func (f *apiTokensForm) validate() string {
+	if len(strings.TrimSpace(f.Name)) == 0 {
+		return "Name is required"
+	}
+	if len(f.Scopes) == 0 {
+		return "Select at least one scope"
+	}
+	for _, s := range f.Scopes {
+		if !isAPITokenScope(s) {
+			return "Unknown scope " + s
+		}
+	}
+	if f.ExpiresInDays < 0 {
+		return "Expiry must not be negative"
+	}
+	return ""
+}
+
+func isAPITokenScope(s string) bool {
+	return hasScope(apiTokenScopes, s)
+}
+
+type apiTokensGetHandler struct {
+	db *sql.DB
+	s  sessions.Store
+}
+
+type apiTokensPostHandler struct {
+	db *sql.DB
+	s  sessions.Store
+}
+
+type apiTokenDeletePostHandler struct {
+	db *sql.DB
+	s  sessions.Store
+}
+
+func newAPITokensGetHandler(db *sql.DB, s sessions.Store) *apiTokensGetHandler {
+	return &apiTokensGetHandler{db, s}
+}
+
+func newAPITokensPostHandler(db *sql.DB, s sessions.Store) *apiTokensPostHandler {
+	return &apiTokensPostHandler{db, s}
+}
+
+func newAPITokenDeletePostHandler(db *sql.DB, s sessions.Store) *apiTokenDeletePostHandler {
+	return &apiTokenDeletePostHandler{db, s}
+}
+
+func (h apiTokensGetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	c, err := newAPITokensContext(h.db, u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateHandler("api_tokens.html", c, w, r)
+}
+
+func (h apiTokensPostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	f := &apiTokensForm{}
+	if err := schema.NewDecoder().Decode(f, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var secret string
+	msg := f.validate()
+	if len(msg) == 0 {
+		var exp time.Time
+		if f.ExpiresInDays > 0 {
+			exp = time.Now().AddDate(0, 0, f.ExpiresInDays)
+		}
+		t, s, err := newAPIToken(u.ID, strings.TrimSpace(f.Name), f.Scopes, exp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := t.insert(h.db); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(h.db, r, u.ID, u.ID, auditAPITokenCreated,
+			map[string]string{"name": t.Name, "scopes": strings.Join(t.Scopes, " ")})
+		secret = s
+	}
+
+	c, err := newAPITokensContext(h.db, u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Error = msg
+	c.NewToken = secret
+	templateHandler("api_tokens.html", c, w, r)
+}
+
+func (h apiTokenDeletePostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	f := &apiTokenDeleteForm{}
+	if err := schema.NewDecoder().Decode(f, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := deleteAPIToken(h.db, u.ID, f.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.db, r, u.ID, u.ID, auditAPITokenDeleted, map[string]string{"id": strconv.FormatInt(f.ID, 10)})
+	http.Redirect(w, r, "tokens", http.StatusFound)
+}
@@ -0,0 +1,111 @@
+package account
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestAPITokenLookup(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("some@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal("Failed to insert user")
+	}
+
+	tok, secret, err := newAPIToken(u.ID, "ci", []string{"read"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tok.insert(db); err != nil {
+		t.Fatalf("Failed to insert token %v", err)
+	}
+
+	u2, t2, err := loadUserByAPIToken(db, secret)
+	if err != nil {
+		t.Fatalf("Expected to load token user, got %v", err)
+	}
+	if u2.ID != u.ID || !t2.hasScope("read") || t2.hasScope("write") {
+		t.Errorf("Got wrong user or scopes %v %v", u2, t2.Scopes)
+	}
+
+	if _, _, err := loadUserByAPIToken(db, secret+"x"); err != errInvalidAPIToken {
+		t.Errorf("Expected invalid token error, got %v", err)
+	}
+
+	expired, es, _ := newAPIToken(u.ID, "old", []string{"read"}, time.Now().Add(-time.Hour))
+	if err := expired.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadUserByAPIToken(db, es); err != errInvalidAPIToken {
+		t.Errorf("Expected expired token to be rejected, got %v", err)
+	}
+
+	if err := deleteAPIToken(db, u.ID, tok.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadUserByAPIToken(db, secret); err != errInvalidAPIToken {
+		t.Errorf("Expected deleted token to be rejected, got %v", err)
+	}
+}
+
+func TestRequireUserMiddlewareBearer(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("some@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal("Failed to insert user")
+	}
+	tok, secret, _ := newAPIToken(u.ID, "ci", []string{"read"}, time.Time{})
+	if err := tok.insert(db); err != nil {
+		t.Fatal(err)
+	}
+
+	store := sessions.NewCookieStore([]byte("secret"))
+	am := NewAccountManager(store, db, "http://localhost", NewFacebookClient("", ""))
+	h := am.RequireUserMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ru, err := UserFromRequest(store, r)
+		if err != nil || ru == nil || ru.ID != u.ID {
+			t.Errorf("Expected token user in request, got %v %v", ru, err)
+		}
+		if !HasScope(r, "read") || HasScope(r, "write") {
+			t.Error("Expected only read scope")
+		}
+	}))
+
+	r := httptest.NewRequest("GET", "/private", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %v", w.Code)
+	}
+
+	r = httptest.NewRequest("POST", "/private", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected read token to be refused changes, got %v", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/private", nil)
+	r.Header.Set("Authorization", "Bearer gw_bogus")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %v", w.Code)
+	}
+}
@@ -0,0 +1,229 @@
+package account
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/schema"
+)
+
+// Audited events.
+const (
+	auditSignup               = "signup"
+	auditLogin                = "login"
+	auditLoginFailed          = "login_failed"
+	auditLoginBlocked         = "login_blocked"
+	auditLogout               = "logout"
+	auditPasswordChange       = "password_change"
+	auditProviderLinked       = "provider_linked"
+	auditAPITokenCreated      = "api_token_created"
+	auditAPITokenDeleted      = "api_token_deleted"
+	auditOAuthGrant           = "oauth_grant"
+	auditOAuthClientCreated   = "oauth_client_created"
+	auditOAuthClientDeleted   = "oauth_client_deleted"
+	auditOAuthClientApproval  = "oauth_client_approval"
+	auditAdminAction          = "admin_action"
+	auditImpersonationStart   = "impersonation_start"
+	auditImpersonationStop    = "impersonation_stop"
+	auditDeletionScheduled    = "deletion_scheduled"
+	auditDeletionCancelled    = "deletion_cancelled"
+	auditDeleted              = "deleted"
+	auditDataExport           = "data_export"
+	auditEmailChangeRequested = "email_change_requested"
+	auditEmailChange          = "email_change"
+	auditEmailChangeReverted  = "email_change_reverted"
+	auditEmailAdded           = "email_added"
+	auditEmailVerified        = "email_verified"
+	auditEmailPrimary         = "email_primary"
+	auditEmailRemoved         = "email_removed"
+	auditUsernameChange       = "username_change"
+	auditInvitationCreated    = "invitation_created"
+	auditInvitationRevoked    = "invitation_revoked"
+	auditInvitationRedeemed   = "invitation_redeemed"
+	auditWaitlistApproved     = "waitlist_approved"
+	auditOrgCreated           = "org_created"
+	auditOrgInvitation        = "org_invitation"
+	auditOrgMemberAdded       = "org_member_added"
+	auditOrgMemberRemoved     = "org_member_removed"
+	auditOrgRoleChange        = "org_role_change"
+	auditOrgDomainClaimed     = "org_domain_claimed"
+	auditOrgDomainVerified    = "org_domain_verified"
+	auditOrgJoinRequested     = "org_join_requested"
+)
+
+const auditPageSize = 50
+
+// auditEvent records something security relevant done to a user's account.
+// ActorID is who did it, the user themselves unless an admin acted on their
+// behalf, and 0 when unknown as for failed logins.
+type auditEvent struct {
+	ID        int64
+	ActorID   int64
+	UserID    int64
+	Type      string
+	IP        string
+	UserAgent string
+	Metadata  map[string]string
+	Created   time.Time
+}
+
+// recordAuditEvent notes that actor caused an event of type typ on user's
+// account.  Events are kept when the users involved are deleted.  r is nil
+// for events not caused by a request.
+func recordAuditEvent(db *sql.DB, r *http.Request, actorID, userID int64, typ string, meta map[string]string) error {
+	m, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	var ip, ua string
+	if r != nil {
+		ip, ua = remoteIP(r), r.UserAgent()
+	}
+	_, err = db.Exec(
+		"INSERT INTO AuditEvents (actor_id, user_id, type, ip, user_agent, metadata) VALUES ($1, $2, $3, $4, $5, $6)",
+		actorID, userID, typ, ip, ua, string(m))
+	return err
+}
+
+// audit records an event, logging rather than failing the request when it
+// can not.
+func audit(db *sql.DB, r *http.Request, actorID, userID int64, typ string, meta map[string]string) {
+	if err := recordAuditEvent(db, r, actorID, userID, typ, meta); err != nil {
+		log.Printf("unable to record %v event for user %v: %v", typ, userID, err)
+	}
+}
+
+// auditQuery selects events for the admin view.  Zero fields match anything.
+type auditQuery struct {
+	UserID  int64  `schema:"user"`
+	ActorID int64  `schema:"actor"`
+	Type    string `schema:"type"`
+	IP      string `schema:"ip"`
+	Page    int    `schema:"page"`
+}
+
+// loadAuditEvents returns one page of events matching q, newest first, and
+// whether there are more.
+func loadAuditEvents(db *sql.DB, q *auditQuery) ([]*auditEvent, bool, error) {
+	var where []string
+	var args []interface{}
+	if q.UserID != 0 {
+		where = append(where, "user_id = ?")
+		args = append(args, q.UserID)
+	}
+	if q.ActorID != 0 {
+		where = append(where, "actor_id = ?")
+		args = append(args, q.ActorID)
+	}
+	if q.Type != "" {
+		where = append(where, "type = ?")
+		args = append(args, q.Type)
+	}
+	if q.IP != "" {
+		where = append(where, "ip = ?")
+		args = append(args, q.IP)
+	}
+	query := "SELECT id, actor_id, user_id, type, ip, user_agent, metadata, created FROM AuditEvents"
+	if len(where) != 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, auditPageSize+1, q.Page*auditPageSize)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	var es []*auditEvent
+	for rows.Next() {
+		e := &auditEvent{}
+		var m string
+		err := rows.Scan(&e.ID, &e.ActorID, &e.UserID, &e.Type, &e.IP, &e.UserAgent, &m, &e.Created)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := json.Unmarshal([]byte(m), &e.Metadata); err != nil {
+			return nil, false, err
+		}
+		es = append(es, e)
+	}
+	if len(es) > auditPageSize {
+		return es[:auditPageSize], true, rows.Err()
+	}
+	return es, false, rows.Err()
+}
+
+// hideOthers clears the IP address and user agent of the events others,
+// such as admins, caused on the user's account, before they are shown to
+// the user.
+func hideOthers(es []*auditEvent) []*auditEvent {
+	for _, e := range es {
+		if e.ActorID != e.UserID {
+			e.IP, e.UserAgent = "", ""
+		}
+	}
+	return es
+}
+
+type activityContext struct {
+	Events []*auditEvent
+}
+
+// activityHandler shows users the recent events on their own account, so
+// they can spot logins they don't recognise.
+func (am AccountManager) activityHandler(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(am.store, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	es, _, err := loadAuditEvents(am.db, &auditQuery{UserID: u.ID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pageHandler("activity.html", &activityContext{hideOthers(es)}, w, r)
+}
+
+type adminAuditContext struct {
+	Query    *auditQuery
+	Events   []*auditEvent
+	HasPrev  bool
+	HasNext  bool
+	PrevPage int
+	NextPage int
+}
+
+func (a adminHandler) audit(w http.ResponseWriter, r *http.Request) {
+	q := &auditQuery{}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d := schema.NewDecoder()
+	d.IgnoreUnknownKeys(true)
+	if err := d.Decode(q, r.Form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Page < 0 {
+		q.Page = 0
+	}
+	es, more, err := loadAuditEvents(a.db, q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pageHandler("admin_audit.html", &adminAuditContext{
+		Query:    q,
+		Events:   es,
+		HasPrev:  q.Page > 0,
+		HasNext:  more,
+		PrevPage: q.Page - 1,
+		NextPage: q.Page + 1}, w, r)
+}
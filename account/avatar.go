@@ -0,0 +1,291 @@
+package account
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	maxAvatarUploadBytes = 5 << 20
+	// maxAvatarPixels keeps small files that decode to huge images out.
+	maxAvatarPixels = 4096 * 4096
+)
+
+// avatarSizes are the widths in pixels avatars are stored at, largest last.
+var avatarSizes = []int{32, 64, 128, 256}
+
+var avatarContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+func avatarKey(userID int64, size int) string {
+	return "avatars/" + strconv.FormatInt(userID, 10) + "/" + strconv.Itoa(size) + ".png"
+}
+
+// avatarSize returns the stored size closest to, and at least, size.
+func avatarSize(size int) int {
+	for _, s := range avatarSizes {
+		if s >= size {
+			return s
+		}
+	}
+	return avatarSizes[len(avatarSizes)-1]
+}
+
+// decodeAvatar checks data is an image of a supported type and size and
+// decodes it.  The returned message is for the user.
+func decodeAvatar(data []byte) (image.Image, string) {
+	if !avatarContentTypes[http.DetectContentType(data)] {
+		return nil, "Avatars must be PNG, JPEG or GIF images"
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "Unable to read the image"
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxAvatarPixels {
+		return nil, "The image is too large"
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "Unable to read the image"
+	}
+	return img, ""
+}
+
+// squareImage crops the middle square out of img.
+func squareImage(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	s := b.Dx()
+	if b.Dy() < s {
+		s = b.Dy()
+	}
+	sq := image.NewRGBA(image.Rect(0, 0, s, s))
+	sp := image.Pt(b.Min.X+(b.Dx()-s)/2, b.Min.Y+(b.Dy()-s)/2)
+	draw.Draw(sq, sq.Bounds(), img, sp, draw.Src)
+	return sq
+}
+
+// resizeSquare scales a square image to size by averaging the source
+// pixels under each destination pixel.
+func resizeSquare(src *image.RGBA, size int) *image.RGBA {
+	s := src.Bounds().Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := y*s/size, (y+1)*s/size
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < size; x++ {
+			x0, x1 := x*s/size, (x+1)*s/size
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(src.Pix[i+c])
+					}
+					i += 4
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			j := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[j+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// storeAvatar re-encodes img at every avatar size.  Encoding it ourselves
+// drops whatever else the upload carried, such as metadata.
+func storeAvatar(store BlobStore, userID int64, img image.Image) error {
+	largest := resizeSquare(squareImage(img), avatarSizes[len(avatarSizes)-1])
+	for _, size := range avatarSizes {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, resizeSquare(largest, size)); err != nil {
+			return err
+		}
+		if err := store.Put(avatarKey(userID, size), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteAvatar(store BlobStore, userID int64) error {
+	return store.Delete("avatars/" + strconv.FormatInt(userID, 10))
+}
+
+// identicon draws a symmetric five by five pattern, in a colour and shape
+// derived from the user's ID, for users without an avatar.
+func identicon(userID int64, size int) *image.RGBA {
+	h := sha256.Sum256([]byte(strconv.FormatInt(userID, 10)))
+	fg := color.RGBA{h[0]/2 + 64, h[1]/2 + 64, h[2]/2 + 64, 255}
+	bg := color.RGBA{240, 240, 240, 255}
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{bg}, image.ZP, draw.Src)
+	cell := size / 6
+	margin := (size - 5*cell) / 2
+	for row := 0; row < 5; row++ {
+		for col := 0; col < 3; col++ {
+			if h[3+row*3+col]&1 == 0 {
+				continue
+			}
+			for _, c := range []int{col, 4 - col} {
+				r := image.Rect(margin+c*cell, margin+row*cell, margin+(c+1)*cell, margin+(row+1)*cell)
+				draw.Draw(img, r, &image.Uniform{fg}, image.ZP, draw.Src)
+			}
+		}
+	}
+	return img
+}
+
+// AvatarURL returns where to load the user's avatar from: the one they
+// chose, or else a generated identicon.
+func (am AccountManager) AvatarURL(u *User) string {
+	if u.AvatarURL != "" {
+		return u.AvatarURL
+	}
+	return am.serverAddr + am.baseURL.Path + "/avatar/" + strconv.FormatInt(u.ID, 10)
+}
+
+// avatarSrc returns the avatar to show on the account pages, relative to
+// them.
+func avatarSrc(userID int64, p *Profile) string {
+	if p.AvatarURL != "" {
+		return p.AvatarURL
+	}
+	return "avatar/" + strconv.FormatInt(userID, 10)
+}
+
+type avatarHandler struct {
+	db    *sql.DB
+	s     sessions.Store
+	blobs BlobStore
+	// base is the absolute url of the account routes, for the avatar urls.
+	base string
+}
+
+func newAvatarHandler(db *sql.DB, s sessions.Store, blobs BlobStore, base string) *avatarHandler {
+	return &avatarHandler{db, s, blobs, base}
+}
+
+// serve answers with the uploaded avatar of the user at the size asked for
+// by the size parameter, or their identicon if they uploaded none.
+func (h avatarHandler) serve(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+	size = avatarSize(size)
+	b, err := h.blobs.Get(avatarKey(id, size))
+	if err == ErrBlobNotFound {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, identicon(id, size)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b = buf.Bytes()
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(b)
+}
+
+// upload replaces the user's avatar with the image posted as the avatar
+// file, or removes it when the remove field is set.  Either way the avatar
+// url of the profile is updated.
+func (h avatarHandler) upload(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	c := &profileContext{
+		Form:   &profileForm{Profile: u.Profile},
+		Avatar: avatarSrc(u.ID, &u.Profile),
+		Errors: map[string]string{}}
+	if err := r.ParseMultipartForm(maxAvatarUploadBytes); err != nil {
+		c.Errors["Avatar"] = "The upload is too large"
+		templateHandler("profile.html", c, w, r)
+		return
+	}
+
+	if r.PostFormValue("remove") != "" {
+		if err := deleteAvatar(h.blobs, u.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c.Form.AvatarURL = ""
+		c.Message = "Avatar removed"
+	} else {
+		f, _, err := r.FormFile("avatar")
+		if err != nil {
+			c.Errors["Avatar"] = "Choose an image to upload"
+			templateHandler("profile.html", c, w, r)
+			return
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		img, msg := decodeAvatar(data)
+		if len(msg) != 0 {
+			c.Errors["Avatar"] = msg
+			templateHandler("profile.html", c, w, r)
+			return
+		}
+		if err := storeAvatar(h.blobs, u.ID, img); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The version parameter makes browsers fetch the new image.
+		c.Form.AvatarURL = h.base + "/avatar/" + strconv.FormatInt(u.ID, 10) +
+			"?v=" + strconv.FormatInt(time.Now().Unix(), 10)
+		c.Message = "Avatar uploaded"
+	}
+	if err := saveProfile(h.db, u.ID, &c.Form.Profile); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Avatar = avatarSrc(u.ID, &c.Form.Profile)
+	templateHandler("profile.html", c, w, r)
+}
+
+// maxBytesMiddleware refuses request bodies over n bytes.
+func maxBytesMiddleware(n int64) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package account
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDecodeAvatar(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg := decodeAvatar(buf.Bytes()); msg != "" {
+		t.Errorf("Expected png to be accepted, got %q", msg)
+	}
+	if _, msg := decodeAvatar([]byte("<svg></svg>")); msg == "" {
+		t.Errorf("Expected non image upload to be rejected")
+	}
+
+	buf.Reset()
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 5000, 4000))); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg := decodeAvatar(buf.Bytes()); msg == "" {
+		t.Errorf("Expected huge image to be rejected")
+	}
+}
+
+func TestStoreAvatar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &DirBlobStore{Dir: dir}
+
+	// A wide image, red in the middle: only the middle is kept.
+	img := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	for x := 100; x < 200; x++ {
+		for y := 0; y < 100; y++ {
+			img.Set(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+	if err := storeAvatar(store, 1, img); err != nil {
+		t.Fatalf("Failed to store avatar %v", err)
+	}
+	for _, size := range avatarSizes {
+		b, err := store.Get(avatarKey(1, size))
+		if err != nil {
+			t.Fatalf("Failed to get avatar of size %v: %v", size, err)
+		}
+		a, err := png.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Bounds().Dx() != size || a.Bounds().Dy() != size {
+			t.Errorf("Expected %vx%v avatar, got %v", size, size, a.Bounds())
+		}
+		if r, g, _, _ := a.At(0, 0).RGBA(); r>>8 != 255 || g != 0 {
+			t.Errorf("Expected avatar to be cropped to the middle")
+		}
+	}
+
+	if err := deleteAvatar(store, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(avatarKey(1, 32)); err != ErrBlobNotFound {
+		t.Errorf("Expected avatar to be deleted, got %v", err)
+	}
+}
+
+func TestDirBlobStoreKeys(t *testing.T) {
+	store := &DirBlobStore{Dir: os.TempDir()}
+	if err := store.Put("../escape", []byte("x")); err == nil {
+		t.Errorf("Expected key outside the directory to be refused")
+	}
+}
+
+func TestIdenticon(t *testing.T) {
+	a, b := identicon(7, 64), identicon(7, 64)
+	if !bytes.Equal(a.Pix, b.Pix) {
+		t.Errorf("Expected identicons to be deterministic")
+	}
+	if bytes.Equal(a.Pix, identicon(8, 64).Pix) {
+		t.Errorf("Expected users to get different identicons")
+	}
+}
+
+func TestAvatarSize(t *testing.T) {
+	for in, want := range map[int]int{0: 32, 32: 32, 50: 64, 1000: 256} {
+		if got := avatarSize(in); got != want {
+			t.Errorf("avatarSize(%v) = %v, want %v", in, got, want)
+		}
+	}
+}
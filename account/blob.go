@@ -0,0 +1,86 @@
+package account
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrBlobNotFound is returned by BlobStore.Get for keys that hold nothing.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps files such as uploaded avatars.  Keys are slash separated
+// paths chosen by the account package.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	// Delete removes key and everything under it.  Deleting a missing key is
+	// not an error.
+	Delete(key string) error
+}
+
+// DirBlobStore keeps blobs as files under a local directory.
+type DirBlobStore struct {
+	Dir string
+}
+
+func (s *DirBlobStore) path(key string) (string, error) {
+	p := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, filepath.Clean(s.Dir)+string(os.PathSeparator)) {
+		return "", errors.New("invalid blob key " + key)
+	}
+	return p, nil
+}
+
+func (s *DirBlobStore) Put(key string, data []byte) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// Write to the side and rename, so readers never see half a file.
+	f, err := ioutil.TempFile(filepath.Dir(p), ".blob")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (s *DirBlobStore) Get(key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return b, err
+}
+
+func (s *DirBlobStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+// SetBlobStore changes where uploaded files are kept.  By default they go
+// under the "blobs" directory.  It must be called before CreateRoutes.
+func (am *AccountManager) SetBlobStore(s BlobStore) {
+	am.blobs = s
+}
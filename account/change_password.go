@@ -9,8 +9,9 @@ import (
 )
 
 type changePasswordPostHandler struct {
-	db *sql.DB
-	s  sessions.Store
+	db    *sql.DB
+	s     sessions.Store
+	hooks hooks
 }
 
 type changePasswordGetHandler struct {
@@ -32,8 +33,8 @@ type changePasswordContext struct {
 	Message        string
 }
 
-func newChangePasswordPostHandler(db *sql.DB, s sessions.Store) *changePasswordPostHandler {
-	return &changePasswordPostHandler{db, s}
+func newChangePasswordPostHandler(db *sql.DB, s sessions.Store, hs hooks) *changePasswordPostHandler {
+	return &changePasswordPostHandler{db, s, hs}
 }
 
 func newChangePasswordGetHandler(db *sql.DB, s sessions.Store) *changePasswordGetHandler {
@@ -91,13 +92,14 @@ func (h changePasswordPostHandler) ServeHTTP(w http.ResponseWriter, r *http.Requ
 
 	perr, ierr := h.updatePassword(c, u, w, r)
 	if ierr != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, ierr.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	if len(perr) != 0 {
 		c.Message = perr
 	} else {
+		audit(h.db, r, u.ID, u.ID, auditPasswordChange, nil)
 		c.Message = "Password changed"
 	}
 
@@ -113,26 +115,41 @@ func (h changePasswordPostHandler) ServeHTTP(w http.ResponseWriter, r *http.Requ
 
 func (h changePasswordPostHandler) updatePassword(
 	c *changePasswordContext, u *User, w http.ResponseWriter, r *http.Request) (passwordError string, err error) {
-	hp, err := u.HasPassword(h.db)
+	_, passwordError, err = updatePassword(h.db, u, c.Form, h.hooks, r)
+	if v, ok := err.(*vetoError); ok {
+		return v.Error(), nil
+	}
+	return
+}
+
+// updatePassword validates the form against the user's current password and
+// stores the new one.  passwordError describes a problem with the named form
+// field that the user can fix.  A *vetoError is returned if a hook refused
+// the change.
+func updatePassword(db *sql.DB, u *User, f *ChangePasswordForm, hs hooks, r *http.Request) (field, passwordError string, err error) {
+	hp, err := u.HasPassword(db)
 	if err != nil {
 		return
 	}
 
 	if hp {
-		cp, err := u.isCorrectPassword(h.db, c.Form.OldPassword)
+		cp, err := u.isCorrectPassword(db, f.OldPassword)
 		if err != nil {
-			return "", err
+			return "", "", err
 		}
 		if !cp {
-			return "Incorrect old password", nil
+			return "OldPassword", "Incorrect old password", nil
 		}
 	}
 
-	if len(c.Form.NewPassword) < MIN_PASS_LEN {
-		passwordError = "Passwords is too short"
-	} else if c.Form.ConfirmNewPassword != c.Form.NewPassword {
-		passwordError = "New password doesn't match confirmation"
+	if len(f.NewPassword) < MIN_PASS_LEN {
+		return "NewPassword", "Passwords is too short", nil
+	} else if f.ConfirmNewPassword != f.NewPassword {
+		return "ConfirmNewPassword", "New password doesn't match confirmation", nil
+	}
+	if err = hs.run(passwordChangeHook, u, r); err != nil {
+		return
 	}
-	err = u.changePassword(h.db, c.Form.NewPassword)
+	err = u.changePassword(db, f.NewPassword)
 	return
 }
@@ -0,0 +1,275 @@
+package account
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/schema"
+	"github.com/gorilla/sessions"
+)
+
+// DefaultDeletionGracePeriod is how long users have to change their mind
+// after asking for their account to be deleted.
+const DefaultDeletionGracePeriod = 14 * 24 * time.Hour
+
+// Users without a password confirm deletion by having logged in recently.
+const deletionReauthWindow = 10 * time.Minute
+
+const deletionPollInterval = time.Hour
+
+func (u *User) setDeletionScheduled(t int64) {
+	if t != 0 {
+		u.deletionDue = time.Unix(t, 0)
+	}
+}
+
+// DeletionDue returns when the user's account is due to be deleted, or the
+// zero time if they have not asked for it.
+func (u *User) DeletionDue() time.Time {
+	return u.deletionDue
+}
+
+// scheduleDeletion marks the user for deletion at due.  Until then the
+// account can be recovered by logging in, but all its sessions and tokens
+// are revoked straight away.
+func scheduleDeletion(db *sql.DB, userID int64, due time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE Users SET deletion_scheduled = ? WHERE id = ?", due.Unix(), userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, q := range []string{
+		"DELETE FROM Sessions WHERE user_id = ?",
+		"DELETE FROM RefreshTokens WHERE user_id = ?",
+		"DELETE FROM ApiTokens WHERE user_id = ?",
+		"DELETE FROM OAuthTokens WHERE user_id = ?",
+		"DELETE FROM OAuthCodes WHERE user_id = ?",
+	} {
+		if _, err := tx.Exec(q, userID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// cancelDeletion calls off the user's pending deletion, if any.  Logging in
+// during the grace period does so.
+func cancelDeletion(db *sql.DB, r *http.Request, u *User) error {
+	if u.deletionDue.IsZero() {
+		return nil
+	}
+	if _, err := db.Exec("UPDATE Users SET deletion_scheduled = 0 WHERE id = ?", u.ID); err != nil {
+		return err
+	}
+	u.deletionDue = time.Time{}
+	audit(db, r, u.ID, u.ID, auditDeletionCancelled, nil)
+	return nil
+}
+
+// purgeDeletions deletes the users whose grace period ended by now, asking
+// providers to forget them on the way out.  It returns how many it deleted.
+func purgeDeletions(db *sql.DB, fb *oAuthFacebook, hs hooks, now time.Time) (int, error) {
+	rows, err := db.Query(
+		"SELECT id FROM Users WHERE deletion_scheduled != 0 AND deletion_scheduled <= ?", now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, id := range ids {
+		// Owners who stopped sharing an organization during the grace
+		// period wait until they hand it over.
+		if c, err := countSoleOwnedOrgs(db, id); err != nil {
+			return n, err
+		} else if c != 0 {
+			log.Printf("not deleting user %v: %v", id, errSoleOrgOwner)
+			continue
+		}
+		u, err := loadUserByID(db, id)
+		if err != nil {
+			return n, err
+		}
+		aus, err := loadAuthUsers(db, u)
+		if err != nil {
+			return n, err
+		}
+		for _, au := range aus {
+			if au.authType == "facebook" && fb != nil {
+				if err := fb.revoke(au); err != nil {
+					log.Printf("unable to revoke facebook grant of user %v: %v", id, err)
+				}
+			}
+		}
+		if err := deleteUser(db, id); err != nil {
+			return n, err
+		}
+		n++
+		audit(db, nil, id, id, auditDeleted, nil)
+		// There is no request behind a scheduled deletion.
+		hs.notify(afterDeleteHook, u, nil)
+	}
+	return n, nil
+}
+
+// RunScheduledDeletions deletes accounts whose grace period has ended, until
+// stop is closed.
+func (am AccountManager) RunScheduledDeletions(stop <-chan struct{}) {
+	t := time.NewTicker(deletionPollInterval)
+	defer t.Stop()
+	for {
+		if _, err := purgeDeletions(am.db, am.fb, am.hooks, time.Now()); err != nil {
+			log.Print("unable to delete scheduled accounts ", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// SetDeletionGracePeriod changes how long users have to change their mind
+// after asking for their account to be deleted.  It must be called before
+// CreateRoutes.
+func (am *AccountManager) SetDeletionGracePeriod(d time.Duration) {
+	am.deletionGrace = d
+}
+
+type deleteAccountForm struct {
+	Password string
+	Token    string `schema:"csrf_token"`
+}
+
+type deleteAccountContext struct {
+	Form        *deleteAccountForm
+	HasPassword bool
+	GraceDays   int
+	Error       string
+	Due         time.Time
+}
+
+func (c *deleteAccountContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+type deleteAccountHandler struct {
+	db    *sql.DB
+	s     sessions.Store
+	hooks hooks
+	grace time.Duration
+}
+
+func newDeleteAccountHandler(db *sql.DB, s sessions.Store, hs hooks, grace time.Duration) *deleteAccountHandler {
+	return &deleteAccountHandler{db, s, hs, grace}
+}
+
+func (h deleteAccountHandler) context(u *User) (*deleteAccountContext, error) {
+	hp, err := u.HasPassword(h.db)
+	if err != nil {
+		return nil, err
+	}
+	return &deleteAccountContext{
+		Form:        &deleteAccountForm{},
+		HasPassword: hp,
+		GraceDays:   int(h.grace / (24 * time.Hour))}, nil
+}
+
+func (h deleteAccountHandler) get(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	c, err := h.context(u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateHandler("delete_account.html", c, w, r)
+}
+
+// reauthenticate checks the user making the request is who they say they
+// are, returning a message for them if not.
+func (h deleteAccountHandler) reauthenticate(u *User, c *deleteAccountContext, r *http.Request) (string, error) {
+	if c.HasPassword {
+		cp, err := u.isCorrectPassword(h.db, c.Form.Password)
+		if err != nil || cp {
+			return "", err
+		}
+		return "Incorrect password", nil
+	}
+	created, err := sessionCreated(h.db, h.s, r)
+	if err != nil {
+		return "", err
+	}
+	if time.Since(created) > deletionReauthWindow {
+		return "Please log out and log in again to confirm it's you", nil
+	}
+	return "", nil
+}
+
+func (h deleteAccountHandler) post(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	c, err := h.context(u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := schema.NewDecoder().Decode(c.Form, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if c.Error, err = h.reauthenticate(u, c, r); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(c.Error) == 0 {
+		if err := h.hooks.run(deleteHook, u, r); err != nil {
+			c.Error = err.Error()
+		}
+	}
+	if len(c.Error) != 0 {
+		templateHandler("delete_account.html", c, w, r)
+		return
+	}
+
+	due := time.Now().Add(h.grace)
+	if err := scheduleDeletion(h.db, u.ID, due); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.db, r, u.ID, u.ID, auditDeletionScheduled,
+		map[string]string{"due": due.UTC().Format(time.RFC3339)})
+	clearSession(w)
+	c.Due = due
+	templateHandler("delete_account.html", c, w, r)
+}
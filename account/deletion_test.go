@@ -0,0 +1,115 @@
+package account
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+func TestScheduledDeletion(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	am := NewAccountManager(sessions.NewCookieStore([]byte("secret")), db,
+		"http://localhost", NewFacebookClient("", ""))
+	mx := mux.NewRouter()
+	if err := am.CreateRoutes(mx.PathPrefix("/account").Subrouter()); err != nil {
+		t.Fatal(err)
+	}
+
+	u := newUser("a@b.com")
+	u.setPassword("foobar")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduleDeletion(db, u.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := purgeDeletions(db, nil, am.hooks, time.Now()); err != nil || n != 0 {
+		t.Fatalf("Expected nothing to be due, got %v %v", n, err)
+	}
+
+	r := httptest.NewRequest("POST", "/account/api/v1/login",
+		strings.NewReader(`{"email": "a@b.com", "password": "foobar"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	mx.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected login to succeed, got %v %v", w.Code, w.Body)
+	}
+	if u2, err := loadUserByID(db, u.ID); err != nil || !u2.DeletionDue().IsZero() {
+		t.Fatalf("Expected login to cancel deletion, got %v %v", u2, err)
+	}
+
+	if err := scheduleDeletion(db, u.ID, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if ss, err := loadUserSessions(db, u.ID); err != nil || len(ss) != 0 {
+		t.Errorf("Expected sessions to be revoked, got %v %v", ss, err)
+	}
+	if n, err := purgeDeletions(db, nil, am.hooks, time.Now()); err != nil || n != 1 {
+		t.Fatalf("Expected one deletion, got %v %v", n, err)
+	}
+	if _, err := loadUserByID(db, u.ID); err != sql.ErrNoRows {
+		t.Errorf("Expected user to be deleted, got %v", err)
+	}
+	es, _, err := loadAuditEvents(db, &auditQuery{UserID: u.ID, Type: auditDeleted})
+	if err != nil || len(es) != 1 {
+		t.Errorf("Expected deletion to be audited, got %v %v", es, err)
+	}
+}
+
+func TestSoleOwnerDeletion(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	am := NewAccountManager(sessions.NewCookieStore([]byte("secret")), db,
+		"http://localhost", NewFacebookClient("", ""))
+	owner := newUser("owner@email.com")
+	other := newUser("other@email.com")
+	for _, u := range []*User{owner, other} {
+		if err := u.insert(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o, err := createOrganization(db, "Acme", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/", nil)
+	if err := am.hooks.run(deleteHook, owner, r); err == nil {
+		t.Errorf("Expected deleting the only owner to be vetoed")
+	}
+
+	if err := addOrgMember(db, o.ID, other.ID, OrgOwner); err != nil {
+		t.Fatal(err)
+	}
+	if err := am.hooks.run(deleteHook, owner, r); err != nil {
+		t.Fatalf("Expected an owner to be deleted when another remains, got %v", err)
+	}
+	if err := scheduleDeletion(db, owner.ID, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// The other owner leaving during the grace period holds the deletion.
+	if _, err := db.Exec("DELETE FROM OrgMembers WHERE user_id = ?", other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := purgeDeletions(db, nil, am.hooks, time.Now()); err != nil || n != 0 {
+		t.Errorf("Expected the only owner not to be deleted, got %v %v", n, err)
+	}
+	if _, err := loadMembership(db, o.ID, owner.ID); err != nil {
+		t.Errorf("Expected the organization to keep its owner, got %v", err)
+	}
+}
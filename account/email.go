@@ -0,0 +1,152 @@
+package account
+
+import (
+	"database/sql"
+	"errors"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// FoldEmailLocalPart makes addresses be stored with the part before the @
+// lowercased too.  Lookups ignore case either way, so it only changes how
+// addresses are kept and shown.  It must be set before the AccountManager
+// starts serving requests.
+var FoldEmailLocalPart = true
+
+var errInvalidEmail = errors.New("invalid email address")
+
+// normalizeEmail returns the form addresses are stored and looked up in:
+// without surrounding space or display name, with the domain lowercased and
+// in punycode, and the local part lowercased if FoldEmailLocalPart is set.
+func normalizeEmail(email string) (string, error) {
+	// mail.ParseAddress refuses fully qualified domains, ending in a dot, so
+	// drop the dot first.
+	email = strings.TrimSpace(email)
+	if strings.HasSuffix(email, ".>") {
+		email = email[:len(email)-2] + ">"
+	}
+	a, err := mail.ParseAddress(strings.TrimSuffix(email, "."))
+	if err != nil {
+		return "", errInvalidEmail
+	}
+	i := strings.LastIndex(a.Address, "@")
+	if i < 0 {
+		return "", errInvalidEmail
+	}
+	local, domain := a.Address[:i], a.Address[i+1:]
+	domain, err = idna.Lookup.ToASCII(domain)
+	if err != nil || domain == "" {
+		return "", errInvalidEmail
+	}
+	if FoldEmailLocalPart {
+		local = strings.ToLower(local)
+	}
+	return local + "@" + strings.ToLower(domain), nil
+}
+
+// EmailDuplicate lists the users whose stored addresses normalize to the
+// same one.  They have to be merged or told apart by hand.
+type EmailDuplicate struct {
+	Email   string
+	UserIDs []int64
+}
+
+// NormalizeStoredEmails brings addresses stored before normalization into
+// normal form, as a one off migration.  Addresses held by several users once
+// normalized, or several times by one user, are left alone and returned.
+// Once there are none, databases created before addresses were unique
+// regardless of case are given unique indexes ignoring case.  Nothing is
+// changed unless every step succeeds.
+func NormalizeStoredEmails(db *sql.DB) ([]*EmailDuplicate, error) {
+	type stored struct {
+		userID int64
+		email  string
+		// userEmailsRow is set for addresses from UserEmails.
+		userEmailsRow bool
+	}
+	byKey := make(map[string][]stored)
+	for i, q := range []string{
+		"SELECT id, email FROM Users",
+		"SELECT user_id, email FROM UserEmails",
+	} {
+		rows, err := db.Query(q)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			s := stored{userEmailsRow: i == 1}
+			if err := rows.Scan(&s.userID, &s.email); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			n, err := normalizeEmail(s.email)
+			if err != nil {
+				// Leave addresses we can't parse as they are.
+				continue
+			}
+			byKey[strings.ToLower(n)] = append(byKey[strings.ToLower(n)], s)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var dups []*EmailDuplicate
+	for _, ss := range byKey {
+		ids := make(map[int64]bool)
+		rows := 0
+		for _, s := range ss {
+			ids[s.userID] = true
+			if s.userEmailsRow {
+				rows++
+			}
+		}
+		n, _ := normalizeEmail(ss[0].email)
+		if len(ids) > 1 || rows > 1 {
+			d := &EmailDuplicate{Email: n}
+			for id := range ids {
+				d.UserIDs = append(d.UserIDs, id)
+			}
+			sort.Slice(d.UserIDs, func(i, j int) bool { return d.UserIDs[i] < d.UserIDs[j] })
+			dups = append(dups, d)
+			continue
+		}
+		for _, s := range ss {
+			if s.email == n {
+				continue
+			}
+			if _, err := tx.Exec("UPDATE Users SET email = ? WHERE id = ? AND email = ?", n, s.userID, s.email); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			if _, err := tx.Exec("UPDATE UserEmails SET email = ? WHERE user_id = ? AND email = ?", n, s.userID, s.email); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+	}
+	if len(dups) == 0 {
+		for _, q := range []string{
+			"CREATE UNIQUE INDEX IF NOT EXISTS users_email_nocase ON Users (email COLLATE NOCASE)",
+			"CREATE UNIQUE INDEX IF NOT EXISTS user_emails_email_nocase ON UserEmails (email COLLATE NOCASE)",
+		} {
+			if _, err := tx.Exec(q); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	sort.Slice(dups, func(i, j int) bool { return dups[i].Email < dups[j].Email })
+	return dups, nil
+}
@@ -0,0 +1,484 @@
+package account
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/schema"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// emailChangeTTL is how long the new address has to confirm a change.
+	emailChangeTTL = 24 * time.Hour
+	// emailRevertTTL is how long the old address can undo a change, should
+	// someone else have made it.
+	emailRevertTTL = 7 * 24 * time.Hour
+)
+
+var (
+	errInvalidEmailChange = errors.New("invalid or expired email change link")
+	errEmailInUse         = errors.New("email address already in use")
+	// errEmailChangedRecently refuses changes while an earlier one may be
+	// reverted.
+	errEmailChangedRecently = errors.New("email address changed recently")
+)
+
+// emailChange is a request to move a user to a new address.  It is pending
+// until the new address confirms it, after which the old address may revert
+// it until it expires.
+type emailChange struct {
+	ID         int64
+	UserID     int64
+	OldEmail   string
+	NewEmail   string
+	Expiration time.Time
+}
+
+// requestEmailChange records that u wants to use newEmail, replacing any
+// change they had pending, and returns the secret confirming it.
+func requestEmailChange(db *sql.DB, u *User, newEmail string) (string, error) {
+	secret, err := randomSecret("")
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.Exec("DELETE FROM EmailChanges WHERE user_id = ? AND confirmed = 0", u.ID); err != nil {
+		return "", err
+	}
+	_, err = db.Exec(
+		"INSERT INTO EmailChanges (user_id, old_email, new_email, token_hash, expiration) VALUES ($1, $2, $3, $4, $5)",
+		u.ID, u.Email, newEmail, hashSecret(secret), time.Now().Add(emailChangeTTL).Unix())
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func loadEmailChange(db *sql.DB, query, secret string) (*emailChange, error) {
+	c := &emailChange{}
+	var expiration int64
+	err := db.QueryRow(
+		"SELECT id, user_id, old_email, new_email, expiration FROM EmailChanges WHERE "+query,
+		hashSecret(secret)).
+		Scan(&c.ID, &c.UserID, &c.OldEmail, &c.NewEmail, &expiration)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidEmailChange
+	} else if err != nil {
+		return nil, err
+	}
+	c.Expiration = time.Unix(expiration, 0)
+	if time.Now().After(c.Expiration) {
+		return nil, errInvalidEmailChange
+	}
+	return c, nil
+}
+
+// loadRevertableEmailChange returns the user's confirmed change which the
+// old address may still revert, or nil.  Further changes wait until it
+// expires, so the revert link always puts the user back on their old
+// address.
+func loadRevertableEmailChange(db *sql.DB, userID int64) (*emailChange, error) {
+	c := &emailChange{}
+	var expiration int64
+	err := db.QueryRow(
+		"SELECT id, user_id, old_email, new_email, expiration FROM EmailChanges WHERE user_id = ? AND confirmed = 1 AND expiration > ? ORDER BY expiration DESC LIMIT 1",
+		userID, time.Now().Unix()).
+		Scan(&c.ID, &c.UserID, &c.OldEmail, &c.NewEmail, &expiration)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c.Expiration = time.Unix(expiration, 0)
+	return c, nil
+}
+
+// checkEmailReserved fails with errEmailInUse if email is the old address
+// of another user's change which may still be reverted, holding it for them
+// to go back to.
+func checkEmailReserved(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, email string, userID int64) error {
+	var n int
+	err := q.QueryRow(
+		"SELECT COUNT(*) FROM EmailChanges WHERE old_email = ? AND user_id != ? AND confirmed = 1 AND expiration > ?",
+		email, userID, time.Now().Unix()).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n != 0 {
+		return errEmailInUse
+	}
+	return nil
+}
+
+// swapEmail moves the user's primary address from one address to another
+// within tx, failing with errEmailInUse if another account took the address
+// in the meantime.  Changing from an address the user no longer has is
+// refused.
+func swapEmail(tx *sql.Tx, userID int64, from, to string) error {
+	if err := checkEmailReserved(tx, to, userID); err != nil {
+		return err
+	}
+	// The user may have added the address as a secondary one already.
+	_, err := tx.Exec("DELETE FROM UserEmails WHERE user_id = ? AND email = ?", userID, to)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"UPDATE UserEmails SET email = ?, verified = 1, token_hash = NULL, expiration = 0 WHERE user_id = ? AND email = ?",
+		to, userID, from)
+	if isExistingUserError(err) {
+		return errEmailInUse
+	} else if err != nil {
+		return err
+	}
+	r, err := tx.Exec(
+		"UPDATE Users SET email = ?, email_verified = 1 WHERE id = ? AND email = ?",
+		to, userID, from)
+	if isExistingUserError(err) {
+		return errEmailInUse
+	} else if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errInvalidEmailChange
+	}
+	return nil
+}
+
+// confirmEmailChange switches the user to the new address of the pending
+// change secret confirms, returning the change and a secret for the old
+// address to revert it.
+func confirmEmailChange(db *sql.DB, secret string) (*emailChange, string, error) {
+	c, err := loadEmailChange(db, "token_hash = ? AND confirmed = 0", secret)
+	if err != nil {
+		return nil, "", err
+	}
+	revert, err := randomSecret("")
+	if err != nil {
+		return nil, "", err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := swapEmail(tx, c.UserID, c.OldEmail, c.NewEmail); err != nil {
+		tx.Rollback()
+		return nil, "", err
+	}
+	c.Expiration = time.Now().Add(emailRevertTTL)
+	_, err = tx.Exec(
+		"UPDATE EmailChanges SET confirmed = 1, revert_hash = ?, expiration = ? WHERE id = ?",
+		hashSecret(revert), c.Expiration.Unix(), c.ID)
+	if err != nil {
+		tx.Rollback()
+		return nil, "", err
+	}
+	return c, revert, tx.Commit()
+}
+
+// revertEmailChange puts the user back on their old address, whatever
+// their address is now, and logs them out everywhere and revokes their API
+// and OAuth tokens, as whoever changed it may still hold any of them.
+func revertEmailChange(db *sql.DB, secret string) (*emailChange, error) {
+	c, err := loadEmailChange(db, "revert_hash = ? AND confirmed = 1", secret)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var current string
+	if err := tx.QueryRow("SELECT email FROM Users WHERE id = ?", c.UserID).Scan(&current); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := swapEmail(tx, c.UserID, current, c.OldEmail); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM EmailChanges WHERE id = ?", c.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for _, q := range []string{
+		"DELETE FROM ApiTokens WHERE user_id = ?",
+		"DELETE FROM OAuthTokens WHERE user_id = ?",
+	} {
+		if _, err := tx.Exec(q, c.UserID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return c, deleteUserSessions(db, c.UserID)
+}
+
+type changeEmailForm struct {
+	NewEmail string
+	Password string
+	Token    string `schema:"csrf_token"`
+}
+
+type changeEmailContext struct {
+	Form        *changeEmailForm
+	Email       string
+	HasPassword bool
+	Error       string
+	Message     string
+}
+
+func (c *changeEmailContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+// emailChangeLinkContext asks the user following a link from an email to
+// confirm its action, so that merely fetching the link changes nothing.
+type emailChangeLinkContext struct {
+	Action string
+	Secret string
+	Prompt string
+	Submit string
+	Error  string
+	Token  string
+}
+
+func (c *emailChangeLinkContext) setToken(t string) {
+	c.Token = t
+}
+
+// emailChangeResultContext reports the outcome of following a link from an
+// email.
+type emailChangeResultContext struct {
+	Error   string
+	Message string
+}
+
+type emailChangeHandler struct {
+	db     *sql.DB
+	s      sessions.Store
+	mailer Mailer
+	// base is the absolute url of the account routes, for links in emails.
+	base string
+}
+
+func newEmailChangeHandler(db *sql.DB, s sessions.Store, m Mailer, base string) *emailChangeHandler {
+	return &emailChangeHandler{db, s, m, base}
+}
+
+func (h emailChangeHandler) context(u *User) (*changeEmailContext, error) {
+	hp, err := u.HasPassword(h.db)
+	if err != nil {
+		return nil, err
+	}
+	return &changeEmailContext{Form: &changeEmailForm{}, Email: u.Email, HasPassword: hp}, nil
+}
+
+func (h emailChangeHandler) get(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	c, err := h.context(u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateHandler("change_email.html", c, w, r)
+}
+
+// checkPassword returns why password does not confirm a sensitive change
+// to u's account, or the empty string if it does.  Users without a
+// password, who log in through a provider, aren't asked for one.
+func checkPassword(db *sql.DB, u *User, password string) (string, error) {
+	hp, err := u.HasPassword(db)
+	if err != nil || !hp {
+		return "", err
+	}
+	cp, err := u.isCorrectPassword(db, password)
+	if err != nil {
+		return "", err
+	}
+	if !cp {
+		return "Incorrect password", nil
+	}
+	return "", nil
+}
+
+// validate checks the form, returning a message for the user if it is not
+// acceptable.
+func (h emailChangeHandler) validate(u *User, c *changeEmailContext) (string, error) {
+	if msg, err := checkPassword(h.db, u, c.Form.Password); len(msg) != 0 || err != nil {
+		return msg, err
+	}
+	if rc, err := loadRevertableEmailChange(h.db, u.ID); err != nil {
+		return "", err
+	} else if rc != nil {
+		return "Your email address was changed recently.  It can be changed again after " +
+			rc.Expiration.Format("January 2"), nil
+	}
+	email, err := normalizeEmail(c.Form.NewEmail)
+	if err != nil {
+		return "Invalid email address", nil
+	}
+	c.Form.NewEmail = email
+	if c.Form.NewEmail == u.Email {
+		return "That is already your email address", nil
+	}
+	if o, err := loadUserByEmail(h.db, c.Form.NewEmail); err == nil && o.ID != u.ID {
+		return "Email address already in use", nil
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+	if err := checkEmailReserved(h.db, c.Form.NewEmail, u.ID); err == errEmailInUse {
+		return "Email address already in use", nil
+	} else if err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+func (h emailChangeHandler) post(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	c, err := h.context(u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := schema.NewDecoder().Decode(c.Form, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if c.Error, err = h.validate(u, c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(c.Error) != 0 {
+		templateHandler("change_email.html", c, w, r)
+		return
+	}
+
+	secret, err := requestEmailChange(h.db, u, c.Form.NewEmail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = h.mailer.SendMail(c.Form.NewEmail, "Confirm your new email address",
+		"Follow this link within a day to start using this address for your account:\n\n"+
+			h.base+"/confirm_email?token="+url.QueryEscape(secret)+"\n")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = h.mailer.SendMail(u.Email, "Your email address is being changed",
+		"Someone asked to change the address of your account to "+c.Form.NewEmail+".\n"+
+			"If it wasn't you, change your password.  You will be sent a link to undo\n"+
+			"the change if it is confirmed.\n")
+	if err != nil {
+		log.Printf("unable to notify user %v of email change: %v", u.ID, err)
+	}
+	audit(h.db, r, u.ID, u.ID, auditEmailChangeRequested, map[string]string{"email": c.Form.NewEmail})
+
+	nc, err := h.context(u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nc.Message = "We sent a confirmation link to " + c.Form.NewEmail
+	templateHandler("change_email.html", nc, w, r)
+}
+
+// confirmGet shows the change in the link sent to the new address, for the
+// user to confirm.  It needs no login, as the address may be opened on
+// another device.
+func (h emailChangeHandler) confirmGet(w http.ResponseWriter, r *http.Request) {
+	secret := r.URL.Query().Get("token")
+	c := &emailChangeLinkContext{Action: "confirm_email", Secret: secret, Submit: "Confirm"}
+	if ec, err := loadEmailChange(h.db, "token_hash = ? AND confirmed = 0", secret); err == errInvalidEmailChange {
+		c.Error = err.Error()
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else {
+		c.Prompt = "Use " + ec.NewEmail + " as the address of your account?"
+	}
+	templateHandler("email_change_link.html", c, w, r)
+}
+
+// confirmPost completes a change confirmed from confirmGet.
+func (h emailChangeHandler) confirmPost(w http.ResponseWriter, r *http.Request) {
+	c, revert, err := confirmEmailChange(h.db, r.PostFormValue("token"))
+	if err == errInvalidEmailChange || err == errEmailInUse {
+		w.WriteHeader(http.StatusBadRequest)
+		pageHandler("email_change_result.html", &emailChangeResultContext{Error: err.Error()}, w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = h.mailer.SendMail(c.OldEmail, "Your email address was changed",
+		"The address of your account was changed to "+c.NewEmail+".\n"+
+			"If it wasn't you, follow this link within a week to undo it:\n\n"+
+			h.base+"/revert_email?token="+url.QueryEscape(revert)+"\n")
+	if err != nil {
+		log.Printf("unable to send email change revert link to user %v: %v", c.UserID, err)
+	}
+	audit(h.db, r, c.UserID, c.UserID, auditEmailChange,
+		map[string]string{"old": c.OldEmail, "new": c.NewEmail})
+	pageHandler("email_change_result.html", &emailChangeResultContext{
+		Message: "Your email address is now " + c.NewEmail}, w, r)
+}
+
+// revertGet shows the change in the link sent to the old address, for the
+// user to undo.
+func (h emailChangeHandler) revertGet(w http.ResponseWriter, r *http.Request) {
+	secret := r.URL.Query().Get("token")
+	c := &emailChangeLinkContext{Action: "revert_email", Secret: secret, Submit: "Undo the change"}
+	if ec, err := loadEmailChange(h.db, "revert_hash = ? AND confirmed = 1", secret); err == errInvalidEmailChange {
+		c.Error = err.Error()
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else {
+		c.Prompt = "Change the address of your account back to " + ec.OldEmail +
+			"?  You will be logged out everywhere and your API tokens and app authorizations revoked."
+	}
+	templateHandler("email_change_link.html", c, w, r)
+}
+
+// revertPost undoes a change confirmed from revertGet.
+func (h emailChangeHandler) revertPost(w http.ResponseWriter, r *http.Request) {
+	c, err := revertEmailChange(h.db, r.PostFormValue("token"))
+	if err == errInvalidEmailChange || err == errEmailInUse {
+		w.WriteHeader(http.StatusBadRequest)
+		pageHandler("email_change_result.html", &emailChangeResultContext{Error: err.Error()}, w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.db, r, c.UserID, c.UserID, auditEmailChangeReverted,
+		map[string]string{"old": c.NewEmail, "new": c.OldEmail})
+	pageHandler("email_change_result.html", &emailChangeResultContext{
+		Message: "Your email address is " + c.OldEmail + " again and you have been logged out " +
+			"everywhere.  Log in, change your password and create new API tokens."}, w, r)
+}
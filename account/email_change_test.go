@@ -0,0 +1,182 @@
+package account
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmailChange(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("old@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	other := newUser("taken@email.com")
+	if err := other.insert(db); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := requestEmailChange(db, u, "taken@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := confirmEmailChange(db, secret); err != errEmailInUse {
+		t.Errorf("Expected collision to be refused, got %v", err)
+	}
+
+	secret, err = requestEmailChange(db, u, "new@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := confirmEmailChange(db, "wrong"); err != errInvalidEmailChange {
+		t.Errorf("Expected wrong token to be refused, got %v", err)
+	}
+	c, revert, err := confirmEmailChange(db, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.OldEmail != "old@email.com" || c.NewEmail != "new@email.com" {
+		t.Errorf("Got wrong change %+v", c)
+	}
+	if _, _, err := confirmEmailChange(db, secret); err != errInvalidEmailChange {
+		t.Errorf("Expected token to be single use, got %v", err)
+	}
+	u2, err := loadUserByID(db, u.ID)
+	if err != nil || u2.Email != "new@email.com" || !u2.EmailVerified {
+		t.Fatalf("Expected new verified address, got %v %v", u2, err)
+	}
+
+	at, apiSecret, err := newAPIToken(u.ID, "cli", []string{"profile"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := at.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	var oauthSecrets []string
+	for _, typ := range []string{"access", "refresh"} {
+		secret, err := newOAuthToken(db, "", typ, "client", u.ID, []string{"profile"}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oauthSecrets = append(oauthSecrets, secret)
+	}
+
+	if _, err := revertEmailChange(db, revert); err != nil {
+		t.Fatal(err)
+	}
+	u2, err = loadUserByID(db, u.ID)
+	if err != nil || u2.Email != "old@email.com" {
+		t.Fatalf("Expected old address to be restored, got %v %v", u2, err)
+	}
+	if _, _, err := loadUserByAPIToken(db, apiSecret); err == nil {
+		t.Errorf("Expected the API token to be revoked")
+	}
+	for _, secret := range oauthSecrets {
+		if _, err := loadOAuthToken(db, secret); err == nil {
+			t.Errorf("Expected the OAuth tokens to be revoked")
+		}
+	}
+	if _, err := revertEmailChange(db, revert); err != errInvalidEmailChange {
+		t.Errorf("Expected revert to be single use, got %v", err)
+	}
+}
+
+func TestEmailChangeRevertWindow(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("old@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := requestEmailChange(db, u, "new@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, revert, err := confirmEmailChange(db, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := loadRevertableEmailChange(db, u.ID); err != nil || c == nil {
+		t.Errorf("Expected further changes to wait for the revert window, got %v %v", c, err)
+	}
+
+	// The old address is held until the change can no longer be reverted.
+	squatter := newUser("old@email.com")
+	if err := squatter.insert(db); !isExistingUserError(err) {
+		t.Errorf("Expected old address to be reserved, got %v", err)
+	}
+	other := newUser("other@email.com")
+	if err := other.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := addUserEmail(db, other.ID, "old@email.com"); err != errEmailInUse {
+		t.Errorf("Expected old address to be reserved, got %v", err)
+	}
+
+	// Whatever the address is now, revert restores the old one.
+	if _, err := db.Exec("UPDATE Users SET email = 'later@email.com' WHERE id = ?", u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE UserEmails SET email = 'later@email.com' WHERE user_id = ?", u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := revertEmailChange(db, revert); err != nil {
+		t.Fatal(err)
+	}
+	u2, err := loadUserByID(db, u.ID)
+	if err != nil || u2.Email != "old@email.com" {
+		t.Fatalf("Expected old address to be restored, got %v %v", u2, err)
+	}
+}
+
+func TestEmailChangeLinksNeedAPost(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+	if err := InitializeTemplates("../"); err != nil {
+		t.Fatal(err)
+	}
+
+	u := newUser("old@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := requestEmailChange(db, u, "new@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newEmailChangeHandler(db, nil, &testMailer{}, "http://localhost/account")
+
+	w := httptest.NewRecorder()
+	h.confirmGet(w, httptest.NewRequest("GET", "/confirm_email?token="+url.QueryEscape(secret), nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `method="post"`) {
+		t.Errorf("Expected a form to confirm the change, got %v %v", w.Code, w.Body)
+	}
+	if u2, _ := loadUserByID(db, u.ID); u2.Email != "old@email.com" {
+		t.Errorf("Expected following the link to change nothing, got %v", u2.Email)
+	}
+
+	r := httptest.NewRequest("POST", "/confirm_email", strings.NewReader("token="+url.QueryEscape(secret)))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	h.confirmPost(w, r)
+	if u2, _ := loadUserByID(db, u.ID); w.Code != http.StatusOK || u2.Email != "new@email.com" {
+		t.Errorf("Expected posting the form to change the address, got %v %v", w.Code, u2.Email)
+	}
+}
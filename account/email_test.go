@@ -0,0 +1,85 @@
+package account
+
+import (
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	for _, c := range []struct {
+		in, want string
+	}{
+		{" Bob@Example.COM ", "bob@example.com"},
+		{"Bob Smith <bob@example.com>", "bob@example.com"},
+		{"bob@example.com.", "bob@example.com"},
+		{"Bob <bob@example.com.>", "bob@example.com"},
+		{"bob@bücher.de", "bob@xn--bcher-kva.de"},
+	} {
+		if got, err := normalizeEmail(c.in); err != nil || got != c.want {
+			t.Errorf("normalizeEmail(%q) = %q, %v, want %q", c.in, got, err, c.want)
+		}
+	}
+	if _, err := normalizeEmail("not an address"); err != errInvalidEmail {
+		t.Errorf("Expected invalid address error, got %v", err)
+	}
+
+	FoldEmailLocalPart = false
+	defer func() { FoldEmailLocalPart = true }()
+	if got, _ := normalizeEmail("Bob@Example.com"); got != "Bob@example.com" {
+		t.Errorf("Expected local part to be kept, got %q", got)
+	}
+}
+
+func TestCaseInsensitiveEmail(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	f := newSignupForm()
+	f.Email, f.Password, f.Password2 = "Bob@Example.com", "foobar", "foobar"
+	if !f.validate() {
+		t.Fatalf("Expected form to validate, got %v", f.Errors)
+	}
+	u, err := f.createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "bob@example.com" {
+		t.Errorf("Expected normalized address, got %v", u.Email)
+	}
+	if u2, err := loadUserByEmail(db, "BOB@example.com"); err != nil || u2.ID != u.ID {
+		t.Errorf("Expected lookup to ignore case, got %v %v", u2, err)
+	}
+	if _, err := db.Exec("INSERT INTO Users (email) VALUES ('BOB@EXAMPLE.COM')"); !isExistingUserError(err) {
+		t.Errorf("Expected case insensitive uniqueness, got %v", err)
+	}
+}
+
+func TestNormalizeStoredEmails(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("bob@example.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	// As stored before addresses were normalized.
+	if _, err := db.Exec("UPDATE Users SET email = 'Bob@Example.COM' WHERE id = ?", u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE UserEmails SET email = 'Bob@Example.COM' WHERE user_id = ?", u.ID); err != nil {
+		t.Fatal(err)
+	}
+	dups, err := NormalizeStoredEmails(db)
+	if err != nil || len(dups) != 0 {
+		t.Fatalf("Expected no duplicates, got %v %v", dups, err)
+	}
+	u2, err := loadUserByID(db, u.ID)
+	if err != nil || u2.Email != "bob@example.com" {
+		t.Errorf("Expected stored address to be normalized, got %v %v", u2, err)
+	}
+}
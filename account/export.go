@@ -0,0 +1,366 @@
+package account
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Exporter returns the host application's data about u for inclusion in
+// their data export.  The value is marshalled as json.
+type Exporter func(u *User) (interface{}, error)
+
+// exporters holds the registered exporters by name.  Like hooks it is a map
+// so copies of AccountManager share it.
+type exporters map[string]Exporter
+
+// OnExport registers e to contribute the host application's data about a
+// user to their data export, under name.  Exporters must be registered before
+// the AccountManager starts serving requests.
+func (am AccountManager) OnExport(name string, e Exporter) {
+	am.exporters[name] = e
+}
+
+// userExport is everything held about a user, as handed to them on request.
+// Secrets such as password hashes and token hashes are left out.
+type userExport struct {
+	Exported     time.Time                  `json:"exported"`
+	User         *exportUser                `json:"user"`
+	Emails       []*exportEmail             `json:"emails"`
+	Roles        []string                   `json:"roles"`
+	Identities   []*apiProvider             `json:"identities"`
+	Sessions     []*exportSession           `json:"sessions"`
+	APITokens    []*exportAPIToken          `json:"apiTokens"`
+	OAuthClients []*exportOAuthClient       `json:"oauthClients"`
+	Invitations  []*exportInvitation        `json:"invitations"`
+	Memberships  []*exportMembership        `json:"memberships"`
+	OrgInvites   []*exportOrgInvitation     `json:"orgInvitations"`
+	JoinRequests []*exportJoinRequest       `json:"joinRequests"`
+	AuditEvents  []*exportAuditEvent        `json:"auditEvents"`
+	Settings     map[string]json.RawMessage `json:"settings"`
+	Application  map[string]interface{}     `json:"application,omitempty"`
+}
+
+type exportUser struct {
+	ID            int64     `json:"id"`
+	Email         string    `json:"email"`
+	Username      string    `json:"username,omitempty"`
+	EmailVerified bool      `json:"emailVerified"`
+	HasPassword   bool      `json:"hasPassword"`
+	Created       time.Time `json:"created"`
+	DisplayName   string    `json:"displayName,omitempty"`
+	AvatarURL     string    `json:"avatarUrl,omitempty"`
+	Locale        string    `json:"locale,omitempty"`
+	Timezone      string    `json:"timezone,omitempty"`
+	Bio           string    `json:"bio,omitempty"`
+	// InvitedBy is the id of the user whose invitation they signed up with.
+	InvitedBy int64 `json:"invitedBy,omitempty"`
+}
+
+type exportEmail struct {
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
+	Primary  bool   `json:"primary"`
+}
+
+type exportSession struct {
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"lastSeen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+}
+
+type exportAPIToken struct {
+	Name    string    `json:"name"`
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+	// Expiration is nil for tokens that never expire.
+	Expiration *time.Time `json:"expiration,omitempty"`
+}
+
+type exportOAuthClient struct {
+	ClientID     string   `json:"clientId"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirectUris"`
+	Scopes       []string `json:"scopes"`
+}
+
+type exportInvitation struct {
+	Email   string    `json:"email,omitempty"`
+	MaxUses int       `json:"maxUses"`
+	Uses    int       `json:"uses"`
+	Revoked bool      `json:"revoked"`
+	Created time.Time `json:"created"`
+	// Expiration is nil for invitations that never expire.
+	Expiration *time.Time `json:"expiration,omitempty"`
+}
+
+type exportMembership struct {
+	OrgID   int64  `json:"orgId"`
+	OrgName string `json:"orgName"`
+	Role    string `json:"role"`
+}
+
+// exportOrgInvitation is a pending invitation to one of the user's verified
+// addresses.
+type exportOrgInvitation struct {
+	OrgID      int64     `json:"orgId"`
+	OrgName    string    `json:"orgName"`
+	InviterID  int64     `json:"inviterId"`
+	Email      string    `json:"email"`
+	Role       string    `json:"role"`
+	Created    time.Time `json:"created"`
+	Expiration time.Time `json:"expiration"`
+}
+
+type exportJoinRequest struct {
+	OrgID   int64     `json:"orgId"`
+	OrgName string    `json:"orgName"`
+	Status  string    `json:"status"`
+	Created time.Time `json:"created"`
+}
+
+type exportAuditEvent struct {
+	ActorID   int64             `json:"actorId"`
+	Type      string            `json:"type"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"userAgent"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Created   time.Time         `json:"created"`
+}
+
+// exportUserData gathers everything held about u, asking the registered
+// exporters for the host application's share.
+func exportUserData(db *sql.DB, es exporters, u *User) (*userExport, error) {
+	e := &userExport{Exported: time.Now().UTC()}
+
+	eu := &exportUser{
+		ID:          u.ID,
+		Username:    u.Username,
+		DisplayName: u.DisplayName,
+		AvatarURL:   u.AvatarURL,
+		Locale:      u.Locale,
+		Timezone:    u.Timezone,
+		Bio:         u.Bio}
+	err := db.QueryRow("SELECT email, email_verified, created, invited_by FROM Users WHERE id = ?", u.ID).
+		Scan(&eu.Email, &eu.EmailVerified, &eu.Created, &eu.InvitedBy)
+	if err != nil {
+		return nil, err
+	}
+	if eu.HasPassword, err = u.HasPassword(db); err != nil {
+		return nil, err
+	}
+	e.User = eu
+
+	ues, err := loadUserEmails(db, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	e.Emails = []*exportEmail{}
+	for _, ue := range ues {
+		e.Emails = append(e.Emails, &exportEmail{Email: ue.Email, Verified: ue.Verified, Primary: ue.Primary})
+	}
+
+	if e.Roles, err = loadUserRoles(db, u.ID); err != nil {
+		return nil, err
+	}
+
+	aus, err := loadAuthUsers(db, u)
+	if err != nil {
+		return nil, err
+	}
+	e.Identities = []*apiProvider{}
+	for _, au := range aus {
+		e.Identities = append(e.Identities, &apiProvider{Type: au.authType, ID: au.authID})
+	}
+
+	ss, err := loadUserSessions(db, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	e.Sessions = []*exportSession{}
+	for _, s := range ss {
+		e.Sessions = append(e.Sessions, &exportSession{
+			Created: s.Created, LastSeen: s.LastSeen, IP: s.IP, UserAgent: s.UserAgent})
+	}
+
+	ts, err := loadAPITokens(db, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	e.APITokens = []*exportAPIToken{}
+	for _, t := range ts {
+		et := &exportAPIToken{Name: t.Name, Scopes: t.Scopes, Created: t.Created}
+		if !t.Expiration.IsZero() {
+			et.Expiration = &t.Expiration
+		}
+		e.APITokens = append(e.APITokens, et)
+	}
+
+	if e.Settings, err = loadUserSettings(db, u.ID); err != nil {
+		return nil, err
+	}
+
+	cs, err := loadOAuthClientsByOwner(db, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	e.OAuthClients = []*exportOAuthClient{}
+	for _, c := range cs {
+		e.OAuthClients = append(e.OAuthClients, &exportOAuthClient{
+			ClientID: c.ClientID, Name: c.Name, RedirectURIs: c.RedirectURIs, Scopes: c.Scopes})
+	}
+
+	invs, err := loadInvitations(db, "WHERE inviter_id = ?", u.ID)
+	if err != nil {
+		return nil, err
+	}
+	e.Invitations = []*exportInvitation{}
+	for _, inv := range invs {
+		ei := &exportInvitation{
+			Email: inv.Email, MaxUses: inv.MaxUses, Uses: inv.Uses, Revoked: inv.Revoked, Created: inv.Created}
+		if !inv.Expiration.IsZero() {
+			ei.Expiration = &inv.Expiration
+		}
+		e.Invitations = append(e.Invitations, ei)
+	}
+
+	ms, err := loadUserMemberships(db, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	e.Memberships = []*exportMembership{}
+	for _, m := range ms {
+		e.Memberships = append(e.Memberships, &exportMembership{
+			OrgID: m.Organization.ID, OrgName: m.Organization.Name, Role: m.Role})
+	}
+
+	if e.OrgInvites, err = exportOrgInvitations(db, ues); err != nil {
+		return nil, err
+	}
+	if e.JoinRequests, err = exportJoinRequests(db, u.ID); err != nil {
+		return nil, err
+	}
+
+	e.AuditEvents = []*exportAuditEvent{}
+	q := &auditQuery{UserID: u.ID}
+	for more := true; more; q.Page++ {
+		var aes []*auditEvent
+		if aes, more, err = loadAuditEvents(db, q); err != nil {
+			return nil, err
+		}
+		for _, ae := range hideOthers(aes) {
+			e.AuditEvents = append(e.AuditEvents, &exportAuditEvent{
+				ActorID:   ae.ActorID,
+				Type:      ae.Type,
+				IP:        ae.IP,
+				UserAgent: ae.UserAgent,
+				Metadata:  ae.Metadata,
+				Created:   ae.Created})
+		}
+	}
+
+	if len(es) != 0 {
+		e.Application = make(map[string]interface{})
+	}
+	for name, x := range es {
+		v, err := x(u)
+		if err != nil {
+			return nil, err
+		}
+		e.Application[name] = v
+	}
+	return e, nil
+}
+
+// exportOrgInvitations returns the unexpired invitations to join an
+// organization sent to the verified addresses among ues.
+func exportOrgInvitations(db *sql.DB, ues []*userEmail) ([]*exportOrgInvitation, error) {
+	eis := []*exportOrgInvitation{}
+	for _, ue := range ues {
+		if !ue.Verified {
+			continue
+		}
+		rows, err := db.Query(
+			"SELECT o.id, o.name, i.inviter_id, i.email, i.role, i.created, i.expiration FROM OrgInvitations i "+
+				"JOIN Organizations o ON o.id = i.org_id WHERE i.email = ? AND i.expiration > ? ORDER BY i.created",
+			ue.Email, time.Now().Unix())
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			ei := &exportOrgInvitation{}
+			var expiration int64
+			if err := rows.Scan(&ei.OrgID, &ei.OrgName, &ei.InviterID, &ei.Email, &ei.Role,
+				&ei.Created, &expiration); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			ei.Expiration = time.Unix(expiration, 0).UTC()
+			eis = append(eis, ei)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return eis, nil
+}
+
+// exportJoinRequests returns the user's requests to join organizations.
+func exportJoinRequests(db *sql.DB, userID int64) ([]*exportJoinRequest, error) {
+	rows, err := db.Query(
+		"SELECT o.id, o.name, j.status, j.created FROM OrgJoinRequests j "+
+			"JOIN Organizations o ON o.id = j.org_id WHERE j.user_id = ? ORDER BY j.created",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ejs := []*exportJoinRequest{}
+	for rows.Next() {
+		ej := &exportJoinRequest{}
+		if err := rows.Scan(&ej.OrgID, &ej.OrgName, &ej.Status, &ej.Created); err != nil {
+			return nil, err
+		}
+		ejs = append(ejs, ej)
+	}
+	return ejs, rows.Err()
+}
+
+// exportHandler serves the logged in user's data as a json download.
+func (am AccountManager) exportHandler(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(am.store, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	e, err := exportUserData(am.db, am.exporters, u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(am.db, r, u.ID, u.ID, auditDataExport, nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="account-`+strconv.FormatInt(u.ID, 10)+`.json"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(e)
+}
+
+func (am AccountManager) apiExport(w http.ResponseWriter, r *http.Request, u *User) {
+	if impersonatorFromRequest(r) != nil {
+		writeJSONError(w, http.StatusForbidden, errImpersonating.Error(), nil)
+		return
+	}
+	e, err := exportUserData(am.db, am.exporters, u)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	audit(am.db, r, u.ID, u.ID, auditDataExport, nil)
+	writeJSON(w, http.StatusOK, e)
+}
@@ -0,0 +1,102 @@
+package account
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportUserData(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("some@email.com")
+	u.setPassword("foobar")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	tok, secret, err := newAPIToken(u.ID, "laptop", []string{"read"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tok.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createInvitation(db, u.ID, "friend@email.com", 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE Users SET invited_by = ? WHERE id = ?", u.ID+1, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := setEmailVerified(db, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	acme, err := createOrganization(db, "Acme", u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := createOrganization(db, "Other", u.ID+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createOrgInvitation(db, other.ID, u.ID+1, u.Email, OrgMember); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO OrgJoinRequests (org_id, user_id, status) VALUES (?, ?, ?)",
+		other.ID, u.ID, joinPending); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	audit(db, r, u.ID, u.ID, auditLogin, map[string]string{"method": "password"})
+	audit(db, r, u.ID+1, u.ID, auditAdminAction, map[string]string{"action": "reset_password"})
+
+	es := exporters{"notes": func(u *User) (interface{}, error) {
+		return []string{"hello"}, nil
+	}}
+	e, err := exportUserData(db, es, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.User.Email != u.Email || !e.User.HasPassword {
+		t.Errorf("Expected user record, got %+v", e.User)
+	}
+	if e.User.InvitedBy != u.ID+1 {
+		t.Errorf("Expected inviter, got %v", e.User.InvitedBy)
+	}
+	if len(e.Invitations) != 1 || e.Invitations[0].Email != "friend@email.com" || e.Invitations[0].Expiration == nil {
+		t.Errorf("Expected the user's invitation, got %v", e.Invitations)
+	}
+	if len(e.Memberships) != 1 || e.Memberships[0].OrgID != acme.ID || e.Memberships[0].Role != OrgOwner {
+		t.Errorf("Expected the user's membership, got %v", e.Memberships)
+	}
+	if len(e.OrgInvites) != 1 || e.OrgInvites[0].OrgID != other.ID {
+		t.Errorf("Expected the invitation to the user's address, got %v", e.OrgInvites)
+	}
+	if len(e.JoinRequests) != 1 || e.JoinRequests[0].Status != joinPending {
+		t.Errorf("Expected the user's join request, got %v", e.JoinRequests)
+	}
+	if len(e.APITokens) != 1 || e.APITokens[0].Name != "laptop" || e.APITokens[0].Expiration != nil {
+		t.Errorf("Expected api token, got %v", e.APITokens)
+	}
+	if len(e.AuditEvents) != 2 || e.AuditEvents[1].Type != auditLogin || e.AuditEvents[1].IP == "" {
+		t.Errorf("Expected audit events, got %v", e.AuditEvents)
+	} else if e.AuditEvents[0].IP != "" || e.AuditEvents[0].UserAgent != "" {
+		t.Errorf("Expected the admin's address to be left out, got %v", e.AuditEvents[0])
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"notes":["hello"]`) {
+		t.Errorf("Expected application data, got %s", b)
+	}
+	if strings.Contains(string(b), hashSecret(secret)) || strings.Contains(string(b), "$2a$") {
+		t.Errorf("Expected secrets to be left out, got %s", b)
+	}
+}
@@ -5,9 +5,13 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
@@ -25,10 +29,13 @@ type oAuthFacebook struct {
 	db     *sql.DB
 	store  sessions.Store
 	config oauth2.Config
+	hooks  hooks
+	// base is the path of the account routes, set by CreateRoutes.
+	base string
 }
 
-func newOAuthFacebook(db *sql.DB, store sessions.Store, config oauth2.Config) *oAuthFacebook {
-	return &oAuthFacebook{db, store, config}
+func newOAuthFacebook(db *sql.DB, store sessions.Store, config oauth2.Config, hs hooks) *oAuthFacebook {
+	return &oAuthFacebook{db: db, store: store, config: config, hooks: hs}
 }
 
 func (fb oAuthFacebook) GetLoginURL(w http.ResponseWriter, r *http.Request) (string, error) {
@@ -80,16 +87,60 @@ func (fb oAuthFacebook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	client := fb.config.Client(oauth2.NoContext, tok)
 	u, err := fb.getFacebookUser(client, tok)
+	if err == errEmailUnverified {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if u.created {
+		audit(fb.db, r, u.user.ID, u.user.ID, auditSignup, map[string]string{"provider": u.authType})
+		err = fb.hooks.run(signupHook, u.user, r)
+	}
+	if err == nil && u.linked {
+		audit(fb.db, r, u.user.ID, u.user.ID, auditProviderLinked, map[string]string{"provider": u.authType})
+		err = fb.hooks.run(providerLinkedHook, u.user, r)
+	}
 	if err != nil {
+		if uerr := u.unlink(fb.db); uerr != nil {
+			http.Error(w, uerr.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if u.created {
+		fb.hooks.notify(afterSignupHook, u.user, r)
+	}
+	if u.user.Suspended() {
+		audit(fb.db, r, u.user.ID, u.user.ID, auditLoginBlocked, nil)
+		renderSuspended(w, r, u.user.Suspension())
+		return
+	}
+	if err := fb.hooks.run(loginHook, u.user, r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := cancelDeletion(fb.db, r, u.user); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	u.user.saveToSession(fb.store, w, r)
+	if err := u.user.saveToSession(fb.db, fb.store, w, r); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(fb.db, r, u.user.ID, u.user.ID, auditLogin, map[string]string{"method": u.authType})
+	if u.created && u.user.Username == "" {
+		// Let new users pick a handle before going on where they were headed.
+		http.Redirect(w, r, fb.base+"/username?welcome=1", http.StatusFound)
+		return
+	}
 	redirectAfterLogin(fb.store, w, r)
 }
 
 func (fb oAuthFacebook) getFacebookUser(client *http.Client, tok *oauth2.Token) (*authUser, error) {
-	r, err := client.Get("https://graph.facebook.com/me")
+	r, err := client.Get("https://graph.facebook.com/me?fields=id,email,name,locale")
 	if err != nil {
 		return nil, err
 	}
@@ -105,5 +156,36 @@ func (fb oAuthFacebook) getFacebookUser(client *http.Client, tok *oauth2.Token)
 	}
 
 	id, err := strconv.ParseInt(m["id"].(string), 10, 64)
-	return getOrInsertAuthUser(fb.db, id, "facebook", tok.AccessToken, m["email"].(string), tok.Expiry)
+	au, err := getOrInsertAuthUser(fb.db, id, "facebook", tok.AccessToken, m["email"].(string), tok.Expiry)
+	if err != nil || !au.linked {
+		return au, err
+	}
+	// Facebook locales look like en_US.
+	name, _ := m["name"].(string)
+	locale, _ := m["locale"].(string)
+	p := &Profile{DisplayName: name, Locale: strings.Replace(locale, "_", "-", -1)}
+	if err := prefillProfile(fb.db, au.user, p); err != nil {
+		log.Printf("unable to prefill profile of user %v: %v", au.user.ID, err)
+	}
+	return au, nil
+}
+
+// revoke withdraws the permissions the user granted the app on facebook, so
+// it forgets them as well.
+func (fb oAuthFacebook) revoke(au *authUser) error {
+	v := url.Values{"access_token": {au.token}}
+	req, err := http.NewRequest("DELETE",
+		"https://graph.facebook.com/"+strconv.FormatInt(au.authID, 10)+"/permissions?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("facebook answered %v", resp.Status)
+	}
+	return nil
 }
@@ -0,0 +1,95 @@
+package account
+
+import (
+	"log"
+	"net/http"
+)
+
+// Hook lets the host application act on events in a user's life, e.g. to
+// create its own records for new users.  A hook returning an error vetoes
+// the action and the error's message is shown to the user, so it should be
+// fit for them to read.
+type Hook func(u *User, r *http.Request) error
+
+type hookEvent int
+
+const (
+	signupHook hookEvent = iota
+	loginHook
+	logoutHook
+	passwordChangeHook
+	providerLinkedHook
+	deleteHook
+
+	// Hooks that are told once an action is done, and can't veto it.
+	afterSignupHook
+	afterDeleteHook
+)
+
+// hooks holds the registered hooks by event.  Being a map it is shared by
+// copies of AccountManager and the handlers it creates.
+type hooks map[hookEvent][]Hook
+
+// vetoError is returned when a hook vetoes an action.
+type vetoError struct {
+	error
+}
+
+// run calls the hooks for e in the order they were registered, stopping at
+// the first veto.
+func (hs hooks) run(e hookEvent, u *User, r *http.Request) error {
+	for _, h := range hs[e] {
+		if err := h(u, r); err != nil {
+			return &vetoError{err}
+		}
+	}
+	return nil
+}
+
+// notify calls all the hooks for e, logging their errors.
+func (hs hooks) notify(e hookEvent, u *User, r *http.Request) {
+	for _, h := range hs[e] {
+		if err := h(u, r); err != nil {
+			log.Printf("hook for event %v failed for user %v: %v", e, u.ID, err)
+		}
+	}
+}
+
+// Hooks must be registered before the AccountManager starts serving
+// requests.
+
+// OnSignup registers h to run when a user has signed up, with a password or
+// through a provider, before they are logged in.  Vetoing deletes the new
+// user.
+func (am AccountManager) OnSignup(h Hook) {
+	am.hooks[signupHook] = append(am.hooks[signupHook], h)
+}
+
+// OnLogin registers h to run when a user's credentials have been checked,
+// before they are logged in or issued tokens.
+func (am AccountManager) OnLogin(h Hook) {
+	am.hooks[loginHook] = append(am.hooks[loginHook], h)
+}
+
+// OnLogout registers h to run before a user's session is ended.
+func (am AccountManager) OnLogout(h Hook) {
+	am.hooks[logoutHook] = append(am.hooks[logoutHook], h)
+}
+
+// OnPasswordChange registers h to run when a new password, chosen by the
+// user or reset by an admin, has been validated but not yet stored.
+func (am AccountManager) OnPasswordChange(h Hook) {
+	am.hooks[passwordChangeHook] = append(am.hooks[passwordChangeHook], h)
+}
+
+// OnProviderLinked registers h to run when a login through an external
+// provider has linked its identity to the user.  Vetoing unlinks it.
+func (am AccountManager) OnProviderLinked(h Hook) {
+	am.hooks[providerLinkedHook] = append(am.hooks[providerLinkedHook], h)
+}
+
+// OnDelete registers h to run before a user is deleted by an admin, or
+// before their own request to delete their account is scheduled.
+func (am AccountManager) OnDelete(h Hook) {
+	am.hooks[deleteHook] = append(am.hooks[deleteHook], h)
+}
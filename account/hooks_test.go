@@ -0,0 +1,65 @@
+package account
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+func TestHooks(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	am := NewAccountManager(sessions.NewCookieStore([]byte("secret")), db,
+		"http://localhost", NewFacebookClient("", ""))
+	var logins []string
+	am.OnSignup(func(u *User, r *http.Request) error {
+		if strings.HasSuffix(u.Email, "@blocked.com") {
+			return errors.New("signups from blocked.com are closed")
+		}
+		return nil
+	})
+	am.OnLogin(func(u *User, r *http.Request) error {
+		logins = append(logins, u.Email)
+		return nil
+	})
+	mx := mux.NewRouter()
+	if err := am.CreateRoutes(mx.PathPrefix("/account").Subrouter()); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/account/api/v1"+path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mx.ServeHTTP(w, r)
+		return w
+	}
+
+	w := post("/signup", `{"email": "a@blocked.com", "password": "foobar", "password2": "foobar"}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "closed") {
+		t.Errorf("Expected signup to be vetoed, got %v %v", w.Code, w.Body)
+	}
+	if _, err := loadUserByEmail(db, "a@blocked.com"); err != sql.ErrNoRows {
+		t.Errorf("Expected vetoed user to be deleted, got %v", err)
+	}
+
+	if w := post("/signup", `{"email": "a@b.com", "password": "foobar", "password2": "foobar"}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected signup to succeed, got %v %v", w.Code, w.Body)
+	}
+	if w := post("/login", `{"email": "a@b.com", "password": "foobar"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected login to succeed, got %v %v", w.Code, w.Body)
+	}
+	if len(logins) != 1 || logins[0] != "a@b.com" {
+		t.Errorf("Expected login hook to run once, got %v", logins)
+	}
+}
@@ -0,0 +1,181 @@
+package account
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/sessions"
+)
+
+// ImpersonatePermission lets admins log in as another user from the admin
+// console, to see exactly what they see.
+const ImpersonatePermission = "impersonate"
+
+// The admin's identity and session are kept in the cookie while they
+// impersonate, so they can be restored when the admin stops.
+const (
+	impersonatorKey    = "IMPERSONATOR"
+	impersonatorSIDKey = "IMPERSONATOR_SID"
+)
+
+var errImpersonating = errors.New("not allowed while impersonating")
+
+// impersonation is kept in the request context while an admin impersonates
+// the logged in user.
+type impersonation struct {
+	admin *User
+	// base is the path of the account routes, for the banner's link.
+	base string
+}
+
+func withImpersonator(r *http.Request, u *User, base string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), impersonatorContextKey, &impersonation{u, base}))
+}
+
+func impersonationFromRequest(r *http.Request) *impersonation {
+	i, _ := r.Context().Value(impersonatorContextKey).(*impersonation)
+	return i
+}
+
+// impersonatorFromRequest returns the admin impersonating the logged in user,
+// or nil.  Like UserFromRequest for bearer tokens it relies on middleware to
+// have authenticated the request.
+func impersonatorFromRequest(r *http.Request) *User {
+	if i := impersonationFromRequest(r); i != nil {
+		return i.admin
+	}
+	return nil
+}
+
+// Impersonator returns the admin acting as the logged in user, or nil.
+func (am AccountManager) Impersonator(r *http.Request) (*User, error) {
+	_, r, err := am.authenticate(r)
+	if isInvalidTokenError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return impersonatorFromRequest(r), nil
+}
+
+// BlockImpersonationMiddleware refuses requests from admins impersonating a
+// user.  Put it in front of anything that changes credentials or acts on the
+// user's behalf beyond looking.  It must follow RequireUserMiddleware.
+func (am AccountManager) BlockImpersonationMiddleware() func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if impersonatorFromRequest(r) != nil {
+				http.Error(w, errImpersonating.Error(), http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// startImpersonation logs admin in as u, keeping the admin's own session to
+// return to.
+func startImpersonation(db *sql.DB, store sessions.Store, w http.ResponseWriter, r *http.Request, admin, u *User) error {
+	s, err := store.Get(r, Session)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.Values[impersonatorKey]; ok {
+		return errImpersonating
+	}
+	us, err := newUserSession(db, u, r)
+	if err != nil {
+		return err
+	}
+	s.Values[impersonatorKey] = admin.ID
+	s.Values[impersonatorSIDKey] = s.Values[sessionIDKey]
+	s.Values[UserKey] = u
+	s.Values[sessionIDKey] = us.key
+	if err := s.Save(r, w); err != nil {
+		return err
+	}
+	return recordAuditEvent(db, r, admin.ID, u.ID, auditImpersonationStart, nil)
+}
+
+// stopImpersonation ends the impersonated session and logs the admin back in
+// as themselves.  It returns the id of the user that was impersonated, or 0
+// if the request was not impersonating.
+func stopImpersonation(db *sql.DB, store sessions.Store, w http.ResponseWriter, r *http.Request) (int64, error) {
+	s, err := store.Get(r, Session)
+	if err != nil {
+		return 0, err
+	}
+	adminID, ok := s.Values[impersonatorKey].(int64)
+	u, _ := s.Values[UserKey].(*User)
+	if !ok || u == nil {
+		return 0, nil
+	}
+	key, _ := s.Values[sessionIDKey].(string)
+	if _, err := db.Exec("DELETE FROM Sessions WHERE session_key = ?", key); err != nil {
+		return 0, err
+	}
+	admin, err := loadUserByID(db, adminID)
+	if err != nil {
+		return 0, err
+	}
+	s.Values[UserKey] = admin
+	s.Values[sessionIDKey] = s.Values[impersonatorSIDKey]
+	delete(s.Values, impersonatorKey)
+	delete(s.Values, impersonatorSIDKey)
+	if err := s.Save(r, w); err != nil {
+		return 0, err
+	}
+	return u.ID, recordAuditEvent(db, r, adminID, u.ID, auditImpersonationStop, nil)
+}
+
+// checkImpersonator returns the admin impersonating the session's user,
+// provided they still hold ImpersonatePermission, are not suspended and have
+// not been logged out of their own session.  Otherwise the impersonated
+// session is ended server side and nil is returned, which leaves the cookie
+// logged out rather than logged in as the user without the banner.
+func checkImpersonator(db *sql.DB, r *http.Request, s *sessions.Session, userID, adminID int64) (*User, error) {
+	adminKey, _ := s.Values[impersonatorSIDKey].(string)
+	admin, err := loadUserBySession(db, adminKey, adminID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil && !admin.Suspended() {
+		perms, err := loadUserPermissions(db, adminID)
+		if err != nil {
+			return nil, err
+		}
+		if perms.Has(ImpersonatePermission) {
+			return admin, nil
+		}
+	}
+	key, _ := s.Values[sessionIDKey].(string)
+	if _, err := db.Exec("DELETE FROM Sessions WHERE session_key = ?", key); err != nil {
+		return nil, err
+	}
+	return nil, recordAuditEvent(db, r, adminID, userID, auditImpersonationStop,
+		map[string]string{"reason": "impersonator_revoked"})
+}
+
+type impersonationContext struct {
+	Base         string
+	Impersonator *User
+	User         *User
+}
+
+// stopImpersonatingHandler is a GET, like logout, so the banner can link to
+// it from any page.
+func (am AccountManager) stopImpersonatingHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := stopImpersonation(am.db, am.store, w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if id == 0 {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, am.baseURL.Path+"/admin/users/"+strconv.FormatInt(id, 10), http.StatusFound)
+}
@@ -0,0 +1,156 @@
+package account
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestImpersonation(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	store := sessions.NewCookieStore([]byte("secret"))
+	am := NewAccountManager(store, db, "http://localhost", NewFacebookClient("", ""))
+	admin := newUser("admin@email.com")
+	u := newUser("some@email.com")
+	for _, nu := range []*User{admin, u} {
+		if err := nu.insert(db); err != nil {
+			t.Fatal("Failed to insert user")
+		}
+	}
+	if err := am.CreateRole("support", ImpersonatePermission); err != nil {
+		t.Fatal(err)
+	}
+	if err := am.AssignRole(admin.ID, "support"); err != nil {
+		t.Fatal(err)
+	}
+
+	// withCookies returns a request carrying the cookies set by w.
+	withCookies := func(w *httptest.ResponseRecorder) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	if err := admin.saveToSession(db, store, w, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	r := withCookies(w)
+	w = httptest.NewRecorder()
+	if err := startImpersonation(db, store, w, r, admin, u); err != nil {
+		t.Fatal(err)
+	}
+
+	cu, r, err := am.authenticate(withCookies(w))
+	if err != nil || cu.ID != u.ID {
+		t.Fatalf("Expected to act as the user, got %v %v", cu, err)
+	}
+	if i := impersonatorFromRequest(r); i == nil || i.ID != admin.ID {
+		t.Errorf("Expected admin as impersonator, got %v", i)
+	}
+	bw := httptest.NewRecorder()
+	am.BlockImpersonationMiddleware()(http.NotFoundHandler()).ServeHTTP(bw, r)
+	if bw.Code != http.StatusForbidden {
+		t.Errorf("Expected impersonation to be blocked, got %v", bw.Code)
+	}
+
+	r = withCookies(w)
+	w = httptest.NewRecorder()
+	if id, err := stopImpersonation(db, store, w, r); err != nil || id != u.ID {
+		t.Fatalf("Expected to stop impersonating the user, got %v %v", id, err)
+	}
+	cu, r, err = am.authenticate(withCookies(w))
+	if err != nil || cu.ID != admin.ID || impersonatorFromRequest(r) != nil {
+		t.Errorf("Expected to be the admin again, got %v %v", cu, err)
+	}
+
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM AuditEvents WHERE actor_id = ? AND user_id = ?",
+		admin.ID, u.ID).Scan(&n)
+	if n != 2 {
+		t.Errorf("Expected start and stop to be audited, got %v events", n)
+	}
+}
+
+func TestImpersonationEndsWithTheAdminsAccess(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	store := sessions.NewCookieStore([]byte("secret"))
+	am := NewAccountManager(store, db, "http://localhost", NewFacebookClient("", ""))
+	if err := am.CreateRole("support", ImpersonatePermission); err != nil {
+		t.Fatal(err)
+	}
+	u := newUser("some@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal("Failed to insert user")
+	}
+
+	withCookies := func(w *httptest.ResponseRecorder) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		return r
+	}
+
+	for i, revoke := range []func(admin *User) error{
+		func(admin *User) error {
+			return am.RevokeRole(admin.ID, "support")
+		},
+		func(admin *User) error {
+			_, err := db.Exec("UPDATE Users SET suspended = 1 WHERE id = ?", admin.ID)
+			return err
+		},
+		func(admin *User) error {
+			_, err := db.Exec("DELETE FROM Sessions WHERE user_id = ?", admin.ID)
+			return err
+		},
+	} {
+		admin := newUser("admin" + strconv.Itoa(i) + "@email.com")
+		if err := admin.insert(db); err != nil {
+			t.Fatal("Failed to insert user")
+		}
+		if err := am.AssignRole(admin.ID, "support"); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		if err := admin.saveToSession(db, store, w, httptest.NewRequest("GET", "/", nil)); err != nil {
+			t.Fatal(err)
+		}
+		r := withCookies(w)
+		w = httptest.NewRecorder()
+		if err := startImpersonation(db, store, w, r, admin, u); err != nil {
+			t.Fatal(err)
+		}
+		if cu, _, err := am.authenticate(withCookies(w)); err != nil || cu == nil {
+			t.Fatalf("Expected to act as the user, got %v %v", cu, err)
+		}
+
+		if err := revoke(admin); err != nil {
+			t.Fatal(err)
+		}
+		if cu, r, err := am.authenticate(withCookies(w)); err != nil || cu != nil || impersonatorFromRequest(r) != nil {
+			t.Errorf("%v: Expected the impersonation to end, got %v %v", i, cu, err)
+		}
+		// The impersonated session stays ended if the admin regains access.
+		db.Exec("UPDATE Users SET suspended = 0 WHERE id = ?", admin.ID)
+		am.AssignRole(admin.ID, "support")
+		if cu, _, err := am.authenticate(withCookies(w)); err != nil || cu != nil {
+			t.Errorf("%v: Expected to stay logged out, got %v %v", i, cu, err)
+		}
+	}
+}
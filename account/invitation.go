@@ -0,0 +1,471 @@
+package account
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/schema"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// userInvitationTTL is how long invitations made by users stay valid.
+	userInvitationTTL = 7 * 24 * time.Hour
+	// maxUserInvitations is how many unused invitations a user may have out
+	// at once.
+	maxUserInvitations = 5
+	// sessionInvitation holds the invitation a visitor arrived with, for
+	// signups through a provider.
+	sessionInvitation = "invitation"
+)
+
+var errInvitationRequired = errors.New("a valid invitation is required to sign up")
+
+// invitation lets people sign up while signup is invite only or goes
+// through the waitlist.  It may be used MaxUses times, or any number of
+// times if MaxUses is 0, and only by Email if that is set.
+type invitation struct {
+	ID        int64
+	InviterID int64
+	Email     string
+	MaxUses   int
+	Uses      int
+	// Expiration is zero for invitations that never expire.
+	Expiration time.Time
+	Revoked    bool
+	Created    time.Time
+}
+
+// Valid reports whether the invitation may still be used.
+func (inv *invitation) Valid() bool {
+	return !inv.Revoked && (inv.MaxUses == 0 || inv.Uses < inv.MaxUses) &&
+		(inv.Expiration.IsZero() || time.Now().Before(inv.Expiration))
+}
+
+// createInvitation records an invitation from inviterID and returns the
+// secret redeeming it.  A ttl of 0 makes it never expire.
+func createInvitation(db *sql.DB, inviterID int64, email string, maxUses int, ttl time.Duration) (string, error) {
+	secret, err := randomSecret("inv_")
+	if err != nil {
+		return "", err
+	}
+	var expiration int64
+	if ttl != 0 {
+		expiration = time.Now().Add(ttl).Unix()
+	}
+	_, err = db.Exec(
+		"INSERT INTO Invitations (token_hash, inviter_id, email, max_uses, expiration) VALUES ($1, $2, $3, $4, $5)",
+		hashSecret(secret), inviterID, email, maxUses, expiration)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func loadInvitations(db *sql.DB, query string, args ...interface{}) ([]*invitation, error) {
+	rows, err := db.Query(
+		"SELECT id, inviter_id, email, max_uses, uses, expiration, revoked, created FROM Invitations "+query,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var invs []*invitation
+	for rows.Next() {
+		inv := &invitation{}
+		var expiration int64
+		if err := rows.Scan(&inv.ID, &inv.InviterID, &inv.Email, &inv.MaxUses, &inv.Uses,
+			&expiration, &inv.Revoked, &inv.Created); err != nil {
+			return nil, err
+		}
+		if expiration != 0 {
+			inv.Expiration = time.Unix(expiration, 0)
+		}
+		invs = append(invs, inv)
+	}
+	return invs, rows.Err()
+}
+
+// countUnusedInvitations returns how many of the user's invitations may
+// still be used.
+func countUnusedInvitations(db *sql.DB, userID int64) (int, error) {
+	invs, err := loadInvitations(db, "WHERE inviter_id = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, inv := range invs {
+		if inv.Valid() {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// revokeInvitation stops the invitation from being used.  Only invitations
+// from inviterID are revoked, unless inviterID is 0.
+func revokeInvitation(db *sql.DB, id, inviterID int64) error {
+	q := "UPDATE Invitations SET revoked = 1 WHERE id = ?"
+	args := []interface{}{id}
+	if inviterID != 0 {
+		q += " AND inviter_id = ?"
+		args = append(args, inviterID)
+	}
+	r, err := db.Exec(q, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// redeemInvitation uses up the invitation secret refers to for u, and
+// records who invited them.  errInvitationRequired is returned if it is
+// not valid or not meant for u.
+func redeemInvitation(db *sql.DB, secret string, u *User) (*invitation, error) {
+	invs, err := loadInvitations(db, "WHERE token_hash = ?", hashSecret(secret))
+	if err != nil {
+		return nil, err
+	}
+	if len(invs) == 0 || !invs[0].Valid() {
+		return nil, errInvitationRequired
+	}
+	inv := invs[0]
+	if inv.Email != "" {
+		if email, err := normalizeEmail(inv.Email); err != nil || email != u.Email {
+			return nil, errInvitationRequired
+		}
+	}
+	// Count the use in the same statement that checks it, so concurrent
+	// signups can't go over the limit.
+	r, err := db.Exec(
+		"UPDATE Invitations SET uses = uses + 1 WHERE id = ? AND revoked = 0 AND (max_uses = 0 OR uses < max_uses)",
+		inv.ID)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, errInvitationRequired
+	}
+	inv.Uses++
+	_, err = db.Exec("UPDATE Users SET invited_by = ?, invitation_id = ? WHERE id = ?", inv.InviterID, inv.ID, u.ID)
+	return inv, err
+}
+
+// undoSignup deletes a user whose signup was vetoed, giving back the use of
+// the invitation they redeemed, since hooks of the host application may veto
+// after invitationHook has run.
+func undoSignup(db *sql.DB, userID int64) error {
+	_, err := db.Exec(
+		"UPDATE Invitations SET uses = uses - 1 WHERE uses > 0 AND id = (SELECT invitation_id FROM Users WHERE id = ?)",
+		userID)
+	if err != nil {
+		return err
+	}
+	return deleteUser(db, userID)
+}
+
+// withInvitation returns a copy of r carrying the invitation secret the
+// visitor signed up with.
+func withInvitation(r *http.Request, secret string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), invitationContextKey, secret))
+}
+
+// invitationHook vetoes signups without a valid invitation, taken from the
+// signup request or else from the session of visitors who followed an
+// invitation link before signing up through a provider.
+func invitationHook(db *sql.DB, store sessions.Store) Hook {
+	return func(u *User, r *http.Request) error {
+		secret, _ := r.Context().Value(invitationContextKey).(string)
+		if secret == "" {
+			if s, err := store.Get(r, Session); err == nil {
+				secret, _ = s.Values[sessionInvitation].(string)
+			}
+		}
+		if secret == "" {
+			return errInvitationRequired
+		}
+		inv, err := redeemInvitation(db, secret, u)
+		if err != nil {
+			return err
+		}
+		audit(db, r, u.ID, u.ID, auditInvitationRedeemed,
+			map[string]string{"invitation": strconv.FormatInt(inv.ID, 10), "inviter": strconv.FormatInt(inv.InviterID, 10)})
+		return nil
+	}
+}
+
+// rememberInvitation keeps the invitation of the signup link the visitor
+// followed in their session.
+func rememberInvitation(store sessions.Store, w http.ResponseWriter, r *http.Request, secret string) error {
+	s, err := store.Get(r, Session)
+	if err != nil {
+		return err
+	}
+	s.Values[sessionInvitation] = secret
+	return s.Save(r, w)
+}
+
+// sendInvitation mails the signup link of an invitation bound to an email
+// address.
+func sendInvitation(m Mailer, base, email, secret string, from *User) error {
+	return m.SendMail(email, "You are invited to sign up",
+		from.Name()+" invited you to create an account.  Follow this link to sign up:\n\n"+
+			base+"/signup?invite="+url.QueryEscape(secret)+"\n")
+}
+
+type invitationForm struct {
+	Email   string
+	MaxUses int
+	Days    int
+	Token   string `schema:"csrf_token"`
+}
+
+type invitationsContext struct {
+	Form        *invitationForm
+	Invitations []*invitation
+	// Invited are the users who signed up with the user's invitations.
+	Invited []*User
+	// Link is the signup link of the invitation just created.
+	Link    string
+	Error   string
+	Message string
+}
+
+func (c *invitationsContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+type invitationsHandler struct {
+	db     *sql.DB
+	s      sessions.Store
+	mailer Mailer
+	// base is the absolute url of the account routes, for the signup links.
+	base string
+}
+
+func newInvitationsHandler(db *sql.DB, s sessions.Store, m Mailer, base string) *invitationsHandler {
+	return &invitationsHandler{db, s, m, base}
+}
+
+func (h invitationsHandler) context(u *User) (*invitationsContext, error) {
+	invs, err := loadInvitations(h.db, "WHERE inviter_id = ? ORDER BY id DESC", u.ID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := h.db.Query("SELECT id FROM Users WHERE invited_by = ? ORDER BY id", u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	c := &invitationsContext{Form: &invitationForm{}, Invitations: invs}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		iu, err := loadUserByID(h.db, id)
+		if err != nil {
+			return nil, err
+		}
+		c.Invited = append(c.Invited, iu)
+	}
+	return c, rows.Err()
+}
+
+func (h invitationsHandler) render(w http.ResponseWriter, r *http.Request, u *User, link, msg, errMsg string) {
+	c, err := h.context(u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Link, c.Message, c.Error = link, msg, errMsg
+	templateHandler("invitations.html", c, w, r)
+}
+
+func (h invitationsHandler) get(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	h.render(w, r, u, "", "", "")
+}
+
+// post creates a single use invitation, mailed to the address given if
+// any.
+func (h invitationsHandler) post(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	f := &invitationForm{}
+	d := schema.NewDecoder()
+	d.IgnoreUnknownKeys(true)
+	if err := d.Decode(f, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Email != "" {
+		if f.Email, err = normalizeEmail(f.Email); err != nil {
+			h.render(w, r, u, "", "", "Invalid email address")
+			return
+		}
+	}
+	if n, err := countUnusedInvitations(h.db, u.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if n >= maxUserInvitations {
+		h.render(w, r, u, "", "", "You have too many unused invitations, revoke one first")
+		return
+	}
+	link, msg, err := h.create(r, u, f.Email, 1, userInvitationTTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.render(w, r, u, link, msg, "")
+}
+
+// create makes an invitation from u and returns its signup link, which is
+// also mailed to email if set.
+func (h invitationsHandler) create(r *http.Request, u *User, email string, maxUses int,
+	ttl time.Duration) (string, string, error) {
+	secret, err := createInvitation(h.db, u.ID, email, maxUses, ttl)
+	if err != nil {
+		return "", "", err
+	}
+	audit(h.db, r, u.ID, u.ID, auditInvitationCreated, map[string]string{"email": email})
+	msg := "Invitation created"
+	if email != "" {
+		if err := sendInvitation(h.mailer, h.base, email, secret, u); err != nil {
+			log.Printf("unable to mail invitation to %v: %v", email, err)
+		} else {
+			msg = "Invitation sent to " + email
+		}
+	}
+	return h.base + "/signup?invite=" + url.QueryEscape(secret), msg, nil
+}
+
+func (h invitationsHandler) revoke(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	id, _ := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err := revokeInvitation(h.db, id, u.ID); err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.db, r, u.ID, u.ID, auditInvitationRevoked, map[string]string{"invitation": strconv.FormatInt(id, 10)})
+	h.render(w, r, u, "", "Invitation revoked", "")
+}
+
+type adminInvitationsContext struct {
+	Form        *invitationForm
+	Base        string
+	Invitations []*invitation
+	Link        string
+	Error       string
+	Message     string
+}
+
+func (c *adminInvitationsContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+func (h invitationsHandler) renderAdmin(w http.ResponseWriter, r *http.Request, link, msg, errMsg string) {
+	invs, err := loadInvitations(h.db, "ORDER BY id DESC LIMIT ?", adminPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateHandler("admin_invitations.html", &adminInvitationsContext{
+		Form:        &invitationForm{},
+		Base:        h.base,
+		Invitations: invs,
+		Link:        link,
+		Message:     msg,
+		Error:       errMsg}, w, r)
+}
+
+// adminList shows the latest invitations from everyone.
+func (h invitationsHandler) adminList(w http.ResponseWriter, r *http.Request) {
+	h.renderAdmin(w, r, "", "", "")
+}
+
+// adminCreate creates an invitation which, unlike those of users, may be
+// used several times and last any number of days, 0 meaning forever.
+func (h invitationsHandler) adminCreate(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	f := &invitationForm{}
+	d := schema.NewDecoder()
+	d.IgnoreUnknownKeys(true)
+	if err := d.Decode(f, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Email != "" {
+		if f.Email, err = normalizeEmail(f.Email); err != nil {
+			h.renderAdmin(w, r, "", "", "Invalid email address")
+			return
+		}
+	}
+	if f.MaxUses < 0 || f.Days < 0 {
+		h.renderAdmin(w, r, "", "", "Uses and days can't be negative")
+		return
+	}
+	link, msg, err := h.create(r, u, f.Email, f.MaxUses, time.Duration(f.Days)*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.renderAdmin(w, r, link, msg, "")
+}
+
+func (h invitationsHandler) adminRevoke(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	id, _ := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err := revokeInvitation(h.db, id, 0); err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.db, r, u.ID, u.ID, auditInvitationRevoked, map[string]string{"invitation": strconv.FormatInt(id, 10)})
+	h.renderAdmin(w, r, "", "Invitation revoked", "")
+}
@@ -0,0 +1,153 @@
+package account
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+func TestRedeemInvitation(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	inviter := newUser("inviter@email.com")
+	if err := inviter.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	newInvitee := func(email string) *User {
+		u := newUser(email)
+		if err := u.insert(db); err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	secret, err := createInvitation(db, inviter.ID, "", 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := redeemInvitation(db, secret, newInvitee(fmt.Sprintf("u%v@email.com", i))); err != nil {
+			t.Errorf("Expected use %v to succeed, got %v", i, err)
+		}
+	}
+	if _, err := redeemInvitation(db, secret, newInvitee("u3@email.com")); err != errInvitationRequired {
+		t.Errorf("Expected used up invitation to be refused, got %v", err)
+	}
+	var invitedBy int64
+	if err := db.QueryRow("SELECT invited_by FROM Users WHERE email = ?", "u0@email.com").Scan(&invitedBy); err != nil {
+		t.Fatal(err)
+	} else if invitedBy != inviter.ID {
+		t.Errorf("Expected invitee to be recorded, got invited by %v", invitedBy)
+	}
+
+	secret, err = createInvitation(db, inviter.ID, "bound@email.com", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := redeemInvitation(db, secret, newInvitee("other@email.com")); err != errInvitationRequired {
+		t.Errorf("Expected invitation bound to another email to be refused, got %v", err)
+	}
+	if _, err := redeemInvitation(db, secret, newInvitee("bound@email.com")); err != nil {
+		t.Errorf("Expected bound invitation to be accepted, got %v", err)
+	}
+
+	secret, err = createInvitation(db, inviter.ID, "", 1, -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := redeemInvitation(db, secret, newInvitee("late@email.com")); err != errInvitationRequired {
+		t.Errorf("Expected expired invitation to be refused, got %v", err)
+	}
+
+	secret, err = createInvitation(db, inviter.ID, "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invs, err := loadInvitations(db, "WHERE inviter_id = ? ORDER BY id DESC", inviter.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := revokeInvitation(db, invs[0].ID, inviter.ID+1); err != sql.ErrNoRows {
+		t.Errorf("Expected others' invitations to be left alone, got %v", err)
+	}
+	if err := revokeInvitation(db, invs[0].ID, inviter.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := redeemInvitation(db, secret, newInvitee("revoked@email.com")); err != errInvitationRequired {
+		t.Errorf("Expected revoked invitation to be refused, got %v", err)
+	}
+	if n, err := countUnusedInvitations(db, inviter.ID); err != nil || n != 0 {
+		t.Errorf("Expected no unused invitations, got %v %v", n, err)
+	}
+}
+
+func TestInviteOnlySignup(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	am := NewAccountManager(sessions.NewCookieStore([]byte("secret")), db,
+		"http://localhost", NewFacebookClient("", ""))
+	am.SetSignupMode(SignupInviteOnly)
+	var hooked []string
+	am.OnSignup(func(u *User, r *http.Request) error {
+		hooked = append(hooked, u.Email)
+		return nil
+	})
+	mx := mux.NewRouter()
+	if err := am.CreateRoutes(mx.PathPrefix("/account").Subrouter()); err != nil {
+		t.Fatal(err)
+	}
+	signup := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/account/api/v1/signup", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mx.ServeHTTP(w, r)
+		return w
+	}
+
+	w := signup(`{"email": "a@b.com", "password": "foobar", "password2": "foobar"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected signup without invitation to be refused, got %v %v", w.Code, w.Body)
+	}
+	if _, err := loadUserByEmail(db, "a@b.com"); err != sql.ErrNoRows {
+		t.Errorf("Expected refused user to be deleted, got %v", err)
+	}
+	if len(hooked) != 0 {
+		t.Errorf("Expected hooks not to run for refused signups, got %v", hooked)
+	}
+
+	secret, err := createInvitation(db, 0, "", 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A host hook registered after the routes vetoes after the invitation
+	// was redeemed; its use must be given back.
+	am.OnSignup(func(u *User, r *http.Request) error {
+		if u.Email == "vetoed@b.com" {
+			return fmt.Errorf("not you")
+		}
+		return nil
+	})
+	w = signup(`{"email": "vetoed@b.com", "password": "foobar", "password2": "foobar", "invite": "` + secret + `"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected vetoed signup to be refused, got %v %v", w.Code, w.Body)
+	}
+	w = signup(`{"email": "a@b.com", "password": "foobar", "password2": "foobar", "invite": "` + secret + `"}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected signup with invitation to succeed, got %v %v", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,268 @@
+package account
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// accessTokenType marks access tokens apart from the ID tokens signed with
+// the same keys.
+const accessTokenType = "access"
+
+var errInvalidAccessToken = errors.New("invalid or expired access token")
+
+type signingKey struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+// keySet holds the RSA keys access tokens are signed with.  The first key
+// signs new tokens, every key is accepted when verifying and published in the
+// JWKS document, so a key can be rotated out once its tokens have expired.
+type keySet struct {
+	once sync.Once
+	keys []*signingKey
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// accessClaims are those of access tokens.  Their audience is the issuer
+// itself; ID tokens are for an OAuth client and carry its id instead.
+type accessClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	Type      string `json:"typ"`
+	Email     string `json:"email,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwks struct {
+	Keys []*jwk `json:"keys"`
+}
+
+// ParseSigningKey reads a PEM encoded RSA private key, in either PKCS#1 or
+// PKCS#8 form, for use with AccountManager.SetSigningKeys.
+func ParseSigningKey(b []byte) (*rsa.PrivateKey, error) {
+	p, _ := pem.Decode(b)
+	if p == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(p.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(p.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an RSA key, got %T", k)
+	}
+	return rk, nil
+}
+
+func newSigningKey(k *rsa.PrivateKey) *signingKey {
+	return &signingKey{kid: keyThumbprint(&k.PublicKey), key: k}
+}
+
+// keyThumbprint is the RFC 7638 thumbprint of the key, used as its kid.
+func keyThumbprint(k *rsa.PublicKey) string {
+	j := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwkE(k), jwkN(k))
+	h := sha256.Sum256([]byte(j))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+func jwkN(k *rsa.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+}
+
+func jwkE(k *rsa.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+}
+
+func (ks *keySet) set(keys []*rsa.PrivateKey) {
+	// Configured keys replace the ephemeral fallback in signer.
+	ks.once.Do(func() {})
+	ks.keys = nil
+	for _, k := range keys {
+		ks.keys = append(ks.keys, newSigningKey(k))
+	}
+}
+
+// signer returns the current signing key.  Without configured keys an
+// ephemeral one is generated, which invalidates tokens on every restart.
+func (ks *keySet) signer() (*signingKey, error) {
+	var err error
+	ks.once.Do(func() {
+		if len(ks.keys) != 0 {
+			return
+		}
+		log.Print("no token signing keys configured, generating an ephemeral key")
+		var k *rsa.PrivateKey
+		if k, err = rsa.GenerateKey(rand.Reader, 2048); err == nil {
+			ks.keys = []*signingKey{newSigningKey(k)}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(ks.keys) == 0 {
+		return nil, errors.New("no token signing keys")
+	}
+	return ks.keys[0], nil
+}
+
+func (ks *keySet) lookup(kid string) *signingKey {
+	for _, k := range ks.keys {
+		if k.kid == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+func (ks *keySet) jwks() (*jwks, error) {
+	if _, err := ks.signer(); err != nil {
+		return nil, err
+	}
+	s := &jwks{Keys: []*jwk{}}
+	for _, k := range ks.keys {
+		s.Keys = append(s.Keys, &jwk{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: "RS256",
+			Kid: k.kid,
+			N:   jwkN(&k.key.PublicKey),
+			E:   jwkE(&k.key.PublicKey)})
+	}
+	return s, nil
+}
+
+// sign encodes claims as an RS256 JWT.
+func (ks *keySet) sign(claims interface{}) (string, error) {
+	k, err := ks.signer()
+	if err != nil {
+		return "", err
+	}
+	h, err := json.Marshal(&jwtHeader{Alg: "RS256", Typ: "JWT", Kid: k.kid})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	in := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	d := sha256.Sum256([]byte(in))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, d[:])
+	if err != nil {
+		return "", err
+	}
+	return in + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verify checks the signature of an RS256 JWT and decodes its claims.
+func (ks *keySet) verify(tok string, claims interface{}) error {
+	if _, err := ks.signer(); err != nil {
+		return err
+	}
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return errInvalidAccessToken
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errInvalidAccessToken
+	}
+	h := &jwtHeader{}
+	if err := json.Unmarshal(hb, h); err != nil || h.Alg != "RS256" {
+		return errInvalidAccessToken
+	}
+	k := ks.lookup(h.Kid)
+	if k == nil {
+		return errInvalidAccessToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errInvalidAccessToken
+	}
+	d := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&k.key.PublicKey, crypto.SHA256, d[:], sig); err != nil {
+		return errInvalidAccessToken
+	}
+	cb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errInvalidAccessToken
+	}
+	if err := json.Unmarshal(cb, claims); err != nil {
+		return errInvalidAccessToken
+	}
+	return nil
+}
+
+func (ks *keySet) newAccessToken(issuer string, u *User) (string, error) {
+	now := time.Now()
+	return ks.sign(&accessClaims{
+		Issuer:    issuer,
+		Subject:   strconv.FormatInt(u.ID, 10),
+		Audience:  issuer,
+		Type:      accessTokenType,
+		Email:     u.Email,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(accessTokenTTL).Unix()})
+}
+
+// parseAccessToken verifies tok and returns the id of the user it was issued
+// to.  ID tokens are refused even when their issuer matches.
+func (ks *keySet) parseAccessToken(issuer, tok string) (int64, error) {
+	c := &accessClaims{}
+	if err := ks.verify(tok, c); err != nil {
+		return 0, err
+	}
+	if c.Issuer != issuer || time.Now().Unix() >= c.ExpiresAt {
+		return 0, errInvalidAccessToken
+	}
+	if c.Type != accessTokenType || c.Audience != issuer || len(c.Nonce) != 0 {
+		return 0, errInvalidAccessToken
+	}
+	id, err := strconv.ParseInt(c.Subject, 10, 64)
+	if err != nil {
+		return 0, errInvalidAccessToken
+	}
+	return id, nil
+}
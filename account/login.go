@@ -29,9 +29,10 @@ func (c *loginContext) setToken(t string) {
 }
 
 type loginPostHandler struct {
-	db *sql.DB
-	s  sessions.Store
-	fb *oAuthFacebook
+	db    *sql.DB
+	s     sessions.Store
+	fb    *oAuthFacebook
+	hooks hooks
 }
 
 type loginGetHandler struct {
@@ -40,8 +41,8 @@ type loginGetHandler struct {
 	fb *oAuthFacebook
 }
 
-func newLoginPostHandler(db *sql.DB, s sessions.Store, fb *oAuthFacebook) http.Handler {
-	return &loginPostHandler{db, s, fb}
+func newLoginPostHandler(db *sql.DB, s sessions.Store, fb *oAuthFacebook, hs hooks) http.Handler {
+	return &loginPostHandler{db, s, fb, hs}
 }
 
 func newLoginGetHandler(db *sql.DB, s sessions.Store, fb *oAuthFacebook) http.Handler {
@@ -67,21 +68,32 @@ func (l loginPostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if u, err := loadUserByEmail(l.db, c.Form.Email); err != nil {
+	if u, err := loadUserByLogin(l.db, c.Form.Email); err != nil {
+		audit(l.db, r, 0, 0, auditLoginFailed, map[string]string{"email": c.Form.Email})
 		c.Error = "Invalid username/password"
-		executeContextTemplate(w, "login.html", c)
+		pageHandler("login.html", c, w, r)
 	} else if cp, err := u.isCorrectPassword(l.db, c.Form.Password); !cp || err != nil {
 		if err != nil {
 		  http.Error(w, err.Error(), http.StatusInternalServerError)
 		  return
 	  } else {
+		  audit(l.db, r, 0, u.ID, auditLoginFailed, nil)
 		  c.Error = "Invalid username/password"
-		  executeContextTemplate(w, "login.html", c)
+		  pageHandler("login.html", c, w, r)
 		}
-	} else if err := u.saveToSession(l.s, w, r); err != nil {
+	} else if u.Suspended() {
+		audit(l.db, r, u.ID, u.ID, auditLoginBlocked, nil)
+		renderSuspended(w, r, u.Suspension())
+	} else if err := l.hooks.run(loginHook, u, r); err != nil {
+		c.Error = err.Error()
+		pageHandler("login.html", c, w, r)
+	} else if err := cancelDeletion(l.db, r, u); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else if err := u.saveToSession(l.db, l.s, w, r); err != nil {
 		c.Error = err.Error()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	} else {
+		audit(l.db, r, u.ID, u.ID, auditLogin, map[string]string{"method": "password"})
 		redirectAfterLogin(l.s, w, r)
 	}
 }
@@ -93,10 +105,3 @@ func (l loginGetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		templateHandler("login.html", newLoginContext(url), w, r)
 	}
 }
-
-func executeContextTemplate(w http.ResponseWriter, n string, c interface{}) {
-	err := templates.ExecuteTemplate(w, n, c)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-}
@@ -0,0 +1,63 @@
+package account
+
+import (
+	"errors"
+	"log"
+	"mime"
+	"net/smtp"
+	"strings"
+)
+
+var errInvalidMailHeader = errors.New("line break in mail header")
+
+// Mailer sends plain text email to users, e.g. to confirm an address.
+type Mailer interface {
+	SendMail(to, subject, body string) error
+}
+
+// logMailer writes messages to the log instead of sending them, so the
+// account pages work during development without a mail server.
+type logMailer struct{}
+
+func (logMailer) SendMail(to, subject, body string) error {
+	log.Printf("mail to %v: %v\n%v", to, subject, body)
+	return nil
+}
+
+// SMTPMailer sends email through an SMTP server.
+type SMTPMailer struct {
+	// Addr is the server's host:port.
+	Addr string
+	From string
+	// Auth may be nil for servers that don't require it.
+	Auth smtp.Auth
+}
+
+func (m *SMTPMailer) SendMail(to, subject, body string) error {
+	msg, err := m.message(to, subject, body)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg))
+}
+
+// message formats the mail.  Line breaks in the recipient or subject, which
+// would let them add headers, are refused, and subjects that aren't ASCII
+// are encoded.
+func (m *SMTPMailer) message(to, subject, body string) (string, error) {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return "", errInvalidMailHeader
+	}
+	return "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		strings.Replace(body, "\n", "\r\n", -1), nil
+}
+
+// SetMailer changes how email is sent to users.  Until it is called
+// messages are only logged.  It must be called before CreateRoutes.
+func (am *AccountManager) SetMailer(m Mailer) {
+	am.mailer = m
+}
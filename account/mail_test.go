@@ -0,0 +1,23 @@
+package account
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSMTPMailerMessage(t *testing.T) {
+	m := &SMTPMailer{From: "accounts@example.com"}
+	if _, err := m.message("a@example.com", "Join x\r\nBcc: victim@example.com", "hi"); err != errInvalidMailHeader {
+		t.Errorf("Expected line break in subject to be refused, got %v", err)
+	}
+	if _, err := m.message("a@example.com\nBcc: victim@example.com", "Hi", "hi"); err != errInvalidMailHeader {
+		t.Errorf("Expected line break in recipient to be refused, got %v", err)
+	}
+	msg, err := m.message("a@example.com", "Join Café", "hi\nthere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg, "Subject: =?utf-8?q?Join_Caf=C3=A9?=\r\n") || !strings.HasSuffix(msg, "hi\r\nthere") {
+		t.Errorf("Expected encoded subject and body, got %q", msg)
+	}
+}
@@ -0,0 +1,957 @@
+package account
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/schema"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	oauthAccessTokenPrefix  = "gwo_"
+	oauthRefreshTokenPrefix = "gwr_"
+
+	oauthCodeTTL        = 10 * time.Minute
+	oauthAccessTokenTTL = time.Hour
+	// oauthCodeKeep is how long used codes are kept past their expiration,
+	// to catch them being replayed.
+	oauthCodeKeep = 24 * time.Hour
+)
+
+var (
+	errInvalidOAuthClient = errors.New("invalid client")
+	errInvalidOAuthToken  = errors.New("invalid or expired oauth token")
+	// errOAuthClientToken refuses the tokens of OAuth clients on routes not
+	// guarded by RequireScopeMiddleware.
+	errOAuthClientToken = errors.New("oauth client tokens are limited to their scopes")
+)
+
+type oauthClient struct {
+	ID           int64
+	ClientID     string
+	Name         string
+	RedirectURIs []string
+	Scopes       []string
+	OwnerID      int64
+	secretHash   string
+
+	// ClientCredentials is set when an admin let the client use the
+	// client_credentials grant, getting tokens with no user behind them.
+	ClientCredentials bool
+}
+
+type oauthToken struct {
+	id         int64
+	tokenType  string
+	clientID   string
+	userID     int64
+	scopes     []string
+	expiration time.Time
+}
+
+// oauthError is the error body defined by RFC 6749 section 5.2.
+type oauthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// oauthGrant is what an authorization code or refresh token was issued for.
+type oauthGrant struct {
+	userID int64
+	scopes []string
+	nonce  string
+}
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+type oauthIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+func randomSecret(prefix string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// newOAuthClient registers a client.  Public clients, such as mobile apps,
+// get no secret and must use PKCE.
+func newOAuthClient(db *sql.DB, ownerID int64, name string, redirectURIs, scopes []string,
+	public bool) (*oauthClient, string, error) {
+	id, err := randomSecret("")
+	if err != nil {
+		return nil, "", err
+	}
+	c := &oauthClient{
+		ClientID:     id[:22],
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Scopes:       scopes,
+		OwnerID:      ownerID}
+	var secret string
+	if !public {
+		if secret, err = randomSecret(""); err != nil {
+			return nil, "", err
+		}
+		c.secretHash = hashSecret(secret)
+	}
+	r, err := db.Exec(
+		"INSERT INTO OAuthClients (client_id, secret_hash, name, redirect_uris, scopes, owner_id) VALUES ($1, $2, $3, $4, $5, $6)",
+		c.ClientID,
+		c.secretHash,
+		c.Name,
+		strings.Join(c.RedirectURIs, " "),
+		strings.Join(c.Scopes, " "),
+		c.OwnerID)
+	if err != nil {
+		return nil, "", err
+	}
+	c.ID, err = r.LastInsertId()
+	return c, secret, err
+}
+
+const oauthClientColumns = "id, client_id, secret_hash, name, redirect_uris, scopes, owner_id, client_credentials"
+
+func scanOAuthClient(row interface {
+	Scan(...interface{}) error
+}) (*oauthClient, error) {
+	c := &oauthClient{}
+	var uris, scopes string
+	err := row.Scan(&c.ID, &c.ClientID, &c.secretHash, &c.Name, &uris, &scopes, &c.OwnerID, &c.ClientCredentials)
+	if err != nil {
+		return nil, err
+	}
+	c.RedirectURIs = strings.Fields(uris)
+	c.Scopes = strings.Fields(scopes)
+	return c, nil
+}
+
+func loadOAuthClient(db *sql.DB, clientID string) (*oauthClient, error) {
+	c, err := scanOAuthClient(db.QueryRow(
+		"SELECT "+oauthClientColumns+" FROM OAuthClients WHERE client_id = ?", clientID))
+	if err == sql.ErrNoRows {
+		return nil, errInvalidOAuthClient
+	}
+	return c, err
+}
+
+func loadOAuthClientsByOwner(db *sql.DB, ownerID int64) ([]*oauthClient, error) {
+	return loadOAuthClients(db, "WHERE owner_id = ? ORDER BY id", ownerID)
+}
+
+func loadOAuthClients(db *sql.DB, query string, args ...interface{}) ([]*oauthClient, error) {
+	rows, err := db.Query("SELECT "+oauthClientColumns+" FROM OAuthClients "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cs []*oauthClient
+	for rows.Next() {
+		c, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	return cs, rows.Err()
+}
+
+func deleteOAuthClient(db *sql.DB, ownerID int64, clientID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	r, err := tx.Exec("DELETE FROM OAuthClients WHERE client_id = ? AND owner_id = ?", clientID, ownerID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return nil
+	}
+	if _, err := tx.Exec("DELETE FROM OAuthTokens WHERE client_id = ?", clientID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM OAuthCodes WHERE client_id = ?", clientID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// setOAuthClientCredentials allows or stops the confidential client using
+// the client_credentials grant.  Stopping it revokes the tokens it got so.
+func setOAuthClientCredentials(db *sql.DB, clientID string, allowed bool) error {
+	r, err := db.Exec("UPDATE OAuthClients SET client_credentials = ? WHERE client_id = ? AND secret_hash != ''",
+		allowed, clientID)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errInvalidOAuthClient
+	}
+	if !allowed {
+		_, err = db.Exec("DELETE FROM OAuthTokens WHERE client_id = ? AND user_id = 0", clientID)
+	}
+	return err
+}
+
+func (c *oauthClient) IsPublic() bool {
+	return len(c.secretHash) == 0
+}
+
+func (c *oauthClient) checkSecret(secret string) bool {
+	if c.IsPublic() {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.secretHash), []byte(hashSecret(secret))) == 1
+}
+
+func (c *oauthClient) allowsRedirect(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// grantScopes narrows the requested scopes to those the client registered.
+// An empty request grants all of the client's scopes.
+func (c *oauthClient) grantScopes(requested string) ([]string, bool) {
+	req := strings.Fields(requested)
+	if len(req) == 0 {
+		return c.Scopes, true
+	}
+	for _, s := range req {
+		if !hasScope(c.Scopes, s) {
+			return nil, false
+		}
+	}
+	return req, true
+}
+
+// authenticateOAuthClient identifies the client calling the token,
+// introspection or revocation endpoints, by HTTP basic auth or form
+// parameters.  Public clients are identified by client_id alone.
+func authenticateOAuthClient(db *sql.DB, r *http.Request) (*oauthClient, error) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	c, err := loadOAuthClient(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if c.IsPublic() {
+		if len(secret) != 0 {
+			return nil, errInvalidOAuthClient
+		}
+		return c, nil
+	}
+	if !c.checkSecret(secret) {
+		return nil, errInvalidOAuthClient
+	}
+	return c, nil
+}
+
+func newOAuthCode(db *sql.DB, c *oauthClient, u *User, redirectURI string, scopes []string,
+	challenge, nonce string) (string, error) {
+	code, err := randomSecret("")
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if _, err := db.Exec("DELETE FROM OAuthCodes WHERE expiration < ?", now.Add(-oauthCodeKeep).Unix()); err != nil {
+		return "", err
+	}
+	_, err = db.Exec(
+		"INSERT INTO OAuthCodes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, nonce, expiration) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		hashSecret(code),
+		c.ClientID,
+		u.ID,
+		redirectURI,
+		strings.Join(scopes, " "),
+		challenge,
+		nonce,
+		now.Add(oauthCodeTTL).Unix())
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// useOAuthCode redeems an authorization code once, checking it was issued to
+// c for redirectURI and, when PKCE was used, that verifier matches.  A code
+// used again was likely stolen, so the tokens issued to its client for its
+// user are revoked, as RFC 6749 section 4.1.2 recommends.
+func useOAuthCode(db *sql.DB, c *oauthClient, code, redirectURI, verifier string) (*oauthGrant, error) {
+	g := &oauthGrant{}
+	var clientID, uri, scopes, challenge string
+	var expiration int64
+	var used bool
+	h := hashSecret(code)
+	err := db.QueryRow(
+		"SELECT client_id, user_id, redirect_uri, scopes, code_challenge, nonce, expiration, used FROM OAuthCodes WHERE code_hash = ?",
+		h).Scan(&clientID, &g.userID, &uri, &scopes, &challenge, &g.nonce, &expiration, &used)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidOAuthToken
+	} else if err != nil {
+		return nil, err
+	}
+	if used {
+		_, err := db.Exec("DELETE FROM OAuthTokens WHERE client_id = ? AND user_id = ?", clientID, g.userID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, errInvalidOAuthToken
+	}
+	r, err := db.Exec("UPDATE OAuthCodes SET used = 1 WHERE code_hash = ? AND used = 0", h)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, errInvalidOAuthToken
+	}
+
+	if clientID != c.ClientID || uri != redirectURI || time.Now().Unix() >= expiration {
+		return nil, errInvalidOAuthToken
+	}
+	if len(challenge) != 0 || c.IsPublic() {
+		if !checkPKCE(challenge, verifier) {
+			return nil, errInvalidOAuthToken
+		}
+	}
+	g.scopes = strings.Fields(scopes)
+	return g, nil
+}
+
+// checkPKCE verifies an S256 code challenge, RFC 7636.
+func checkPKCE(challenge, verifier string) bool {
+	if len(challenge) == 0 || len(verifier) < 43 {
+		return false
+	}
+	h := sha256.Sum256([]byte(verifier))
+	v := base64.RawURLEncoding.EncodeToString(h[:])
+	return subtle.ConstantTimeCompare([]byte(v), []byte(challenge)) == 1
+}
+
+func newOAuthToken(db *sql.DB, prefix, tokenType, clientID string, userID int64, scopes []string,
+	ttl time.Duration) (string, error) {
+	secret, err := randomSecret(prefix)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(
+		"INSERT INTO OAuthTokens (token_hash, type, client_id, user_id, scopes, expiration) VALUES ($1, $2, $3, $4, $5, $6)",
+		hashSecret(secret),
+		tokenType,
+		clientID,
+		userID,
+		strings.Join(scopes, " "),
+		time.Now().Add(ttl).Unix())
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func loadOAuthToken(db *sql.DB, secret string) (*oauthToken, error) {
+	t := &oauthToken{}
+	var scopes string
+	var expiration int64
+	err := db.QueryRow(
+		"SELECT id, type, client_id, user_id, scopes, expiration FROM OAuthTokens WHERE token_hash = ?",
+		hashSecret(secret)).
+		Scan(&t.id, &t.tokenType, &t.clientID, &t.userID, &scopes, &expiration)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidOAuthToken
+	} else if err != nil {
+		return nil, err
+	}
+	t.scopes = strings.Fields(scopes)
+	t.expiration = time.Unix(expiration, 0)
+	if time.Now().After(t.expiration) {
+		return nil, errInvalidOAuthToken
+	}
+	return t, nil
+}
+
+func deleteOAuthToken(db *sql.DB, id int64) error {
+	_, err := db.Exec("DELETE FROM OAuthTokens WHERE id = ?", id)
+	return err
+}
+
+// loadUserByOAuthToken resolves an OAuth access token.  Tokens from the
+// client credentials grant act for a client rather than a user, so the
+// returned user may be nil.
+func loadUserByOAuthToken(db *sql.DB, secret string) (*User, *oauthToken, error) {
+	t, err := loadOAuthToken(db, secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.tokenType != "access" {
+		return nil, nil, errInvalidOAuthToken
+	}
+	if t.userID == 0 {
+		return nil, t, nil
+	}
+	u, err := loadUserByID(db, t.userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, t, nil
+}
+
+// OAuthClientID returns the OAuth client a request was made by, or the empty
+// string if it was not authenticated by an OAuth access token.
+func OAuthClientID(r *http.Request) string {
+	id, _ := r.Context().Value(oauthClientContextKey).(string)
+	return id
+}
+
+func withOAuthClient(r *http.Request, t *oauthToken) *http.Request {
+	r = withScopes(r, t.scopes)
+	return r.WithContext(context.WithValue(r.Context(), oauthClientContextKey, t.clientID))
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, desc string) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, &oauthError{Error: code, ErrorDescription: desc})
+}
+
+type oauthServer struct {
+	db     *sql.DB
+	s      sessions.Store
+	keys   *keySet
+	hooks  hooks
+	issuer string
+}
+
+func newOAuthServer(db *sql.DB, s sessions.Store, keys *keySet, hs hooks, issuer string) *oauthServer {
+	return &oauthServer{db, s, keys, hs, issuer}
+}
+
+// authorizeRequest holds the parameters of an authorization request.  They
+// round trip through the consent form so the POST can be validated again.
+type authorizeRequest struct {
+	ResponseType        string `schema:"response_type"`
+	ClientID            string `schema:"client_id"`
+	RedirectURI         string `schema:"redirect_uri"`
+	Scope               string `schema:"scope"`
+	State               string `schema:"state"`
+	CodeChallenge       string `schema:"code_challenge"`
+	CodeChallengeMethod string `schema:"code_challenge_method"`
+	Nonce               string `schema:"nonce"`
+	Approve             string `schema:"approve"`
+	Token               string `schema:"csrf_token"`
+}
+
+type consentContext struct {
+	Form   *authorizeRequest
+	Client *oauthClient
+	Scopes []string
+	User   *User
+	Error  string
+}
+
+func (c *consentContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+// redirectError sends an authorization error back to the client.
+func (ar *authorizeRequest) redirectError(w http.ResponseWriter, r *http.Request, code string) {
+	ar.redirect(w, r, url.Values{"error": {code}})
+}
+
+func (ar *authorizeRequest) redirect(w http.ResponseWriter, r *http.Request, v url.Values) {
+	u, _ := url.Parse(ar.RedirectURI)
+	q := u.Query()
+	for k, vs := range v {
+		q[k] = vs
+	}
+	if len(ar.State) != 0 {
+		q.Set("state", ar.State)
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// validate checks the request, answering the user agent itself when it does
+// not return a consent context.  Problems with the client or redirect uri are
+// shown to the user, never redirected, so they cannot be used as an open
+// redirect.
+func (o oauthServer) validate(w http.ResponseWriter, r *http.Request, ar *authorizeRequest) *consentContext {
+	c, err := loadOAuthClient(o.db, ar.ClientID)
+	if err == errInvalidOAuthClient {
+		http.Error(w, "Unknown client", http.StatusBadRequest)
+		return nil
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if !c.allowsRedirect(ar.RedirectURI) {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return nil
+	}
+
+	if ar.ResponseType != "code" {
+		ar.redirectError(w, r, "unsupported_response_type")
+		return nil
+	}
+	scopes, ok := c.grantScopes(ar.Scope)
+	if !ok {
+		ar.redirectError(w, r, "invalid_scope")
+		return nil
+	}
+	if len(ar.CodeChallenge) != 0 && ar.CodeChallengeMethod != "S256" {
+		ar.redirectError(w, r, "invalid_request")
+		return nil
+	}
+	if c.IsPublic() && len(ar.CodeChallenge) == 0 {
+		ar.redirectError(w, r, "invalid_request")
+		return nil
+	}
+
+	u, err := UserFromRequest(o.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return nil
+	}
+	return &consentContext{Form: ar, Client: c, Scopes: scopes, User: u}
+}
+
+func (o oauthServer) authorizeGet(w http.ResponseWriter, r *http.Request) {
+	ar := &authorizeRequest{}
+	d := schema.NewDecoder()
+	d.IgnoreUnknownKeys(true)
+	if err := d.Decode(ar, r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c := o.validate(w, r, ar)
+	if c == nil {
+		return
+	}
+	templateHandler("oauth_consent.html", c, w, r)
+}
+
+func (o oauthServer) authorizePost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ar := &authorizeRequest{}
+	if err := schema.NewDecoder().Decode(ar, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c := o.validate(w, r, ar)
+	if c == nil {
+		return
+	}
+	if len(ar.Approve) == 0 {
+		ar.redirectError(w, r, "access_denied")
+		return
+	}
+
+	code, err := newOAuthCode(o.db, c.Client, c.User, ar.RedirectURI, c.Scopes,
+		ar.CodeChallenge, ar.Nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(o.db, r, c.User.ID, c.User.ID, auditOAuthGrant, map[string]string{
+		"client_id": c.Client.ClientID,
+		"scopes":    strings.Join(c.Scopes, " ")})
+	ar.redirect(w, r, url.Values{"code": {code}})
+}
+
+func (o oauthServer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	c, err := authenticateOAuthClient(o.db, r)
+	if err == errInvalidOAuthClient {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	g := &oauthGrant{}
+	refresh := true
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		g, err = useOAuthCode(o.db, c, r.PostForm.Get("code"),
+			r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	case "refresh_token":
+		var t *oauthToken
+		t, err = loadOAuthToken(o.db, r.PostForm.Get("refresh_token"))
+		if err == nil && (t.tokenType != "refresh" || t.clientID != c.ClientID) {
+			err = errInvalidOAuthToken
+		}
+		if err == nil {
+			// Refresh tokens rotate on every use.
+			g.userID, g.scopes = t.userID, t.scopes
+			err = deleteOAuthToken(o.db, t.id)
+		}
+	case "client_credentials":
+		if c.IsPublic() || !c.ClientCredentials {
+			writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "")
+			return
+		}
+		var ok bool
+		if g.scopes, ok = c.grantScopes(r.PostForm.Get("scope")); !ok {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "")
+			return
+		}
+		refresh = false
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	if err == errInvalidOAuthToken {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	tr := &oauthTokenResponse{
+		TokenType: "Bearer",
+		ExpiresIn: int64(oauthAccessTokenTTL / time.Second),
+		Scope:     strings.Join(g.scopes, " ")}
+	tr.AccessToken, err = newOAuthToken(o.db, oauthAccessTokenPrefix, "access", c.ClientID,
+		g.userID, g.scopes, oauthAccessTokenTTL)
+	if err == nil && refresh {
+		tr.RefreshToken, err = newOAuthToken(o.db, oauthRefreshTokenPrefix, "refresh", c.ClientID,
+			g.userID, g.scopes, refreshTokenTTL)
+	}
+	if err == nil && g.userID != 0 && hasScope(g.scopes, "openid") {
+		tr.IDToken, err = o.newIDToken(c, g)
+	}
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, tr)
+}
+
+// introspect implements RFC 7662.  Clients may only introspect their own
+// tokens.
+func (o oauthServer) introspect(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	c, err := authenticateOAuthClient(o.db, r)
+	if err == errInvalidOAuthClient || (err == nil && c.IsPublic()) {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	t, err := loadOAuthToken(o.db, r.PostForm.Get("token"))
+	if err == errInvalidOAuthToken || (err == nil && t.clientID != c.ClientID) {
+		writeJSON(w, http.StatusOK, &oauthIntrospection{Active: false})
+		return
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	i := &oauthIntrospection{
+		Active:    true,
+		Scope:     strings.Join(t.scopes, " "),
+		ClientID:  t.clientID,
+		TokenType: t.tokenType,
+		ExpiresAt: t.expiration.Unix()}
+	if t.userID != 0 {
+		i.Subject = strconv.FormatInt(t.userID, 10)
+	}
+	writeJSON(w, http.StatusOK, i)
+}
+
+// revoke implements RFC 7009.  Unknown tokens are not an error.
+func (o oauthServer) revoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	c, err := authenticateOAuthClient(o.db, r)
+	if err == errInvalidOAuthClient {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	t, err := loadOAuthToken(o.db, r.PostForm.Get("token"))
+	if err == nil && t.clientID == c.ClientID {
+		err = deleteOAuthToken(o.db, t.id)
+	}
+	if err != nil && err != errInvalidOAuthToken {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type oauthClientsForm struct {
+	Name         string
+	RedirectURIs string
+	Scopes       []string
+	Public       bool
+	Token        string `schema:"csrf_token"`
+}
+
+type oauthClientDeleteForm struct {
+	ClientID string
+	Token    string `schema:"csrf_token"`
+}
+
+type oauthClientsContext struct {
+	Form      *oauthClientsForm
+	Clients   []*oauthClient
+	AllScopes []string
+	NewClient *oauthClient
+	NewSecret string
+	Error     string
+}
+
+func newOAuthClientsContext(db *sql.DB, u *User) (*oauthClientsContext, error) {
+	cs, err := loadOAuthClientsByOwner(db, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &oauthClientsContext{
+		Form:      &oauthClientsForm{},
+		Clients:   cs,
+		AllScopes: oauthClientScopes()}, nil
+}
+
+func (c *oauthClientsContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+func (f *oauthClientsForm) validate() (uris []string, msg string) {
+	if len(strings.TrimSpace(f.Name)) == 0 {
+		return nil, "Name is required"
+	}
+	uris = strings.Fields(f.RedirectURIs)
+	if len(uris) == 0 {
+		return nil, "At least one redirect uri is required"
+	}
+	for _, u := range uris {
+		pu, err := url.Parse(u)
+		if err != nil || !pu.IsAbs() || len(pu.Fragment) != 0 {
+			return nil, "Invalid redirect uri " + u
+		}
+	}
+	if len(f.Scopes) == 0 {
+		return nil, "Select at least one scope"
+	}
+	for _, s := range f.Scopes {
+		if !hasScope(oauthClientScopes(), s) {
+			return nil, "Unknown scope " + s
+		}
+	}
+	return uris, ""
+}
+
+func (o oauthServer) clientsGet(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(o.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	c, err := newOAuthClientsContext(o.db, u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateHandler("oauth_clients.html", c, w, r)
+}
+
+func (o oauthServer) clientsPost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := UserFromRequest(o.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	f := &oauthClientsForm{}
+	if err := schema.NewDecoder().Decode(f, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var nc *oauthClient
+	var secret string
+	uris, msg := f.validate()
+	if len(msg) == 0 {
+		nc, secret, err = newOAuthClient(o.db, u.ID, strings.TrimSpace(f.Name), uris, f.Scopes, f.Public)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(o.db, r, u.ID, u.ID, auditOAuthClientCreated, map[string]string{"client_id": nc.ClientID})
+	}
+
+	c, err := newOAuthClientsContext(o.db, u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Error = msg
+	c.NewClient = nc
+	c.NewSecret = secret
+	templateHandler("oauth_clients.html", c, w, r)
+}
+
+func (o oauthServer) clientDeletePost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := UserFromRequest(o.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	f := &oauthClientDeleteForm{}
+	if err := schema.NewDecoder().Decode(f, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := deleteOAuthClient(o.db, u.ID, f.ClientID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(o.db, r, u.ID, u.ID, auditOAuthClientDeleted, map[string]string{"client_id": f.ClientID})
+	http.Redirect(w, r, "clients", http.StatusFound)
+}
+
+type adminOAuthClientsForm struct {
+	ClientID string
+	Action   string
+	Token    string `schema:"csrf_token"`
+}
+
+type adminOAuthClientsContext struct {
+	Form    *adminOAuthClientsForm
+	Clients []*oauthClient
+	Message string
+}
+
+func (c *adminOAuthClientsContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+func (o oauthServer) renderAdminClients(w http.ResponseWriter, r *http.Request, msg string) {
+	// Public clients can't use the client_credentials grant.
+	cs, err := loadOAuthClients(o.db,
+		"WHERE secret_hash != '' ORDER BY client_credentials, id DESC LIMIT ?", adminPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateHandler("admin_oauth_clients.html", &adminOAuthClientsContext{
+		Form: &adminOAuthClientsForm{}, Clients: cs, Message: msg}, w, r)
+}
+
+// adminClients lists the confidential clients, those waiting for the
+// client_credentials grant first.
+func (o oauthServer) adminClients(w http.ResponseWriter, r *http.Request) {
+	o.renderAdminClients(w, r, "")
+}
+
+// adminClientAction allows or stops the client given by the clientid field
+// using the client_credentials grant.
+func (o oauthServer) adminClientAction(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	admin, err := UserFromRequest(o.s, r)
+	if err != nil || admin == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	f := &adminOAuthClientsForm{}
+	if err := schema.NewDecoder().Decode(f, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var allowed bool
+	switch f.Action {
+	case "approve":
+		allowed = true
+	case "revoke":
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	c, err := loadOAuthClient(o.db, f.ClientID)
+	if err == nil {
+		err = setOAuthClientCredentials(o.db, c.ClientID, allowed)
+	}
+	if err == errInvalidOAuthClient {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(o.db, r, admin.ID, c.OwnerID, auditOAuthClientApproval,
+		map[string]string{"client_id": c.ClientID, "allowed": strconv.FormatBool(allowed)})
+	msg := c.Name + " may no longer use client credentials"
+	if allowed {
+		msg = c.Name + " may now use client credentials"
+	}
+	o.renderAdminClients(w, r, msg)
+}
@@ -0,0 +1,222 @@
+package account
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestOAuthCodePKCE(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("some@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal("Failed to insert user")
+	}
+	c, secret, err := newOAuthClient(db, u.ID, "app", []string{"https://app/cb"}, []string{"read"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 0 || !c.IsPublic() {
+		t.Error("Expected public client without secret")
+	}
+
+	verifier := strings.Repeat("v", 43)
+	h := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(h[:])
+
+	code, err := newOAuthCode(db, c, u, "https://app/cb", c.Scopes, challenge, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := useOAuthCode(db, c, code, "https://app/cb", "wrong"+verifier); err != errInvalidOAuthToken {
+		t.Errorf("Expected bad verifier to fail, got %v", err)
+	}
+
+	code, _ = newOAuthCode(db, c, u, "https://app/cb", c.Scopes, challenge, "")
+	g, err := useOAuthCode(db, c, code, "https://app/cb", verifier)
+	if err != nil || g.userID != u.ID || len(g.scopes) != 1 {
+		t.Fatalf("Expected code for user, got %v %v", g, err)
+	}
+	tok, err := newOAuthToken(db, oauthAccessTokenPrefix, "access", c.ClientID, u.ID, g.scopes, oauthAccessTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := useOAuthCode(db, c, code, "https://app/cb", verifier); err != errInvalidOAuthToken {
+		t.Errorf("Expected code to be single use, got %v", err)
+	}
+	if _, err := loadOAuthToken(db, tok); err != errInvalidOAuthToken {
+		t.Errorf("Expected replaying the code to revoke its tokens, got %v", err)
+	}
+}
+
+func TestOAuthClientCredentials(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	c, secret, err := newOAuthClient(db, 1, "svc", []string{"https://svc/cb"}, []string{"read", "write"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := newOAuthServer(db, nil, &keySet{}, nil, "http://localhost/account")
+
+	post := func(h http.HandlerFunc, v url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(v.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(c.ClientID, secret)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	w := post(o.token, url.Values{"grant_type": {"client_credentials"}, "scope": {"read"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected clients to need approval for client credentials, got %v", w.Code)
+	}
+	if err := setOAuthClientCredentials(db, c.ClientID, true); err != nil {
+		t.Fatal(err)
+	}
+	w = post(o.token, url.Values{"grant_type": {"client_credentials"}, "scope": {"read"}})
+	tr := &oauthTokenResponse{}
+	json.NewDecoder(w.Body).Decode(tr)
+	if w.Code != http.StatusOK || tr.Scope != "read" || len(tr.RefreshToken) != 0 {
+		t.Fatalf("Expected read token without refresh, got %v %v", w.Code, tr)
+	}
+
+	w = post(o.introspect, url.Values{"token": {tr.AccessToken}})
+	i := &oauthIntrospection{}
+	json.NewDecoder(w.Body).Decode(i)
+	if !i.Active || i.ClientID != c.ClientID || i.Scope != "read" {
+		t.Errorf("Expected active token, got %v", i)
+	}
+
+	post(o.revoke, url.Values{"token": {tr.AccessToken}})
+	w = post(o.introspect, url.Values{"token": {tr.AccessToken}})
+	i = &oauthIntrospection{}
+	json.NewDecoder(w.Body).Decode(i)
+	if i.Active {
+		t.Error("Expected revoked token to be inactive")
+	}
+
+	w = post(o.token, url.Values{"grant_type": {"client_credentials"}, "scope": {"admin"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected unregistered scope to be refused, got %v", w.Code)
+	}
+
+	w = post(o.token, url.Values{"grant_type": {"client_credentials"}, "scope": {"read"}})
+	tr = &oauthTokenResponse{}
+	json.NewDecoder(w.Body).Decode(tr)
+	if err := setOAuthClientCredentials(db, c.ClientID, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadOAuthToken(db, tr.AccessToken); err != errInvalidOAuthToken {
+		t.Errorf("Expected withdrawing approval to revoke the client's tokens, got %v", err)
+	}
+}
+
+func TestOIDCIDTokenAndUserinfo(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("some@email.com")
+	u.EmailVerified = true
+	if err := u.insert(db); err != nil {
+		t.Fatal("Failed to insert user")
+	}
+	c, secret, err := newOAuthClient(db, u.ID, "rp", []string{"https://rp/cb"},
+		[]string{"openid", "email"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := newOAuthServer(db, nil, &keySet{}, nil, "http://localhost/account")
+	code, err := newOAuthCode(db, c, u, "https://rp/cb", c.Scopes, "", "n-0S6")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"https://rp/cb"}}
+	r := httptest.NewRequest("POST", "/", strings.NewReader(v.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(c.ClientID, secret)
+	w := httptest.NewRecorder()
+	o.token(w, r)
+	tr := &oauthTokenResponse{}
+	json.NewDecoder(w.Body).Decode(tr)
+	if w.Code != http.StatusOK || len(tr.IDToken) == 0 {
+		t.Fatalf("Expected id token, got %v %v", w.Code, tr)
+	}
+
+	claims := &idClaims{}
+	if err := o.keys.verify(tr.IDToken, claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != c.ClientID || claims.Nonce != "n-0S6" || claims.Email != u.Email ||
+		claims.EmailVerified == nil || !*claims.EmailVerified {
+		t.Errorf("Unexpected id token claims %v", claims)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+tr.AccessToken)
+	w = httptest.NewRecorder()
+	o.userinfo(w, r)
+	ui := &userInfo{}
+	json.NewDecoder(w.Body).Decode(ui)
+	if w.Code != http.StatusOK || ui.Subject != claims.Subject || ui.Email != u.Email {
+		t.Errorf("Unexpected userinfo %v %v", w.Code, ui)
+	}
+}
+
+func TestOAuthClientTokenScopes(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("some@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal("Failed to insert user")
+	}
+	tok, err := newOAuthToken(db, oauthAccessTokenPrefix, "access", "client", u.ID, []string{"openid", "read"},
+		oauthAccessTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	am := NewAccountManager(sessions.NewCookieStore([]byte("secret")), db,
+		"http://localhost", NewFacebookClient("", ""))
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	serve := func(h http.Handler) int {
+		r := httptest.NewRequest("GET", "/private", nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := serve(am.RequireUserMiddleware()(ok)); code != http.StatusForbidden {
+		t.Errorf("Expected client token to be refused without a scope check, got %v", code)
+	}
+	if code := serve(am.RequireScopeMiddleware("read")(ok)); code != http.StatusOK {
+		t.Errorf("Expected client token to be let through with its scope, got %v", code)
+	}
+	if code := serve(am.RequireScopeMiddleware("write")(ok)); code != http.StatusForbidden {
+		t.Errorf("Expected client token to be refused other scopes, got %v", code)
+	}
+}
@@ -0,0 +1,194 @@
+package account
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Scopes defined by OpenID Connect, available to OAuth clients alongside the
+// api token scopes.
+var oidcScopes = []string{
+	"openid",
+	"email",
+	"profile",
+}
+
+type idClaims struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub"`
+	Audience      string `json:"aud"`
+	IssuedAt      int64  `json:"iat"`
+	ExpiresAt     int64  `json:"exp"`
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	profileClaims
+}
+
+type userInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	profileClaims
+}
+
+// profileClaims are the standard claims granted by the profile scope.
+type profileClaims struct {
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Picture           string `json:"picture,omitempty"`
+	Locale            string `json:"locale,omitempty"`
+	Zoneinfo          string `json:"zoneinfo,omitempty"`
+}
+
+func newProfileClaims(u *User) profileClaims {
+	return profileClaims{
+		Name:              u.DisplayName,
+		PreferredUsername: u.Username,
+		Picture:           u.AvatarURL,
+		Locale:            u.Locale,
+		Zoneinfo:          u.Timezone}
+}
+
+type oidcDiscovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	EndSessionEndpoint                string   `json:"end_session_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+func oauthClientScopes() []string {
+	s := append([]string{}, apiTokenScopes...)
+	return append(s, oidcScopes...)
+}
+
+func (o oauthServer) newIDToken(c *oauthClient, g *oauthGrant) (string, error) {
+	u, err := loadUserByID(o.db, g.userID)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := &idClaims{
+		Issuer:    o.issuer,
+		Subject:   strconv.FormatInt(u.ID, 10),
+		Audience:  c.ClientID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(oauthAccessTokenTTL).Unix(),
+		Nonce:     g.nonce}
+	if hasScope(g.scopes, "email") {
+		claims.Email = u.Email
+		claims.EmailVerified = &u.EmailVerified
+	}
+	if hasScope(g.scopes, "profile") {
+		claims.profileClaims = newProfileClaims(u)
+	}
+	return o.keys.sign(claims)
+}
+
+func (o oauthServer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &oidcDiscovery{
+		Issuer:                            o.issuer,
+		AuthorizationEndpoint:             o.issuer + "/oauth/authorize",
+		TokenEndpoint:                     o.issuer + "/oauth/token",
+		UserinfoEndpoint:                  o.issuer + "/oauth/userinfo",
+		JWKSURI:                           o.issuer + "/jwks.json",
+		EndSessionEndpoint:                o.issuer + "/oauth/logout",
+		IntrospectionEndpoint:             o.issuer + "/oauth/introspect",
+		RevocationEndpoint:                o.issuer + "/oauth/revoke",
+		ScopesSupported:                   oauthClientScopes(),
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token", "client_credentials"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported: []string{"iss", "sub", "aud", "iat", "exp", "nonce", "email", "email_verified",
+			"name", "preferred_username", "picture", "locale", "zoneinfo"},
+	})
+}
+
+func (o oauthServer) userinfo(w http.ResponseWriter, r *http.Request) {
+	u, t, err := loadUserByOAuthToken(o.db, bearerToken(r))
+	if err == errInvalidOAuthToken || (err == nil && u == nil) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "")
+		return
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	if !hasScope(t.scopes, "openid") {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		writeOAuthError(w, http.StatusForbidden, "insufficient_scope", "")
+		return
+	}
+
+	ui := &userInfo{Subject: strconv.FormatInt(u.ID, 10)}
+	if hasScope(t.scopes, "email") {
+		ui.Email = u.Email
+		ui.EmailVerified = &u.EmailVerified
+	}
+	if hasScope(t.scopes, "profile") {
+		ui.profileClaims = newProfileClaims(u)
+	}
+	writeJSON(w, http.StatusOK, ui)
+}
+
+// logout implements RP-initiated logout.  The user is only sent back to the
+// client when the id_token_hint proves which client is asking and the
+// post_logout_redirect_uri is one of its registered redirect uris.
+func (o oauthServer) logout(w http.ResponseWriter, r *http.Request) {
+	if err := endSession(o.db, o.s, o.hooks, w, r); err != nil {
+		if v, ok := err.(*vetoError); ok {
+			http.Error(w, v.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	target := q.Get("post_logout_redirect_uri")
+	if len(target) == 0 {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	// Expired id tokens are fine as a hint, only the signature matters.
+	claims := &idClaims{}
+	if err := o.keys.verify(q.Get("id_token_hint"), claims); err != nil || claims.Issuer != o.issuer {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	c, err := loadOAuthClient(o.db, claims.Audience)
+	if err != nil || !c.allowsRedirect(target) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if state := q.Get("state"); len(state) != 0 {
+		v := u.Query()
+		v.Set("state", state)
+		u.RawQuery = v.Encode()
+	}
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
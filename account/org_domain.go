@@ -0,0 +1,394 @@
+package account
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/idna"
+)
+
+// What happens to users with a verified address at a domain an
+// organization claimed.
+const (
+	// DomainAutoJoin makes them members.
+	DomainAutoJoin = "join"
+	// DomainAutoRequest asks the organization's admins to let them in.
+	DomainAutoRequest = "request"
+)
+
+// Statuses of the requests to join an organization made for users at its
+// domains.  Every user gets at most one per organization, so those removed
+// or denied are not brought back.
+const (
+	joinPending  = "pending"
+	joinApproved = "approved"
+	joinDenied   = "denied"
+	// joinJoined marks users added to the organization straight away.
+	joinJoined = "joined"
+)
+
+// domainVerificationPrefix names the TXT record proving a domain claim:
+// _account-verify.example.com must hold account-verify=<token>.
+const domainVerificationPrefix = "_account-verify"
+
+var (
+	errInvalidDomain     = errors.New("invalid domain")
+	errDomainClaimed     = errors.New("domain already claimed")
+	errDomainNotVerified = errors.New("verification record not found")
+)
+
+// TXTResolver looks up DNS TXT records.  It is an interface so domain
+// verification can be stubbed out locally.
+type TXTResolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+type netResolver struct{}
+
+func (netResolver) LookupTXT(name string) ([]string, error) {
+	return net.LookupTXT(name)
+}
+
+// SetTXTResolver changes how domain claims are verified.  By default DNS is
+// queried.  It must be called before CreateRoutes.
+func (am *AccountManager) SetTXTResolver(r TXTResolver) {
+	am.resolver = r
+}
+
+// orgDomain is a domain an organization claimed.  Claims take effect once
+// verified.
+type orgDomain struct {
+	ID     int64
+	OrgID  int64
+	Domain string
+	Token  string
+	Mode   string
+	// Verified is zero until the claim is verified.
+	Verified time.Time
+}
+
+// RecordName is the name of the TXT record proving the claim.
+func (d *orgDomain) RecordName() string {
+	return domainVerificationPrefix + "." + d.Domain
+}
+
+// RecordValue is what the TXT record proving the claim must hold.
+func (d *orgDomain) RecordValue() string {
+	return domainVerificationPrefix[1:] + "=" + d.Token
+}
+
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.TrimSpace(domain), ".")
+	domain, err := idna.Lookup.ToASCII(domain)
+	if err != nil || !strings.Contains(domain, ".") {
+		return "", errInvalidDomain
+	}
+	return strings.ToLower(domain), nil
+}
+
+// claimDomain records that the organization claims domain.  The claim is
+// unverified until the TXT record it returns is published.
+func claimDomain(db *sql.DB, orgID int64, domain, mode string) (*orgDomain, error) {
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	if mode != DomainAutoJoin && mode != DomainAutoRequest {
+		mode = DomainAutoRequest
+	}
+	token, err := randomSecret("")
+	if err != nil {
+		return nil, err
+	}
+	r, err := db.Exec("INSERT INTO OrgDomains (org_id, domain, token, mode) VALUES (?, ?, ?, ?)",
+		orgID, domain, token, mode)
+	if isExistingUserError(err) {
+		return nil, errDomainClaimed
+	} else if err != nil {
+		return nil, err
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &orgDomain{ID: id, OrgID: orgID, Domain: domain, Token: token, Mode: mode}, nil
+}
+
+func loadOrgDomains(db *sql.DB, query string, args ...interface{}) ([]*orgDomain, error) {
+	rows, err := db.Query("SELECT id, org_id, domain, token, mode, verified FROM OrgDomains "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ds []*orgDomain
+	for rows.Next() {
+		d := &orgDomain{}
+		var verified int64
+		if err := rows.Scan(&d.ID, &d.OrgID, &d.Domain, &d.Token, &d.Mode, &verified); err != nil {
+			return nil, err
+		}
+		if verified != 0 {
+			d.Verified = time.Unix(verified, 0)
+		}
+		ds = append(ds, d)
+	}
+	return ds, rows.Err()
+}
+
+// verifyDomain checks the TXT record of the organization's claim to a
+// domain.  A domain may only be verified for one organization.
+func verifyDomain(db *sql.DB, res TXTResolver, orgID, id int64) (*orgDomain, error) {
+	ds, err := loadOrgDomains(db, "WHERE id = ? AND org_id = ?", id, orgID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ds) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	d := ds[0]
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM OrgDomains WHERE domain = ? AND verified != 0 AND org_id != ?",
+		d.Domain, orgID).Scan(&n)
+	if err != nil {
+		return nil, err
+	}
+	if n != 0 {
+		return nil, errDomainClaimed
+	}
+	txts, err := res.LookupTXT(d.RecordName())
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, errDomainNotVerified
+		}
+		return nil, err
+	}
+	found := false
+	for _, txt := range txts {
+		if strings.TrimSpace(txt) == d.RecordValue() {
+			found = true
+		}
+	}
+	if !found {
+		return nil, errDomainNotVerified
+	}
+	d.Verified = time.Now()
+	_, err = db.Exec("UPDATE OrgDomains SET verified = ? WHERE id = ?", d.Verified.Unix(), d.ID)
+	return d, err
+}
+
+func removeDomain(db *sql.DB, orgID, id int64) error {
+	_, err := db.Exec("DELETE FROM OrgDomains WHERE id = ? AND org_id = ?", id, orgID)
+	return err
+}
+
+// joinRequest asks for a user to be let into an organization.
+type joinRequest struct {
+	OrgID   int64
+	User    *User
+	Status  string
+	Created time.Time
+}
+
+func loadJoinRequests(db *sql.DB, orgID int64, status string) ([]*joinRequest, error) {
+	rows, err := db.Query(
+		"SELECT user_id, status, created FROM OrgJoinRequests WHERE org_id = ? AND status = ? ORDER BY created",
+		orgID, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	var jrs []*joinRequest
+	for rows.Next() {
+		jr := &joinRequest{OrgID: orgID}
+		var id int64
+		if err := rows.Scan(&id, &jr.Status, &jr.Created); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+		jrs = append(jrs, jr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, jr := range jrs {
+		if jr.User, err = loadUserByID(db, ids[i]); err != nil {
+			return nil, err
+		}
+	}
+	return jrs, nil
+}
+
+// decideJoinRequest approves or denies a pending request.
+func decideJoinRequest(db *sql.DB, orgID, userID int64, approve bool) error {
+	status := joinDenied
+	if approve {
+		status = joinApproved
+	}
+	r, err := db.Exec("UPDATE OrgJoinRequests SET status = ? WHERE org_id = ? AND user_id = ? AND status = ?",
+		status, orgID, userID, joinPending)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if approve {
+		return addOrgMember(db, orgID, userID, OrgMember)
+	}
+	return nil
+}
+
+// joinClaimedOrganizations adds the user to, or asks to let them into, the
+// organizations which verified a domain of one of their verified addresses.
+// Each organization is only acted on once per user.
+func joinClaimedOrganizations(db *sql.DB, r *http.Request, userID int64) error {
+	es, err := loadUserEmails(db, userID)
+	if err != nil {
+		return err
+	}
+	for _, e := range es {
+		if !e.Verified {
+			continue
+		}
+		domain := e.Email[strings.LastIndex(e.Email, "@")+1:]
+		ds, err := loadOrgDomains(db, "WHERE domain = ? AND verified != 0", domain)
+		if err != nil {
+			return err
+		}
+		for _, d := range ds {
+			if err := joinClaimedOrganization(db, r, userID, d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func joinClaimedOrganization(db *sql.DB, r *http.Request, userID int64, d *orgDomain) error {
+	if _, err := loadMembership(db, d.OrgID, userID); err == nil {
+		return nil
+	} else if err != errNotOrgMember {
+		return err
+	}
+	status := joinPending
+	if d.Mode == DomainAutoJoin {
+		status = joinJoined
+	}
+	res, err := db.Exec("INSERT OR IGNORE INTO OrgJoinRequests (org_id, user_id, status) VALUES (?, ?, ?)",
+		d.OrgID, userID, status)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	meta := map[string]string{"org": strconv.FormatInt(d.OrgID, 10), "domain": d.Domain}
+	if status == joinPending {
+		audit(db, r, userID, userID, auditOrgJoinRequested, meta)
+		return nil
+	}
+	if err := addOrgMember(db, d.OrgID, userID, OrgMember); err != nil {
+		return err
+	}
+	meta["role"] = OrgMember
+	audit(db, r, userID, userID, auditOrgMemberAdded, meta)
+	return nil
+}
+
+// domainsHook brings users into the organizations claiming their domains
+// as they log in.  It never vetoes.
+func domainsHook(db *sql.DB) Hook {
+	return func(u *User, r *http.Request) error {
+		if err := joinClaimedOrganizations(db, r, u.ID); err != nil {
+			log.Printf("unable to join user %v to organizations by domain: %v", u.ID, err)
+		}
+		return nil
+	}
+}
+
+// domainAction claims, verifies or removes domains of the organization, or
+// decides on requests to join it.  Owners manage domains, admins decide on
+// requests.
+func (h organizationsHandler) domainAction(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	m := MembershipFromRequest(r)
+	org := strconv.FormatInt(m.Organization.ID, 10)
+	id, _ := strconv.ParseInt(r.PostForm.Get("id"), 10, 64)
+	action := mux.Vars(r)["action"]
+	if !m.AtLeast(OrgOwner) && action != "approve" && action != "deny" {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+
+	var msg string
+	switch action {
+	case "claim":
+		d, err := claimDomain(h.db, m.Organization.ID, r.PostForm.Get("domain"), r.PostForm.Get("mode"))
+		if err == errInvalidDomain || err == errDomainClaimed {
+			h.render(w, r, "", err.Error())
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(h.db, r, u.ID, u.ID, auditOrgDomainClaimed, map[string]string{"org": org, "domain": d.Domain})
+		msg = "Publish the TXT record below, then verify the domain"
+	case "verify":
+		d, err := verifyDomain(h.db, h.resolver, m.Organization.ID, id)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err == errDomainNotVerified || err == errDomainClaimed {
+			h.render(w, r, "", err.Error())
+			return
+		} else if err != nil {
+			h.render(w, r, "", "Unable to look up the verification record: "+err.Error())
+			return
+		}
+		audit(h.db, r, u.ID, u.ID, auditOrgDomainVerified, map[string]string{"org": org, "domain": d.Domain})
+		msg = d.Domain + " verified"
+	case "remove":
+		if err := removeDomain(h.db, m.Organization.ID, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		msg = "Domain removed"
+	case "approve", "deny":
+		approve := action == "approve"
+		if err := decideJoinRequest(h.db, m.Organization.ID, id, approve); err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if approve {
+			audit(h.db, r, u.ID, id, auditOrgMemberAdded, map[string]string{"org": org, "role": OrgMember})
+			msg = "Request approved"
+		} else {
+			msg = "Request denied"
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	h.render(w, r, msg, "")
+}
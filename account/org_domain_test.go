@@ -0,0 +1,146 @@
+package account
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+type stubResolver map[string][]string
+
+func (s stubResolver) LookupTXT(name string) ([]string, error) {
+	return s[name], nil
+}
+
+func TestVerifyDomain(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	owner := newUser("owner@email.com")
+	if err := owner.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	acme, err := createOrganization(db, "Acme", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := createOrganization(db, "Other", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := claimDomain(db, acme.ID, "localhost", DomainAutoJoin); err != errInvalidDomain {
+		t.Errorf("Expected errInvalidDomain, got %v", err)
+	}
+	d, err := claimDomain(db, acme.ID, "Acme.Example.", DomainAutoJoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Domain != "acme.example" || d.RecordName() != "_account-verify.acme.example" {
+		t.Errorf("Expected normalized domain, got %v %v", d.Domain, d.RecordName())
+	}
+	if _, err := claimDomain(db, acme.ID, "acme.example", DomainAutoJoin); err != errDomainClaimed {
+		t.Errorf("Expected errDomainClaimed, got %v", err)
+	}
+	od, err := claimDomain(db, other.ID, "acme.example", DomainAutoJoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := stubResolver{}
+	if _, err := verifyDomain(db, res, acme.ID, d.ID); err != errDomainNotVerified {
+		t.Errorf("Expected errDomainNotVerified, got %v", err)
+	}
+	if _, err := verifyDomain(db, res, other.ID, d.ID); err == nil {
+		t.Errorf("Expected claims of other organizations to be refused")
+	}
+	res[d.RecordName()] = []string{"v=spf1 -all", d.RecordValue()}
+	if v, err := verifyDomain(db, res, acme.ID, d.ID); err != nil || v.Verified.IsZero() {
+		t.Fatalf("Expected domain to be verified, got %v %v", v, err)
+	}
+	res[od.RecordName()] = []string{od.RecordValue()}
+	if _, err := verifyDomain(db, res, other.ID, od.ID); err != errDomainClaimed {
+		t.Errorf("Expected a domain to be verified for one organization only, got %v", err)
+	}
+}
+
+func TestJoinClaimedOrganizations(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	owner := newUser("owner@email.com")
+	joiner := newUser("joiner@join.example")
+	asker := newUser("asker@ask.example")
+	for _, u := range []*User{owner, joiner, asker} {
+		if err := u.insert(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o, err := createOrganization(db, "Acme", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := stubResolver{}
+	for domain, mode := range map[string]string{"join.example": DomainAutoJoin, "ask.example": DomainAutoRequest} {
+		d, err := claimDomain(db, o.ID, domain, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res[d.RecordName()] = []string{d.RecordValue()}
+		if _, err := verifyDomain(db, res, o.ID, d.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+
+	if err := joinClaimedOrganizations(db, r, joiner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadMembership(db, o.ID, joiner.ID); err != errNotOrgMember {
+		t.Errorf("Expected unverified address not to join, got %v", err)
+	}
+	for _, u := range []*User{joiner, asker} {
+		if err := setEmailVerified(db, u.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := joinClaimedOrganizations(db, r, u.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m, err := loadMembership(db, o.ID, joiner.ID); err != nil || m.Role != OrgMember {
+		t.Errorf("Expected joiner to be a member, got %v %v", m, err)
+	}
+	if _, err := loadMembership(db, o.ID, asker.ID); err != errNotOrgMember {
+		t.Errorf("Expected asker to wait for approval, got %v", err)
+	}
+	jrs, err := loadJoinRequests(db, o.ID, joinPending)
+	if err != nil || len(jrs) != 1 || jrs[0].User.ID != asker.ID {
+		t.Fatalf("Expected a pending request from asker, got %v %v", jrs, err)
+	}
+
+	// Members who left are not brought back.
+	if err := removeOrgMember(db, o.ID, joiner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := joinClaimedOrganizations(db, r, joiner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadMembership(db, o.ID, joiner.ID); err != errNotOrgMember {
+		t.Errorf("Expected removed member to stay out, got %v", err)
+	}
+
+	if err := decideJoinRequest(db, o.ID, asker.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadMembership(db, o.ID, asker.ID); err != nil {
+		t.Errorf("Expected approved asker to be a member, got %v", err)
+	}
+	if err := decideJoinRequest(db, o.ID, asker.ID, false); err == nil {
+		t.Errorf("Expected decided request not to be decided again")
+	}
+}
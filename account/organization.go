@@ -0,0 +1,734 @@
+package account
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+	"github.com/gorilla/sessions"
+)
+
+// Roles of organization members, from most to least powerful.  Owners
+// manage everything, admins manage members but not owners, members only
+// belong.
+const (
+	OrgOwner  = "owner"
+	OrgAdmin  = "admin"
+	OrgMember = "member"
+)
+
+const (
+	// orgInvitationTTL is how long invitations to join an organization stay
+	// valid.
+	orgInvitationTTL = 7 * 24 * time.Hour
+	maxOrgNameLen    = 64
+	// sessionOrganization holds the ID of the organization the user is
+	// working in.
+	sessionOrganization = "organization"
+)
+
+var orgRoleRanks = map[string]int{OrgMember: 1, OrgAdmin: 2, OrgOwner: 3}
+
+var (
+	errNotOrgMember         = errors.New("not a member of the organization")
+	errLastOwner            = errors.New("an organization must keep an owner")
+	errSoleOrgOwner         = errors.New("the account is the only owner of an organization, make someone else an owner first")
+	errInvalidOrgInvitation = errors.New("invalid or expired invitation")
+)
+
+// Organization is a group of users, such as a company, sharing what the
+// host application keeps for them.
+type Organization struct {
+	ID      int64
+	Name    string
+	Created time.Time
+}
+
+// Membership is a user's place in an organization.
+type Membership struct {
+	Organization *Organization
+	UserID       int64
+	Role         string
+}
+
+// AtLeast reports whether the member's role is role or a more powerful one.
+func (m *Membership) AtLeast(role string) bool {
+	return orgRoleRanks[m.Role] >= orgRoleRanks[role]
+}
+
+// createOrganization creates an organization owned by ownerID.
+func createOrganization(db *sql.DB, name string, ownerID int64) (*Organization, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	r, err := tx.Exec("INSERT INTO Organizations (name, created_by) VALUES (?, ?)", name, ownerID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec("INSERT INTO OrgMembers (org_id, user_id, role) VALUES (?, ?, ?)",
+		id, ownerID, OrgOwner); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return loadOrganization(db, id)
+}
+
+func loadOrganization(db *sql.DB, id int64) (*Organization, error) {
+	o := &Organization{}
+	err := db.QueryRow("SELECT id, name, created FROM Organizations WHERE id = ?", id).
+		Scan(&o.ID, &o.Name, &o.Created)
+	return o, err
+}
+
+// loadMembership returns the user's membership of the organization, or
+// errNotOrgMember.
+func loadMembership(db *sql.DB, orgID, userID int64) (*Membership, error) {
+	ms, err := loadMemberships(db, "WHERE m.org_id = ? AND m.user_id = ?", orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ms) == 0 {
+		return nil, errNotOrgMember
+	}
+	return ms[0], nil
+}
+
+// loadUserMemberships returns the organizations the user belongs to.
+func loadUserMemberships(db *sql.DB, userID int64) ([]*Membership, error) {
+	return loadMemberships(db, "WHERE m.user_id = ? ORDER BY o.name, o.id", userID)
+}
+
+// loadOrgMembers returns the members of the organization.
+func loadOrgMembers(db *sql.DB, orgID int64) ([]*Membership, error) {
+	return loadMemberships(db, "WHERE m.org_id = ? ORDER BY m.created", orgID)
+}
+
+func loadMemberships(db *sql.DB, query string, args ...interface{}) ([]*Membership, error) {
+	rows, err := db.Query(
+		"SELECT o.id, o.name, o.created, m.user_id, m.role FROM OrgMembers m JOIN Organizations o ON o.id = m.org_id "+query,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ms []*Membership
+	for rows.Next() {
+		m := &Membership{Organization: &Organization{}}
+		if err := rows.Scan(&m.Organization.ID, &m.Organization.Name, &m.Organization.Created,
+			&m.UserID, &m.Role); err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, rows.Err()
+}
+
+// addOrgMember makes the user a member of the organization with role,
+// changing their role if they already are one.
+func addOrgMember(db *sql.DB, orgID, userID int64, role string) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO OrgMembers (org_id, user_id, role) VALUES (?, ?, ?)",
+		orgID, userID, role)
+	return err
+}
+
+// countOrgOwners returns how many owners the organization has.
+func countOrgOwners(db *sql.DB, orgID int64) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM OrgMembers WHERE org_id = ? AND role = ?", orgID, OrgOwner).Scan(&n)
+	return n, err
+}
+
+// countSoleOwnedOrgs returns how many organizations the user is the only
+// owner of.
+func countSoleOwnedOrgs(db *sql.DB, userID int64) (int, error) {
+	var n int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM OrgMembers m WHERE user_id = ? AND role = ? AND NOT EXISTS "+
+			"(SELECT 1 FROM OrgMembers o WHERE o.org_id = m.org_id AND o.role = ? AND o.user_id != m.user_id)",
+		userID, OrgOwner, OrgOwner).Scan(&n)
+	return n, err
+}
+
+// soleOwnerHook vetoes deleting users who are the only owner of an
+// organization, which would be left without one.
+func soleOwnerHook(db *sql.DB) Hook {
+	return func(u *User, r *http.Request) error {
+		if n, err := countSoleOwnedOrgs(db, u.ID); err != nil {
+			return err
+		} else if n != 0 {
+			return errSoleOrgOwner
+		}
+		return nil
+	}
+}
+
+// setOrgRole changes a member's role.  errLastOwner is returned if that
+// would leave the organization without an owner.
+func setOrgRole(db *sql.DB, orgID, userID int64, role string) error {
+	m, err := loadMembership(db, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if m.Role == OrgOwner && role != OrgOwner {
+		if n, err := countOrgOwners(db, orgID); err != nil {
+			return err
+		} else if n <= 1 {
+			return errLastOwner
+		}
+	}
+	_, err = db.Exec("UPDATE OrgMembers SET role = ? WHERE org_id = ? AND user_id = ?", role, orgID, userID)
+	return err
+}
+
+// removeOrgMember takes the user out of the organization.  errLastOwner is
+// returned if they are its only owner.
+func removeOrgMember(db *sql.DB, orgID, userID int64) error {
+	m, err := loadMembership(db, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if m.Role == OrgOwner {
+		if n, err := countOrgOwners(db, orgID); err != nil {
+			return err
+		} else if n <= 1 {
+			return errLastOwner
+		}
+	}
+	_, err = db.Exec("DELETE FROM OrgMembers WHERE org_id = ? AND user_id = ?", orgID, userID)
+	return err
+}
+
+// createOrgInvitation records an invitation for email to join the
+// organization with role, and returns the secret accepting it.
+func createOrgInvitation(db *sql.DB, orgID, inviterID int64, email, role string) (string, error) {
+	secret, err := randomSecret("")
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(
+		"INSERT INTO OrgInvitations (org_id, inviter_id, email, role, token_hash, expiration) VALUES ($1, $2, $3, $4, $5, $6)",
+		orgID, inviterID, email, role, hashSecret(secret), time.Now().Add(orgInvitationTTL).Unix())
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// orgInvitation is a pending invitation to join an organization.
+type orgInvitation struct {
+	ID           int64
+	Organization *Organization
+	Email        string
+	Role         string
+}
+
+func loadOrgInvitation(db *sql.DB, secret string) (*orgInvitation, error) {
+	inv := &orgInvitation{}
+	var orgID, expiration int64
+	err := db.QueryRow("SELECT id, org_id, email, role, expiration FROM OrgInvitations WHERE token_hash = ?",
+		hashSecret(secret)).Scan(&inv.ID, &orgID, &inv.Email, &inv.Role, &expiration)
+	if err == sql.ErrNoRows || (err == nil && time.Now().After(time.Unix(expiration, 0))) {
+		return nil, errInvalidOrgInvitation
+	} else if err != nil {
+		return nil, err
+	}
+	if inv.Organization, err = loadOrganization(db, orgID); err == sql.ErrNoRows {
+		return nil, errInvalidOrgInvitation
+	}
+	return inv, err
+}
+
+// acceptOrgInvitation adds u to the organization of the invitation, which
+// must be addressed to one of their verified addresses.  Accepting never
+// lowers the role of an existing member.
+func acceptOrgInvitation(db *sql.DB, secret string, u *User) (*Membership, error) {
+	inv, err := loadOrgInvitation(db, secret)
+	if err != nil {
+		return nil, err
+	}
+	es, err := loadUserEmails(db, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	verified := false
+	for _, e := range es {
+		if e.Verified && strings.EqualFold(e.Email, inv.Email) {
+			verified = true
+		}
+	}
+	if !verified {
+		return nil, errEmailNotVerified
+	}
+	role := inv.Role
+	if m, err := loadMembership(db, inv.Organization.ID, u.ID); err == nil {
+		if m.AtLeast(role) {
+			role = m.Role
+		}
+	} else if err != errNotOrgMember {
+		return nil, err
+	}
+	if err := addOrgMember(db, inv.Organization.ID, u.ID, role); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("DELETE FROM OrgInvitations WHERE id = ?", inv.ID); err != nil {
+		return nil, err
+	}
+	return &Membership{Organization: inv.Organization, UserID: u.ID, Role: role}, nil
+}
+
+// withMembership returns a copy of r carrying the membership of the user in
+// the organization the request is for.
+func withMembership(r *http.Request, m *Membership) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), orgContextKey, m))
+}
+
+// MembershipFromRequest returns the membership RequireOrganizationMiddleware
+// resolved for the request, or nil.
+func MembershipFromRequest(r *http.Request) *Membership {
+	m, _ := r.Context().Value(orgContextKey).(*Membership)
+	return m
+}
+
+// currentMembership returns the user's membership of the organization the
+// request is for: the one named by the org route variable if there is one,
+// else the one they switched to.  Without either, users belonging to a
+// single organization are in that one.
+func (am AccountManager) currentMembership(r *http.Request, u *User) (*Membership, error) {
+	if v, ok := mux.Vars(r)["org"]; ok {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, errNotOrgMember
+		}
+		return loadMembership(am.db, id, u.ID)
+	}
+	if s, err := am.store.Get(r, Session); err == nil {
+		if id, ok := s.Values[sessionOrganization].(int64); ok {
+			return loadMembership(am.db, id, u.ID)
+		}
+	}
+	ms, err := loadUserMemberships(am.db, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ms) != 1 {
+		return nil, errNotOrgMember
+	}
+	return ms[0], nil
+}
+
+// RequireOrganizationMiddleware resolves the organization the request is
+// for and only lets through its members holding role or a more powerful
+// one.  Handlers get the membership with MembershipFromRequest.  Users who
+// have not picked an organization are sent to choose one.  It must follow
+// RequireUserMiddleware, e.g.
+//
+//	alice.New(am.RequireUserMiddleware(), am.RequireOrganizationMiddleware(account.OrgMember))
+func (am AccountManager) RequireOrganizationMiddleware(role string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, err := am.CurrentUser(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if u == nil {
+				http.Error(w, "user not logged in", http.StatusUnauthorized)
+				return
+			}
+			m, err := am.currentMembership(r, u)
+			if err == errNotOrgMember {
+				if _, ok := mux.Vars(r)["org"]; ok || bearerToken(r) != "" {
+					http.Error(w, err.Error(), http.StatusForbidden)
+					return
+				}
+				if err := am.storeNext(w, r); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				http.Redirect(w, r, am.baseURL.String()+"/organizations", http.StatusFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !m.AtLeast(role) {
+				http.Error(w, "permission denied", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, withMembership(r, m))
+		})
+	}
+}
+
+// orgMember is a member as listed on the organization page.
+type orgMember struct {
+	User *User
+	Role string
+}
+
+type organizationsContext struct {
+	Base        string
+	Memberships []*Membership
+	// Current is the ID of the organization the user switched to.
+	Current int64
+	Error   string
+	Token   string
+}
+
+func (c *organizationsContext) setToken(t string) {
+	c.Token = t
+}
+
+type organizationContext struct {
+	Base    string
+	Member  *Membership
+	Members []*orgMember
+	Roles   []string
+	Message string
+	Error   string
+	Token   string
+	// Domains are shown to owners, the pending requests to join to admins.
+	Domains  []*orgDomain
+	Requests []*joinRequest
+}
+
+func (c *organizationContext) setToken(t string) {
+	c.Token = t
+}
+
+type orgInvitationContext struct {
+	Invitation *orgInvitation
+	Secret     string
+	Error      string
+	Token      string
+}
+
+func (c *orgInvitationContext) setToken(t string) {
+	c.Token = t
+}
+
+type organizationsHandler struct {
+	db     *sql.DB
+	s      sessions.Store
+	mailer Mailer
+	// resolver verifies domain claims.
+	resolver TXTResolver
+	// base is the absolute url of the account routes.
+	base string
+}
+
+func newOrganizationsHandler(db *sql.DB, s sessions.Store, m Mailer, res TXTResolver,
+	base string) *organizationsHandler {
+	return &organizationsHandler{db, s, m, res, base}
+}
+
+func (h organizationsHandler) renderList(w http.ResponseWriter, r *http.Request, u *User, errMsg string) {
+	ms, err := loadUserMemberships(h.db, u.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c := &organizationsContext{Base: h.base, Memberships: ms, Error: errMsg}
+	if s, err := h.s.Get(r, Session); err == nil {
+		c.Current, _ = s.Values[sessionOrganization].(int64)
+	}
+	templateHandler("organizations.html", c, w, r)
+}
+
+// list shows the organizations of the user, to switch between them or
+// create one.
+func (h organizationsHandler) list(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	h.renderList(w, r, u, "")
+}
+
+// validOrgName reports whether name fits in the places it is shown, such as
+// the subject of invitation mails.
+func validOrgName(name string) bool {
+	return name != "" && len(name) <= maxOrgNameLen && strings.IndexFunc(name, unicode.IsControl) < 0
+}
+
+func (h organizationsHandler) create(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	name := strings.TrimSpace(r.PostForm.Get("name"))
+	if !validOrgName(name) {
+		h.renderList(w, r, u, "Organization names are 1 to 64 characters long, on one line")
+		return
+	}
+	o, err := createOrganization(h.db, name, u.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.db, r, u.ID, u.ID, auditOrgCreated, map[string]string{"org": strconv.FormatInt(o.ID, 10)})
+	h.switchTo(w, r, o.ID)
+}
+
+// switchOrg makes the organization given by the id field the one the user
+// works in, then sends them on where they were headed.
+func (h organizationsHandler) switchOrg(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	id, _ := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if _, err := loadMembership(h.db, id, u.ID); err == errNotOrgMember {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.switchTo(w, r, id)
+}
+
+func (h organizationsHandler) switchTo(w http.ResponseWriter, r *http.Request, orgID int64) {
+	s, err := h.s.Get(r, Session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.Values[sessionOrganization] = orgID
+	if err := s.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	redirectAfterLogin(h.s, w, r)
+}
+
+func (h organizationsHandler) render(w http.ResponseWriter, r *http.Request, msg, errMsg string) {
+	m := MembershipFromRequest(r)
+	ms, err := loadOrgMembers(h.db, m.Organization.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c := &organizationContext{
+		Base:    h.base,
+		Member:  m,
+		Roles:   []string{OrgMember, OrgAdmin, OrgOwner},
+		Message: msg,
+		Error:   errMsg}
+	for _, om := range ms {
+		u, err := loadUserByID(h.db, om.UserID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c.Members = append(c.Members, &orgMember{User: u, Role: om.Role})
+	}
+	if m.AtLeast(OrgOwner) {
+		if c.Domains, err = loadOrgDomains(h.db, "WHERE org_id = ? ORDER BY domain", m.Organization.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if m.AtLeast(OrgAdmin) {
+		if c.Requests, err = loadJoinRequests(h.db, m.Organization.ID, joinPending); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	templateHandler("organization.html", c, w, r)
+}
+
+// show lists the members of the organization.
+func (h organizationsHandler) show(w http.ResponseWriter, r *http.Request) {
+	h.render(w, r, "", "")
+}
+
+type orgActionForm struct {
+	UserID int64
+	Email  string
+	Role   string
+	Token  string `schema:"csrf_token"`
+}
+
+// action invites, changes the role of, or removes members.  Admins manage
+// members and admins, only owners manage owners.  Any member may remove
+// themselves.
+func (h organizationsHandler) action(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	m := MembershipFromRequest(r)
+	f := &orgActionForm{}
+	d := schema.NewDecoder()
+	d.IgnoreUnknownKeys(true)
+	if err := d.Decode(f, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Role != "" && orgRoleRanks[f.Role] == 0 {
+		http.Error(w, "unknown role", http.StatusBadRequest)
+		return
+	}
+	// manages reports whether the acting member may act on a member with
+	// role, or grant it.
+	manages := func(role string) bool {
+		return m.AtLeast(OrgAdmin) && m.AtLeast(role)
+	}
+	org := strconv.FormatInt(m.Organization.ID, 10)
+
+	var msg string
+	switch mux.Vars(r)["action"] {
+	case "invite":
+		if f.Role == "" {
+			f.Role = OrgMember
+		}
+		if !manages(f.Role) {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		email, err := normalizeEmail(f.Email)
+		if err != nil {
+			h.render(w, r, "", "Invalid email address")
+			return
+		}
+		secret, err := createOrgInvitation(h.db, m.Organization.ID, u.ID, email, f.Role)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = h.mailer.SendMail(email, "Join "+m.Organization.Name,
+			u.Name()+" invited you to join "+m.Organization.Name+".  Follow this link within a week to accept:\n\n"+
+				h.base+"/join_organization?token="+url.QueryEscape(secret)+"\n")
+		if err != nil {
+			log.Printf("unable to mail organization invitation to %v: %v", email, err)
+		}
+		audit(h.db, r, u.ID, u.ID, auditOrgInvitation, map[string]string{"org": org, "email": email, "role": f.Role})
+		msg = "Invitation sent to " + email
+	case "role":
+		target, err := loadMembership(h.db, m.Organization.ID, f.UserID)
+		if err == errNotOrgMember {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !manages(target.Role) || !manages(f.Role) {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		if err := setOrgRole(h.db, m.Organization.ID, f.UserID, f.Role); err == errLastOwner {
+			h.render(w, r, "", "The organization must keep an owner")
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(h.db, r, u.ID, f.UserID, auditOrgRoleChange,
+			map[string]string{"org": org, "old": target.Role, "new": f.Role})
+		msg = "Role changed"
+	case "remove":
+		target, err := loadMembership(h.db, m.Organization.ID, f.UserID)
+		if err == errNotOrgMember {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if f.UserID != u.ID && !manages(target.Role) {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		if err := removeOrgMember(h.db, m.Organization.ID, f.UserID); err == errLastOwner {
+			h.render(w, r, "", "The organization must keep an owner")
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(h.db, r, u.ID, f.UserID, auditOrgMemberRemoved, map[string]string{"org": org})
+		if f.UserID == u.ID {
+			http.Redirect(w, r, h.base+"/organizations", http.StatusFound)
+			return
+		}
+		msg = "Member removed"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	h.render(w, r, msg, "")
+}
+
+// joinGet shows the invitation in the link followed by the user, for them
+// to accept.
+func (h organizationsHandler) joinGet(w http.ResponseWriter, r *http.Request) {
+	secret := r.URL.Query().Get("token")
+	c := &orgInvitationContext{Secret: secret}
+	inv, err := loadOrgInvitation(h.db, secret)
+	if err == errInvalidOrgInvitation {
+		c.Error = err.Error()
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Invitation = inv
+	templateHandler("join_organization.html", c, w, r)
+}
+
+func (h organizationsHandler) joinPost(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	secret := r.PostFormValue("token")
+	m, err := acceptOrgInvitation(h.db, secret, u)
+	if err == errInvalidOrgInvitation || err == errEmailNotVerified {
+		c := &orgInvitationContext{Secret: secret, Error: err.Error()}
+		if err == errEmailNotVerified {
+			c.Error = "The invitation is for an address you have not verified"
+			c.Invitation, _ = loadOrgInvitation(h.db, secret)
+		}
+		templateHandler("join_organization.html", c, w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.db, r, u.ID, u.ID, auditOrgMemberAdded,
+		map[string]string{"org": strconv.FormatInt(m.Organization.ID, 10), "role": m.Role})
+	h.switchTo(w, r, m.Organization.ID)
+}
@@ -0,0 +1,162 @@
+package account
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+func TestOrganizationMembers(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	owner := newUser("owner@email.com")
+	member := newUser("member@email.com")
+	for _, u := range []*User{owner, member} {
+		if err := u.insert(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o, err := createOrganization(db, "Acme", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadMembership(db, o.ID, owner.ID)
+	if err != nil || m.Role != OrgOwner {
+		t.Fatalf("Expected creator to own the organization, got %v %v", m, err)
+	}
+	if _, err := loadMembership(db, o.ID, member.ID); err != errNotOrgMember {
+		t.Errorf("Expected errNotOrgMember, got %v", err)
+	}
+
+	if err := setOrgRole(db, o.ID, owner.ID, OrgAdmin); err != errLastOwner {
+		t.Errorf("Expected the last owner to keep their role, got %v", err)
+	}
+	if err := removeOrgMember(db, o.ID, owner.ID); err != errLastOwner {
+		t.Errorf("Expected the last owner to stay, got %v", err)
+	}
+
+	if err := addOrgMember(db, o.ID, member.ID, OrgMember); err != nil {
+		t.Fatal(err)
+	}
+	if err := setOrgRole(db, o.ID, member.ID, OrgOwner); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeOrgMember(db, o.ID, owner.ID); err != nil {
+		t.Errorf("Expected an owner to leave when another remains, got %v", err)
+	}
+	ms, err := loadUserMemberships(db, member.ID)
+	if err != nil || len(ms) != 1 || ms[0].Organization.Name != "Acme" || !ms[0].AtLeast(OrgAdmin) {
+		t.Errorf("Expected member to own Acme, got %v %v", ms, err)
+	}
+}
+
+func TestAcceptOrgInvitation(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	owner := newUser("owner@email.com")
+	if err := owner.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	invitee := newUser("invitee@email.com")
+	if err := invitee.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	o, err := createOrganization(db, "Acme", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := createOrgInvitation(db, o.ID, owner.ID, "invitee@email.com", OrgAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acceptOrgInvitation(db, secret, owner); err != errEmailNotVerified {
+		t.Errorf("Expected invitation for another address to be refused, got %v", err)
+	}
+	if _, err := acceptOrgInvitation(db, secret, invitee); err != errEmailNotVerified {
+		t.Errorf("Expected unverified address to be refused, got %v", err)
+	}
+	if err := setEmailVerified(db, invitee.ID); err != nil {
+		t.Fatal(err)
+	}
+	m, err := acceptOrgInvitation(db, secret, invitee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Role != OrgAdmin || m.Organization.ID != o.ID {
+		t.Errorf("Expected to join Acme as admin, got %v", m)
+	}
+	if _, err := acceptOrgInvitation(db, secret, invitee); err != errInvalidOrgInvitation {
+		t.Errorf("Expected invitation to be used up, got %v", err)
+	}
+}
+
+func TestRequireOrganizationMiddleware(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	am := NewAccountManager(sessions.NewCookieStore([]byte("secret")), db,
+		"http://localhost", NewFacebookClient("", ""))
+	owner := newUser("owner@email.com")
+	outsider := newUser("outsider@email.com")
+	for _, u := range []*User{owner, outsider} {
+		if err := u.insert(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o, err := createOrganization(db, "Acme", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *Membership
+	mx := mux.NewRouter()
+	mx.Handle("/orgs/{org}/admin", am.RequireOrganizationMiddleware(OrgAdmin)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = MembershipFromRequest(r)
+		})))
+	serve := func(u *User) int {
+		r := httptest.NewRequest("GET", "/orgs/"+strconv.FormatInt(o.ID, 10)+"/admin", nil)
+		r = withUser(r, u)
+		w := httptest.NewRecorder()
+		mx.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := serve(outsider); code != http.StatusForbidden {
+		t.Errorf("Expected outsider to be refused, got %v", code)
+	}
+	if code := serve(owner); code != http.StatusOK || got == nil || got.Organization.ID != o.ID {
+		t.Errorf("Expected owner to be let through, got %v %v", code, got)
+	}
+}
+
+func TestValidOrgName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"Acme":                  true,
+		"Café":                  true,
+		"":                      false,
+		strings.Repeat("a", 65): false,
+		"Acme\r\nBcc: x@y.com":  false,
+		"Acme\tInc":             false,
+	} {
+		if validOrgName(name) != valid {
+			t.Errorf("Expected validOrgName(%q) to be %v", name, valid)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package account
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/schema"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	maxDisplayNameLen = 64
+	maxBioLen         = 500
+	maxAvatarURLLen   = 2048
+)
+
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// Profile is what users tell about themselves, for host templates to show.
+// Every field is optional.
+type Profile struct {
+	DisplayName string
+	AvatarURL   string
+	// Locale is a BCP 47 language tag such as en-US.
+	Locale string
+	// Timezone is an IANA zone name such as Europe/Paris.
+	Timezone string
+	Bio      string
+}
+
+const profileColumns = "display_name, avatar_url, locale, timezone, bio"
+
+// Name returns what to call the user: their display name, else their
+// username, else their email address.
+func (u *User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	if u.Username != "" {
+		return u.Username
+	}
+	return u.Email
+}
+
+// Location returns the user's time zone, or UTC if they did not set one.
+func (u *User) Location() *time.Location {
+	if u.Timezone != "" {
+		if l, err := time.LoadLocation(u.Timezone); err == nil {
+			return l
+		}
+	}
+	return time.UTC
+}
+
+// validate cleans up the profile and returns messages for the fields that
+// are not acceptable, by field name.
+func (p *Profile) validate() map[string]string {
+	errs := make(map[string]string)
+	p.DisplayName = strings.TrimSpace(p.DisplayName)
+	p.AvatarURL = strings.TrimSpace(p.AvatarURL)
+	p.Locale = strings.TrimSpace(p.Locale)
+	p.Timezone = strings.TrimSpace(p.Timezone)
+	p.Bio = strings.TrimSpace(p.Bio)
+
+	if utf8.RuneCountInString(p.DisplayName) > maxDisplayNameLen {
+		errs["DisplayName"] = "Display name is too long"
+	} else if strings.IndexFunc(p.DisplayName, unicode.IsControl) >= 0 {
+		errs["DisplayName"] = "Display name contains invalid characters"
+	}
+	if p.AvatarURL != "" {
+		u, err := url.Parse(p.AvatarURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" ||
+			len(p.AvatarURL) > maxAvatarURLLen {
+			errs["AvatarURL"] = "Avatar must be an http or https url"
+		}
+	}
+	if p.Locale != "" && !localePattern.MatchString(p.Locale) {
+		errs["Locale"] = "Invalid locale, use a language tag such as en-US"
+	}
+	if p.Timezone != "" {
+		if _, err := time.LoadLocation(p.Timezone); err != nil || p.Timezone == "Local" {
+			errs["Timezone"] = "Unknown time zone"
+		}
+	}
+	if utf8.RuneCountInString(p.Bio) > maxBioLen {
+		errs["Bio"] = "Bio is too long"
+	}
+	return errs
+}
+
+func saveProfile(db *sql.DB, userID int64, p *Profile) error {
+	_, err := db.Exec(
+		"UPDATE Users SET display_name = ?, avatar_url = ?, locale = ?, timezone = ?, bio = ? WHERE id = ?",
+		p.DisplayName, p.AvatarURL, p.Locale, p.Timezone, p.Bio, userID)
+	return err
+}
+
+// prefillProfile fills in the fields of u's profile that they left blank
+// with what a provider knows about them.  Values that don't validate are
+// ignored.
+func prefillProfile(db *sql.DB, u *User, p *Profile) error {
+	errs := p.validate()
+	np := u.Profile
+	fill := func(field string, dst *string, v string) {
+		if *dst == "" && errs[field] == "" {
+			*dst = v
+		}
+	}
+	fill("DisplayName", &np.DisplayName, p.DisplayName)
+	fill("AvatarURL", &np.AvatarURL, p.AvatarURL)
+	fill("Locale", &np.Locale, p.Locale)
+	fill("Timezone", &np.Timezone, p.Timezone)
+	fill("Bio", &np.Bio, p.Bio)
+	if np == u.Profile {
+		return nil
+	}
+	if err := saveProfile(db, u.ID, &np); err != nil {
+		return err
+	}
+	u.Profile = np
+	return nil
+}
+
+type profileForm struct {
+	Profile
+	Token string `schema:"csrf_token"`
+}
+
+type profileContext struct {
+	Form *profileForm
+	// Avatar is the image to show as the user's current avatar.
+	Avatar  string
+	Errors  map[string]string
+	Message string
+}
+
+func (c *profileContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+type profileHandler struct {
+	db *sql.DB
+	s  sessions.Store
+}
+
+func newProfileHandler(db *sql.DB, s sessions.Store) *profileHandler {
+	return &profileHandler{db, s}
+}
+
+func (h profileHandler) get(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	templateHandler("profile.html", &profileContext{
+		Form:   &profileForm{Profile: u.Profile},
+		Avatar: avatarSrc(u.ID, &u.Profile)}, w, r)
+}
+
+func (h profileHandler) post(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	c := &profileContext{Form: &profileForm{}}
+	if err := schema.NewDecoder().Decode(c.Form, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Avatar = avatarSrc(u.ID, &u.Profile)
+	if c.Errors = c.Form.validate(); len(c.Errors) != 0 {
+		templateHandler("profile.html", c, w, r)
+		return
+	}
+	if err := saveProfile(h.db, u.ID, &c.Form.Profile); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Avatar = avatarSrc(u.ID, &c.Form.Profile)
+	c.Message = "Profile saved"
+	templateHandler("profile.html", c, w, r)
+}
@@ -0,0 +1,65 @@
+package account
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProfileValidate(t *testing.T) {
+	p := &Profile{
+		DisplayName: " Bob ",
+		AvatarURL:   "https://example.com/bob.png",
+		Locale:      "en-US",
+		Timezone:    "Europe/Paris"}
+	if errs := p.validate(); len(errs) != 0 {
+		t.Errorf("Expected profile to validate, got %v", errs)
+	}
+	if p.DisplayName != "Bob" {
+		t.Errorf("Expected display name to be trimmed, got %q", p.DisplayName)
+	}
+
+	p = &Profile{
+		DisplayName: strings.Repeat("x", maxDisplayNameLen+1),
+		AvatarURL:   "javascript:alert(1)",
+		Locale:      "english",
+		Timezone:    "Mars/Olympus",
+		Bio:         strings.Repeat("x", maxBioLen+1)}
+	errs := p.validate()
+	for _, f := range []string{"DisplayName", "AvatarURL", "Locale", "Timezone", "Bio"} {
+		if errs[f] == "" {
+			t.Errorf("Expected %v to be rejected", f)
+		}
+	}
+}
+
+func TestPrefillProfile(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("bob@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveProfile(db, u.ID, &Profile{Locale: "fr-FR"}); err != nil {
+		t.Fatal(err)
+	}
+	if u, err = loadUserByID(db, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := prefillProfile(db, u, &Profile{DisplayName: "Bob Smith", Locale: "en-US"}); err != nil {
+		t.Fatal(err)
+	}
+	u2, err := loadUserByID(db, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.DisplayName != "Bob Smith" || u2.Locale != "fr-FR" {
+		t.Errorf("Expected only blank fields to be filled, got %+v", u2.Profile)
+	}
+	if u2.Name() != "Bob Smith" {
+		t.Errorf("Expected display name to be used, got %v", u2.Name())
+	}
+}
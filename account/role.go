@@ -0,0 +1,215 @@
+package account
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// Permissions is the set of permissions a user holds through their roles.
+// Templates can check them with {{ if .Perms.Has "perm" }}.
+type Permissions map[string]bool
+
+func (p Permissions) Has(perm string) bool {
+	return p[perm]
+}
+
+func roleID(tx *sql.Tx, name string) (int64, error) {
+	var id int64
+	err := tx.QueryRow("SELECT id FROM Roles WHERE name = ?", name).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+	r, err := tx.Exec("INSERT INTO Roles (name) VALUES ($1)", name)
+	if err != nil {
+		return 0, err
+	}
+	return r.LastInsertId()
+}
+
+func permissionID(tx *sql.Tx, name string) (int64, error) {
+	var id int64
+	err := tx.QueryRow("SELECT id FROM Permissions WHERE name = ?", name).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+	r, err := tx.Exec("INSERT INTO Permissions (name) VALUES ($1)", name)
+	if err != nil {
+		return 0, err
+	}
+	return r.LastInsertId()
+}
+
+// CreateRole creates the named role, if it does not exist yet, and grants it
+// perms in addition to any permissions it already has.
+func (am AccountManager) CreateRole(name string, perms ...string) error {
+	tx, err := am.db.Begin()
+	if err != nil {
+		return err
+	}
+	rid, err := roleID(tx, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, p := range perms {
+		pid, err := permissionID(tx, p)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT OR IGNORE INTO RolePermissions (role_id, permission_id) VALUES ($1, $2)",
+			rid, pid)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AssignRole gives the user the named role, creating the role if needed.
+func (am AccountManager) AssignRole(userID int64, role string) error {
+	tx, err := am.db.Begin()
+	if err != nil {
+		return err
+	}
+	rid, err := roleID(tx, role)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT OR IGNORE INTO UserRoles (user_id, role_id) VALUES ($1, $2)", userID, rid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (am AccountManager) RevokeRole(userID int64, role string) error {
+	_, err := am.db.Exec(
+		"DELETE FROM UserRoles WHERE user_id = ? AND role_id IN (SELECT id FROM Roles WHERE name = ?)",
+		userID, role)
+	return err
+}
+
+func (am AccountManager) UserRoles(userID int64) ([]string, error) {
+	return loadUserRoles(am.db, userID)
+}
+
+func loadUserRoles(db *sql.DB, userID int64) ([]string, error) {
+	rows, err := db.Query(
+		"SELECT r.name FROM Roles r JOIN UserRoles ur ON ur.role_id = r.id WHERE ur.user_id = ? ORDER BY r.name",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roles []string
+	for rows.Next() {
+		var r string
+		if err := rows.Scan(&r); err != nil {
+			return nil, err
+		}
+		roles = append(roles, r)
+	}
+	return roles, rows.Err()
+}
+
+func (am AccountManager) UserPermissions(u *User) (Permissions, error) {
+	return loadUserPermissions(am.db, u.ID)
+}
+
+func loadUserPermissions(db *sql.DB, userID int64) (Permissions, error) {
+	rows, err := db.Query(
+		`SELECT DISTINCT p.name FROM Permissions p
+		JOIN RolePermissions rp ON rp.permission_id = p.id
+		JOIN UserRoles ur ON ur.role_id = rp.role_id
+		WHERE ur.user_id = ?`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	perms := Permissions{}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		perms[p] = true
+	}
+	return perms, rows.Err()
+}
+
+// Can reports whether the user making the request holds perm.  Anonymous
+// users hold no permissions.
+func (am AccountManager) Can(r *http.Request, perm string) (bool, error) {
+	u, err := am.CurrentUser(r)
+	if err != nil || u == nil {
+		return false, err
+	}
+	perms, err := loadUserPermissions(am.db, u.ID)
+	if err != nil {
+		return false, err
+	}
+	return perms.Has(perm), nil
+}
+
+// RequirePermissionMiddleware only lets through users holding perm.  It
+// must follow RequireUserMiddleware in the chain, e.g.
+//
+//	alice.New(am.RequireUserMiddleware(), am.RequirePermissionMiddleware("admin"))
+func (am AccountManager) RequirePermissionMiddleware(perm string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, err := am.Can(r, perm)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "permission denied", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRoleMiddleware only lets through users with the named role.  Like
+// RequirePermissionMiddleware it must follow RequireUserMiddleware.
+func (am AccountManager) RequireRoleMiddleware(role string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, err := am.CurrentUser(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			var roles []string
+			if u != nil {
+				if roles, err = loadUserRoles(am.db, u.ID); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			if !containsString(roles, role) {
+				http.Error(w, "permission denied", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package account
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRolePermissions(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("some@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal("Failed to insert user")
+	}
+	am := NewAccountManager(nil, db, "http://localhost", NewFacebookClient("", ""))
+	if err := am.CreateRole("editor", "posts.edit", "posts.publish"); err != nil {
+		t.Fatal(err)
+	}
+	if err := am.AssignRole(u.ID, "editor"); err != nil {
+		t.Fatal(err)
+	}
+	// Assigning twice is harmless.
+	if err := am.AssignRole(u.ID, "editor"); err != nil {
+		t.Fatal(err)
+	}
+
+	perms, err := am.UserPermissions(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !perms.Has("posts.edit") || perms.Has("users.delete") {
+		t.Errorf("Unexpected permissions %v", perms)
+	}
+
+	h := am.RequirePermissionMiddleware("posts.publish")(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	r := withUser(httptest.NewRequest("GET", "/", nil), u)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected editor to be let through, got %v", w.Code)
+	}
+
+	if err := am.RevokeRole(u.ID, "editor"); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected revoked user to be refused, got %v", w.Code)
+	}
+}
@@ -2,11 +2,12 @@ package account
 
 import (
 	"database/sql"
+	"html/template"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
-	"text/template"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
@@ -30,6 +31,20 @@ type AccountManager struct {
 	serverAddr string
 	baseURL    *url.URL
 	fb         *oAuthFacebook
+	keys       *keySet
+	hooks      hooks
+	webhooks   *webhookQueue
+	exporters  exporters
+	mailer     Mailer
+	blobs      BlobStore
+	settings   settings
+	// deletionGrace is how long accounts are kept after their users ask for
+	// them to be deleted.
+	deletionGrace time.Duration
+	// signupPolicy decides who may sign up.
+	signupPolicy SignupPolicy
+	// resolver looks up the records verifying organization domains.
+	resolver TXTResolver
 }
 
 type OAuthClientConfig struct {
@@ -48,20 +63,36 @@ func NewFacebookClient(id string, secret string) *OAuthClientConfig {
 
 func NewAccountManager(
 	s sessions.Store, db *sql.DB, dn string, fb *OAuthClientConfig) *AccountManager {
+	wq := newWebhookQueue(db)
+	hs := hooks{
+		deleteHook:      {soleOwnerHook(db)},
+		afterSignupHook: {wq.hook(WebhookUserSignup)},
+		afterDeleteHook: {wq.hook(WebhookUserDeleted)}}
 	return &AccountManager{
 		db:         db,
 		store:      s,
 		serverAddr: dn,
 		baseURL:    nil,
-		fb:         newOAuthFacebook(db, s, fb.Config)}
+		fb:         newOAuthFacebook(db, s, fb.Config, hs),
+		keys:       &keySet{},
+		hooks:      hs,
+		webhooks:   wq,
+		exporters:  exporters{},
+		mailer:     logMailer{},
+		blobs:      &DirBlobStore{Dir: "blobs"},
+		settings:   settings{},
+
+		deletionGrace: DefaultDeletionGracePeriod,
+		resolver:      netResolver{}}
 }
 
-func (u AccountManager) RequireNoUserMiddleware() func(http.Handler) http.Handler {
+func (am AccountManager) RequireNoUserMiddleware() func(http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			u, err := UserFromRequest(u.store, r)
+			u, err := am.CurrentUser(r)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 			if u != nil {
 				http.Redirect(w, r, "/", http.StatusFound)
@@ -75,11 +106,22 @@ func (u AccountManager) RequireNoUserMiddleware() func(http.Handler) http.Handle
 func (am AccountManager) RequireUserMiddleware() func(http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			u, err := UserFromRequest(am.store, r)
-			if err != nil {
+			u, r, err := am.authenticate(r)
+			if err == errAccountSuspended && bearerToken(r) == "" {
+				renderSuspended(w, r, u.Suspension())
+				return
+			} else if isInvalidTokenError(err) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			} else if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			if u == nil && bearerToken(r) != "" {
+				http.Error(w, "token does not act for a user", http.StatusUnauthorized)
+				return
+			}
 			if u == nil {
 				if err := am.storeNext(w, r); err != nil {
 					http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -88,17 +130,165 @@ func (am AccountManager) RequireUserMiddleware() func(http.Handler) http.Handler
 				http.Redirect(w, r, am.baseURL.String()+"/login", http.StatusFound)
 				return
 			}
+			if OAuthClientID(r) != "" {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+				http.Error(w, errOAuthClientToken.Error(), http.StatusForbidden)
+				return
+			}
+			if scope := methodScope(r); !HasScope(r, scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+				http.Error(w, "insufficient scope", http.StatusForbidden)
+				return
+			}
 			h.ServeHTTP(w, r)
 		})
 	}
 }
 
+// methodScope is the scope a token needs for the request on routes guarded
+// by RequireUserMiddleware: read to look, write to change anything.
+func methodScope(r *http.Request) string {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return "read"
+	}
+	return "write"
+}
+
+// RequireScopeMiddleware lets through requests whose bearer token was
+// granted scope.  Requests without a token must carry a session cookie.  It
+// is the only middleware admitting the tokens of third party OAuth clients,
+// including those with no user behind them that clients an admin approved
+// get through the client_credentials grant.
+func (am AccountManager) RequireScopeMiddleware(scope string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, r, err := am.authenticate(r)
+			if isInvalidTokenError(err) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if u == nil && OAuthClientID(r) == "" {
+				http.Error(w, "user not logged in", http.StatusUnauthorized)
+				return
+			}
+			if !HasScope(r, scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+				http.Error(w, "insufficient scope", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isInvalidTokenError(err error) bool {
+	return err == errInvalidAPIToken || err == errInvalidAccessToken ||
+		err == errInvalidOAuthToken || err == errAccountSuspended
+}
+
+// authenticate resolves the user making the request, preferring an api,
+// access or OAuth token in the Authorization header over the session cookie.
+// The user is attached to the returned request so UserFromRequest sees them
+// downstream without authenticating again.  Suspended users are returned
+// along with errAccountSuspended, but not attached.
+func (am AccountManager) authenticate(r *http.Request) (*User, *http.Request, error) {
+	if u, ok := r.Context().Value(userContextKey).(*User); ok {
+		return u, r, nil
+	}
+
+	bt := bearerToken(r)
+	if bt == "" {
+		return am.sessionUser(r)
+	}
+
+	var u *User
+	var err error
+	if strings.HasPrefix(bt, apiTokenPrefix) {
+		var t *apiToken
+		if u, t, err = loadUserByAPIToken(am.db, bt); err == nil {
+			r = withScopes(r, t.Scopes)
+		}
+	} else if strings.HasPrefix(bt, oauthAccessTokenPrefix) {
+		var t *oauthToken
+		if u, t, err = loadUserByOAuthToken(am.db, bt); err == nil {
+			r = withOAuthClient(r, t)
+		}
+	} else {
+		u, err = am.userFromAccessToken(bt)
+	}
+	if err != nil {
+		return nil, r, err
+	}
+	if u == nil {
+		return nil, r, nil
+	}
+	if u.Suspended() {
+		return u, r, errAccountSuspended
+	}
+	return u, withUser(r, u), nil
+}
+
+// sessionUser returns the user logged in by the session cookie, provided the
+// session has not been ended server side.
+func (am AccountManager) sessionUser(r *http.Request) (*User, *http.Request, error) {
+	su, err := UserFromRequest(am.store, r)
+	if err != nil || su == nil {
+		return nil, r, err
+	}
+	s, err := am.store.Get(r, Session)
+	if err != nil {
+		return nil, r, err
+	}
+	key, _ := s.Values[sessionIDKey].(string)
+	u, err := loadUserBySession(am.db, key, su.ID)
+	if err == sql.ErrNoRows {
+		return nil, r, nil
+	} else if err != nil {
+		return nil, r, err
+	}
+	if u.Suspended() {
+		return u, r, errAccountSuspended
+	}
+	r = withUser(r, u)
+	if adminID, ok := s.Values[impersonatorKey].(int64); ok {
+		admin, err := checkImpersonator(am.db, r, s, u.ID, adminID)
+		if err != nil || admin == nil {
+			return nil, r, err
+		}
+		r = withImpersonator(r, admin, am.BasePath())
+	}
+	return u, r, nil
+}
+
+// BasePath returns the path the account routes are mounted at, for links to
+// them from host templates.  It is empty until CreateRoutes is called.
+func (am AccountManager) BasePath() string {
+	if am.baseURL == nil {
+		return ""
+	}
+	return am.baseURL.Path
+}
+
+// CurrentUser returns the logged in user, or nil for anonymous requests.
+// Unlike UserFromRequest it checks the session has not been revoked.
+func (am AccountManager) CurrentUser(r *http.Request) (*User, error) {
+	u, _, err := am.authenticate(r)
+	if isInvalidTokenError(err) {
+		return nil, nil
+	}
+	return u, err
+}
+
 func (am AccountManager) storeNext(w http.ResponseWriter, r *http.Request) error {
 	s, err := am.store.Get(r, Session)
 	if err != nil {
 		return err
 	}
-	s.Values["postLoginPath"] = r.URL.Path
+	s.Values["postLoginPath"] = r.URL.RequestURI()
 	return s.Save(r, w)
 }
 
@@ -143,6 +333,7 @@ func (am *AccountManager) CreateRoutes(sr *mux.Router) error {
 	}
 
 	am.fb.config.RedirectURL = am.serverAddr + am.baseURL.Path + "/loginfb"
+	am.fb.base = am.baseURL.Path
 	sr.Methods("GET").
 		Path("/loginfb").
 		Handler(alice.New(am.RequireNoUserMiddleware()).
@@ -150,26 +341,62 @@ func (am *AccountManager) CreateRoutes(sr *mux.Router) error {
 
 	sr.Methods("POST").
 		Path("/login").
-		Handler(nosurf.New(newLoginPostHandler(am.db, am.store, am.fb)))
+		Handler(nosurf.New(newLoginPostHandler(am.db, am.store, am.fb, am.hooks)))
 
 	sr.Methods("GET").
 		Path("/logout").
 		HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Wipe out the cookie
-		http.SetCookie(w, &http.Cookie{Name: Session, MaxAge: -1, Path: "/"})
+		if err := endSession(am.db, am.store, am.hooks, w, r); err != nil {
+			if v, ok := err.(*vetoError); ok {
+				http.Error(w, v.Error(), http.StatusForbidden)
+				return
+			}
+			log.Print("unable to end session ", err)
+		}
 		http.Redirect(w, r, "/", http.StatusFound)
 	})
 
 	sr.Methods("GET").
 		Path("/signup").
 		Handler(alice.New(nosurf.NewPure, am.RequireNoUserMiddleware()).ThenFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			templateHandler("signup.html", newSignupContext(), w, r)
-		}))
+		signupGetHandler(am.store, am.signupPolicy)))
 
 	sr.Methods("POST").
 		Path("/signup").
-		Handler(nosurf.New(newSignupPostHandler(am.db, am.store)))
+		Handler(nosurf.New(newSignupPostHandler(am.db, am.store, am.hooks, am.signupPolicy)))
+
+	// The policy and invitation are checked before the hooks of the host
+	// application run, so they don't act on signups that are refused.  Should
+	// one of them veto the invitation's use is given back.
+	checks := []Hook{policyHook(am.signupPolicy)}
+	if am.signupPolicy.needsInvitation() {
+		checks = append(checks, invitationHook(am.db, am.store))
+	}
+	am.hooks[signupHook] = append(checks, am.hooks[signupHook]...)
+
+	wl := newWaitlistHandler(am.db, am.store, am.mailer, am.signupPolicy, am.serverAddr+am.baseURL.Path)
+	if am.signupPolicy.Mode == SignupWaitlist {
+		sr.Methods("POST").
+			Path("/waitlist").
+			Handler(nosurf.New(alice.New(am.RequireNoUserMiddleware()).ThenFunc(wl.join)))
+	}
+
+	inv := newInvitationsHandler(am.db, am.store, am.mailer, am.serverAddr+am.baseURL.Path)
+	if am.signupPolicy.Mode == SignupInviteOnly {
+		sr.Methods("GET").
+			Path("/invitations").
+			Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware()).ThenFunc(inv.get))
+
+		sr.Methods("POST").
+			Path("/invitations").
+			Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+			am.BlockImpersonationMiddleware()).ThenFunc(inv.post)))
+
+		sr.Methods("POST").
+			Path("/revoke_invitation").
+			Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+			am.BlockImpersonationMiddleware()).ThenFunc(inv.revoke)))
+	}
 
 	sr.Methods("GET").
 		Path("/change_password").
@@ -178,14 +405,328 @@ func (am *AccountManager) CreateRoutes(sr *mux.Router) error {
 
 	sr.Methods("POST").
 		Path("/change_password").
-		Handler(nosurf.New(newChangePasswordPostHandler(am.db, am.store)))
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).Then(
+		newChangePasswordPostHandler(am.db, am.store, am.hooks))))
+
+	ec := newEmailChangeHandler(am.db, am.store, am.mailer, am.serverAddr+am.baseURL.Path)
+	sr.Methods("GET").
+		Path("/change_email").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware()).ThenFunc(ec.get))
+
+	sr.Methods("POST").
+		Path("/change_email").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).ThenFunc(ec.post)))
+
+	// The links sent for a change only show a form, as mail scanners and
+	// link prefetchers fetch them too.
+	sr.Methods("GET").
+		Path("/confirm_email").
+		Handler(nosurf.NewPure(http.HandlerFunc(ec.confirmGet)))
+
+	sr.Methods("POST").
+		Path("/confirm_email").
+		Handler(nosurf.New(http.HandlerFunc(ec.confirmPost)))
+
+	sr.Methods("GET").
+		Path("/revert_email").
+		Handler(nosurf.NewPure(http.HandlerFunc(ec.revertGet)))
+
+	sr.Methods("POST").
+		Path("/revert_email").
+		Handler(nosurf.New(http.HandlerFunc(ec.revertPost)))
+
+	ue := newUserEmailsHandler(am.db, am.store, am.mailer, am.serverAddr+am.baseURL.Path)
+	sr.Methods("GET").
+		Path("/emails").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware()).ThenFunc(ue.get))
+
+	sr.Methods("POST").
+		Path("/emails").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).ThenFunc(ue.post)))
+
+	sr.Methods("GET").
+		Path("/verify_email").
+		HandlerFunc(ue.verify)
+
+	p := newProfileHandler(am.db, am.store)
+	sr.Methods("GET").
+		Path("/profile").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware()).ThenFunc(p.get))
+
+	sr.Methods("POST").
+		Path("/profile").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).ThenFunc(p.post)))
+
+	av := newAvatarHandler(am.db, am.store, am.blobs, am.serverAddr+am.baseURL.Path)
+	sr.Methods("POST").
+		Path("/avatar").
+		Handler(maxBytesMiddleware(maxAvatarUploadBytes+1<<10)(nosurf.New(alice.New(
+		am.RequireUserMiddleware(), am.BlockImpersonationMiddleware()).ThenFunc(av.upload))))
+
+	sr.Methods("GET").
+		Path("/avatar/{id:[0-9]+}").
+		HandlerFunc(av.serve)
+
+	// Uploaded avatars go with the account.
+	am.hooks[afterDeleteHook] = append(am.hooks[afterDeleteHook], func(u *User, r *http.Request) error {
+		return deleteAvatar(am.blobs, u.ID)
+	})
+
+	org := newOrganizationsHandler(am.db, am.store, am.mailer, am.resolver, am.serverAddr+am.baseURL.Path)
+	sr.Methods("GET").
+		Path("/organizations").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware()).ThenFunc(org.list))
+
+	sr.Methods("POST").
+		Path("/organizations").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).ThenFunc(org.create)))
+
+	sr.Methods("POST").
+		Path("/switch_organization").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware()).ThenFunc(org.switchOrg)))
+
+	sr.Methods("GET").
+		Path("/organizations/{org:[0-9]+}").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware(),
+		am.RequireOrganizationMiddleware(OrgMember)).ThenFunc(org.show))
+
+	sr.Methods("POST").
+		Path("/organizations/{org:[0-9]+}/{action}").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireOrganizationMiddleware(OrgMember)).ThenFunc(org.action)))
+
+	sr.Methods("POST").
+		Path("/organizations/{org:[0-9]+}/domains/{action}").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireOrganizationMiddleware(OrgAdmin)).ThenFunc(org.domainAction)))
+
+	// Users join the organizations claiming their domains as they log in.
+	am.hooks[loginHook] = append(am.hooks[loginHook], domainsHook(am.db))
+
+	sr.Methods("GET").
+		Path("/join_organization").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware()).ThenFunc(org.joinGet))
+
+	sr.Methods("POST").
+		Path("/join_organization").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).ThenFunc(org.joinPost)))
+
+	st := newSettingsHandler(am.db, am.store, am.settings)
+	sr.Methods("GET").
+		Path("/settings").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware()).ThenFunc(st.get))
+
+	sr.Methods("POST").
+		Path("/settings").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).ThenFunc(st.post)))
+
+	un := newUsernameHandler(am.db, am.store)
+	sr.Methods("GET").
+		Path("/username").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware()).ThenFunc(un.get))
+
+	sr.Methods("POST").
+		Path("/username").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).ThenFunc(un.post)))
+
+	sr.Methods("GET").
+		Path("/delete").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware()).ThenFunc(
+		newDeleteAccountHandler(am.db, am.store, am.hooks, am.deletionGrace).get))
+
+	sr.Methods("POST").
+		Path("/delete").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).ThenFunc(
+		newDeleteAccountHandler(am.db, am.store, am.hooks, am.deletionGrace).post)))
+
+	sr.Methods("GET").
+		Path("/tokens").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware()).Then(
+		newAPITokensGetHandler(am.db, am.store)))
+
+	sr.Methods("POST").
+		Path("/tokens").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).Then(
+		newAPITokensPostHandler(am.db, am.store))))
+
+	sr.Methods("POST").
+		Path("/delete_token").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).Then(
+		newAPITokenDeletePostHandler(am.db, am.store))))
+
+	o := newOAuthServer(am.db, am.store, am.keys, am.hooks, am.serverAddr+am.baseURL.Path)
+	sr.Methods("GET").
+		Path("/.well-known/openid-configuration").
+		HandlerFunc(o.discovery)
+
+	sr.Methods("GET").
+		Path("/oauth/authorize").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware()).ThenFunc(
+		o.authorizeGet))
+
+	sr.Methods("POST").
+		Path("/oauth/authorize").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).ThenFunc(
+		o.authorizePost)))
+
+	sr.Methods("POST").
+		Path("/oauth/token").
+		HandlerFunc(o.token)
+
+	sr.Methods("POST").
+		Path("/oauth/introspect").
+		HandlerFunc(o.introspect)
+
+	sr.Methods("POST").
+		Path("/oauth/revoke").
+		HandlerFunc(o.revoke)
+
+	sr.Methods("GET", "POST").
+		Path("/oauth/userinfo").
+		HandlerFunc(o.userinfo)
+
+	sr.Methods("GET").
+		Path("/oauth/logout").
+		HandlerFunc(o.logout)
+
+	sr.Methods("GET").
+		Path("/oauth/clients").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware()).ThenFunc(
+		o.clientsGet))
+
+	sr.Methods("POST").
+		Path("/oauth/clients").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).ThenFunc(
+		o.clientsPost)))
+
+	sr.Methods("POST").
+		Path("/oauth/delete_client").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).ThenFunc(
+		o.clientDeletePost)))
+
+	a := newAdminHandler(am.db, am.store, am.hooks, am.baseURL.Path+"/admin")
+	asr := sr.PathPrefix("/admin").Subrouter()
+	asr.Methods("GET").
+		Path("/users").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireRoleMiddleware(AdminRole)).ThenFunc(a.users))
+
+	asr.Methods("GET").
+		Path("/users/{id:[0-9]+}").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireRoleMiddleware(AdminRole)).ThenFunc(a.user))
+
+	asr.Methods("POST").
+		Path("/users/{id:[0-9]+}/{action}").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireRoleMiddleware(AdminRole)).ThenFunc(a.action)))
+
+	asr.Methods("GET").
+		Path("/invitations").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireRoleMiddleware(AdminRole)).ThenFunc(inv.adminList))
+
+	asr.Methods("POST").
+		Path("/invitations").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireRoleMiddleware(AdminRole)).ThenFunc(inv.adminCreate)))
+
+	asr.Methods("POST").
+		Path("/revoke_invitation").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireRoleMiddleware(AdminRole)).ThenFunc(inv.adminRevoke)))
+
+	asr.Methods("GET").
+		Path("/waitlist").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireRoleMiddleware(AdminRole)).ThenFunc(wl.adminList))
+
+	asr.Methods("POST").
+		Path("/waitlist").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireRoleMiddleware(AdminRole)).ThenFunc(wl.adminAction)))
+
+	asr.Methods("GET").
+		Path("/oauth_clients").
+		Handler(alice.New(nosurf.NewPure, am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireRoleMiddleware(AdminRole)).ThenFunc(o.adminClients))
+
+	asr.Methods("POST").
+		Path("/oauth_clients").
+		Handler(nosurf.New(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireRoleMiddleware(AdminRole)).ThenFunc(o.adminClientAction)))
+
+	asr.Methods("GET").
+		Path("/webhooks").
+		Handler(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireRoleMiddleware(AdminRole)).ThenFunc(a.webhooks))
+
+	asr.Methods("GET").
+		Path("/audit").
+		Handler(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware(), am.RequireRoleMiddleware(AdminRole)).ThenFunc(a.audit))
+
+	sr.Methods("GET").
+		Path("/export").
+		Handler(alice.New(am.RequireUserMiddleware(),
+		am.BlockImpersonationMiddleware()).ThenFunc(am.exportHandler))
+
+	sr.Methods("GET").
+		Path("/activity").
+		Handler(alice.New(am.RequireUserMiddleware()).ThenFunc(
+		am.activityHandler))
+
+	sr.Methods("GET").
+		Path("/stop_impersonating").
+		HandlerFunc(am.stopImpersonatingHandler)
+
+	sr.Methods("GET").
+		Path("/jwks.json").
+		HandlerFunc(am.jwksHandler)
+
+	am.createAPIRoutes(sr.PathPrefix("/api/v1").Subrouter())
 
 	return nil
 }
 
+// clearSession logs the client out by wiping out the session cookie.
+func clearSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: Session, MaxAge: -1, Path: "/"})
+}
+
 func templateHandler(tmpl string, f csrfForm, w http.ResponseWriter, r *http.Request) {
 	f.setToken(nosurf.Token(r))
-	err := templates.ExecuteTemplate(w, tmpl, f)
+	pageHandler(tmpl, f, w, r)
+}
+
+// pageHandler renders tmpl, preceded by a banner while an admin impersonates
+// the user.  Every account page is rendered through it so none goes without
+// the banner.
+func pageHandler(tmpl string, c interface{}, w http.ResponseWriter, r *http.Request) {
+	if i := impersonationFromRequest(r); i != nil {
+		u, _ := UserFromRequest(nil, r)
+		err := templates.ExecuteTemplate(w, "impersonation_banner.html",
+			&impersonationContext{Base: i.base, Impersonator: i.admin, User: u})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	err := templates.ExecuteTemplate(w, tmpl, c)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -0,0 +1,154 @@
+package account
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// sessionIDKey holds the key of the Sessions row backing a login.  Cookie
+// sessions can not be revoked by themselves, so a login only counts while its
+// row exists.
+const sessionIDKey = "SID"
+
+type userSession struct {
+	ID        int64
+	UserID    int64
+	Created   time.Time
+	LastSeen  time.Time
+	IP        string
+	UserAgent string
+	key       string
+}
+
+func newUserSession(db *sql.DB, u *User, r *http.Request) (*userSession, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	us := &userSession{
+		UserID:    u.ID,
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+		key:       base64.RawURLEncoding.EncodeToString(b)}
+	res, err := db.Exec(
+		"INSERT INTO Sessions (session_key, user_id, ip, user_agent) VALUES ($1, $2, $3, $4)",
+		us.key,
+		us.UserID,
+		us.IP,
+		us.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+	us.ID, err = res.LastInsertId()
+	return us, err
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func loadUserSessions(db *sql.DB, userID int64) ([]*userSession, error) {
+	rows, err := db.Query(
+		"SELECT id, user_id, created, last_seen, ip, user_agent FROM Sessions WHERE user_id = ? ORDER BY last_seen DESC",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ss []*userSession
+	for rows.Next() {
+		us := &userSession{}
+		err := rows.Scan(&us.ID, &us.UserID, &us.Created, &us.LastSeen, &us.IP, &us.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, us)
+	}
+	return ss, rows.Err()
+}
+
+// loadUserBySession returns the current state of the user logged in by the
+// session key, or sql.ErrNoRows if the session was ended.
+func loadUserBySession(db *sql.DB, key string, userID int64) (*User, error) {
+	r, err := db.Exec(
+		"UPDATE Sessions SET last_seen = CURRENT_TIMESTAMP WHERE session_key = ? AND user_id = ?",
+		key, userID)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return loadUserByID(db, userID)
+}
+
+// deleteUserSessions logs the user out everywhere, including refresh tokens
+// held by native clients.
+func deleteUserSessions(db *sql.DB, userID int64) error {
+	if _, err := db.Exec("DELETE FROM Sessions WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM RefreshTokens WHERE user_id = ?", userID)
+	return err
+}
+
+// endSession logs the client out, forgetting the session server side and
+// wiping out the cookie.  A *vetoError is returned if a logout hook refused,
+// leaving the session alone.
+func endSession(db *sql.DB, store sessions.Store, hs hooks, w http.ResponseWriter, r *http.Request) error {
+	s, err := store.Get(r, Session)
+	if err != nil {
+		// An unreadable cookie is as good as gone.
+		clearSession(w)
+		return nil
+	}
+	u, _ := s.Values[UserKey].(*User)
+	if u != nil {
+		if err := hs.run(logoutHook, u, r); err != nil {
+			return err
+		}
+	}
+	clearSession(w)
+	key, ok := s.Values[sessionIDKey].(string)
+	if !ok || u == nil {
+		return nil
+	}
+	if _, err = db.Exec("DELETE FROM Sessions WHERE session_key = ?", key); err != nil {
+		return err
+	}
+	// Logging out while impersonating logs the admin out as well.
+	adminID, ok := s.Values[impersonatorKey].(int64)
+	if !ok {
+		return recordAuditEvent(db, r, u.ID, u.ID, auditLogout, nil)
+	}
+	adminKey, _ := s.Values[impersonatorSIDKey].(string)
+	if _, err = db.Exec("DELETE FROM Sessions WHERE session_key = ?", adminKey); err != nil {
+		return err
+	}
+	return recordAuditEvent(db, r, adminID, u.ID, auditImpersonationStop,
+		map[string]string{"reason": "logout"})
+}
+
+// sessionCreated returns when the client's session was logged in.
+func sessionCreated(db *sql.DB, store sessions.Store, r *http.Request) (time.Time, error) {
+	s, err := store.Get(r, Session)
+	if err != nil {
+		return time.Time{}, err
+	}
+	key, _ := s.Values[sessionIDKey].(string)
+	var created time.Time
+	err = db.QueryRow("SELECT created FROM Sessions WHERE session_key = ?", key).Scan(&created)
+	return created, err
+}
@@ -0,0 +1,305 @@
+package account
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+var (
+	// ErrUnknownSetting is returned for keys no setting was registered for.
+	ErrUnknownSetting = errors.New("unknown setting")
+	// ErrInvalidSetting is returned when a value doesn't fit its setting.
+	ErrInvalidSetting = errors.New("invalid setting value")
+)
+
+// Setting describes a per-user preference of the host application.  Values
+// are stored as json and have the type of Default, which must be a bool, a
+// string or a number.
+type Setting struct {
+	Key string
+	// Label and Help describe the setting on the settings page.
+	Label   string
+	Help    string
+	Default interface{}
+	// Choices, if any, are the only strings a string setting may hold.
+	Choices []string
+	// Hidden settings are left off the settings page, for those the host
+	// application manages itself.
+	Hidden bool
+}
+
+// kind returns the json type of the setting's values.
+func (s *Setting) kind() string {
+	return jsonKind(s.Default)
+}
+
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case bool:
+		return "bool"
+	case string:
+		return "string"
+	case float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "number"
+	}
+	return ""
+}
+
+// check returns the canonical json of v, or ErrInvalidSetting if v isn't of
+// the setting's type or one of its choices.
+func (s *Setting) check(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, ErrInvalidSetting
+	}
+	var d interface{}
+	if err := json.Unmarshal(b, &d); err != nil || jsonKind(d) != s.kind() {
+		return nil, ErrInvalidSetting
+	}
+	if str, ok := d.(string); ok && len(s.Choices) != 0 && !containsString(s.Choices, str) {
+		return nil, ErrInvalidSetting
+	}
+	return b, nil
+}
+
+// settings holds the registered settings by key.  Like hooks it is a map so
+// copies of AccountManager share it.
+type settings map[string]*Setting
+
+// sorted returns the visible settings in key order.
+func (ss settings) sorted() []*Setting {
+	var l []*Setting
+	for _, s := range ss {
+		if !s.Hidden {
+			l = append(l, s)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Key < l[j].Key })
+	return l
+}
+
+// RegisterSetting declares a setting users may have.  Settings must be
+// registered before the AccountManager starts serving requests.  It panics
+// if the key is taken or the default isn't a bool, string or number, as
+// those are programming errors.
+func (am AccountManager) RegisterSetting(s Setting) {
+	if s.Key == "" || am.settings[s.Key] != nil {
+		panic("account: setting " + strconv.Quote(s.Key) + " registered twice or without a key")
+	}
+	if s.kind() == "" {
+		panic(fmt.Sprintf("account: setting %q has a default of unsupported type %T", s.Key, s.Default))
+	}
+	if s.Label == "" {
+		s.Label = s.Key
+	}
+	am.settings[s.Key] = &s
+}
+
+// GetSetting stores the user's value for key, or the setting's default if
+// they have none, in the value pointed to by v.
+func (am AccountManager) GetSetting(u *User, key string, v interface{}) error {
+	s := am.settings[key]
+	if s == nil {
+		return ErrUnknownSetting
+	}
+	b, err := loadSetting(am.db, u.ID, key)
+	if err == sql.ErrNoRows {
+		if b, err = json.Marshal(s.Default); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// SetSetting changes the user's value for key.  ErrInvalidSetting is
+// returned if v isn't of the setting's type.
+func (am AccountManager) SetSetting(u *User, key string, v interface{}) error {
+	s := am.settings[key]
+	if s == nil {
+		return ErrUnknownSetting
+	}
+	b, err := s.check(v)
+	if err != nil {
+		return err
+	}
+	return saveSetting(am.db, u.ID, key, b)
+}
+
+// DeleteSetting brings the user's value for key back to the default.
+func (am AccountManager) DeleteSetting(u *User, key string) error {
+	if am.settings[key] == nil {
+		return ErrUnknownSetting
+	}
+	return deleteSetting(am.db, u.ID, key)
+}
+
+func loadSetting(db *sql.DB, userID int64, key string) ([]byte, error) {
+	var b []byte
+	err := db.QueryRow("SELECT value FROM UserSettings WHERE user_id = ? AND name = ?", userID, key).Scan(&b)
+	return b, err
+}
+
+// loadUserSettings returns the values the user set, by key, including those
+// of settings no longer registered.
+func loadUserSettings(db *sql.DB, userID int64) (map[string]json.RawMessage, error) {
+	rows, err := db.Query("SELECT name, value FROM UserSettings WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var k string
+		var b []byte
+		if err := rows.Scan(&k, &b); err != nil {
+			return nil, err
+		}
+		m[k] = json.RawMessage(b)
+	}
+	return m, rows.Err()
+}
+
+func saveSetting(db *sql.DB, userID int64, key string, value []byte) error {
+	_, err := db.Exec(
+		"INSERT OR REPLACE INTO UserSettings (user_id, name, value, updated) VALUES (?, ?, ?, ?)",
+		userID, key, value, time.Now().Unix())
+	return err
+}
+
+func deleteSetting(db *sql.DB, userID int64, key string) error {
+	_, err := db.Exec("DELETE FROM UserSettings WHERE user_id = ? AND name = ?", userID, key)
+	return err
+}
+
+// settingField is a setting as shown on the settings page.
+type settingField struct {
+	*Setting
+	Kind  string
+	Value interface{}
+	Error string
+}
+
+type settingsContext struct {
+	Fields  []*settingField
+	Message string
+	Token   string
+}
+
+func (c *settingsContext) setToken(t string) {
+	c.Token = t
+}
+
+type settingsHandler struct {
+	db       *sql.DB
+	s        sessions.Store
+	settings settings
+}
+
+func newSettingsHandler(db *sql.DB, s sessions.Store, ss settings) *settingsHandler {
+	return &settingsHandler{db, s, ss}
+}
+
+// fields returns the visible settings with the user's values.
+func (h settingsHandler) fields(userID int64) ([]*settingField, error) {
+	vals, err := loadUserSettings(h.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	var fs []*settingField
+	for _, s := range h.settings.sorted() {
+		f := &settingField{Setting: s, Kind: s.kind(), Value: s.Default}
+		if b, ok := vals[s.Key]; ok {
+			var v interface{}
+			if err := json.Unmarshal(b, &v); err == nil && jsonKind(v) == f.Kind {
+				f.Value = v
+			}
+		}
+		fs = append(fs, f)
+	}
+	return fs, nil
+}
+
+func (h settingsHandler) get(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	fs, err := h.fields(u.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateHandler("settings.html", &settingsContext{Fields: fs}, w, r)
+}
+
+// post saves every visible setting from the form.  Values equal to the
+// default are deleted rather than stored, so users who never touched a
+// setting follow changes to its default.
+func (h settingsHandler) post(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	fs, err := h.fields(u.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c := &settingsContext{Fields: fs, Message: "Settings saved"}
+	for _, f := range fs {
+		raw := strings.TrimSpace(r.PostForm.Get(f.Key))
+		var v interface{}
+		switch f.Kind {
+		case "bool":
+			// Unchecked boxes are left out of the form.
+			v = raw != ""
+		case "number":
+			n, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				f.Value = raw
+				f.Error = "Enter a number"
+				c.Message = ""
+				continue
+			}
+			v = n
+		default:
+			v = raw
+		}
+		b, err := f.check(v)
+		if err != nil {
+			f.Value = v
+			f.Error = "Invalid value"
+			c.Message = ""
+			continue
+		}
+		f.Value = v
+		def, _ := f.check(f.Default)
+		if string(b) == string(def) {
+			err = deleteSetting(h.db, u.ID, f.Key)
+		} else {
+			err = saveSetting(h.db, u.ID, f.Key, b)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	templateHandler("settings.html", c, w, r)
+}
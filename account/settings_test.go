@@ -0,0 +1,83 @@
+package account
+
+import (
+	"testing"
+)
+
+func TestSettings(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	am := AccountManager{db: db, settings: settings{}}
+	am.RegisterSetting(Setting{Key: "newsletter", Default: true})
+	am.RegisterSetting(Setting{Key: "page_size", Default: 20})
+	am.RegisterSetting(Setting{Key: "theme", Default: "light", Choices: []string{"light", "dark"}})
+
+	u := newUser("some@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var size int
+	if err := am.GetSetting(u, "page_size", &size); err != nil || size != 20 {
+		t.Errorf("Expected default page size 20, got %v, %v", size, err)
+	}
+	if err := am.SetSetting(u, "page_size", 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := am.GetSetting(u, "page_size", &size); err != nil || size != 50 {
+		t.Errorf("Expected page size 50, got %v, %v", size, err)
+	}
+	if err := am.DeleteSetting(u, "page_size"); err != nil {
+		t.Fatal(err)
+	}
+	if err := am.GetSetting(u, "page_size", &size); err != nil || size != 20 {
+		t.Errorf("Expected page size back to 20, got %v, %v", size, err)
+	}
+
+	if err := am.SetSetting(u, "page_size", "many"); err != ErrInvalidSetting {
+		t.Errorf("Expected string to be refused for a number setting, got %v", err)
+	}
+	if err := am.SetSetting(u, "theme", "pink"); err != ErrInvalidSetting {
+		t.Errorf("Expected value outside the choices to be refused, got %v", err)
+	}
+	if err := am.SetSetting(u, "nope", 1); err != ErrUnknownSetting {
+		t.Errorf("Expected unknown setting to be refused, got %v", err)
+	}
+
+	if err := am.SetSetting(u, "newsletter", false); err != nil {
+		t.Fatal(err)
+	}
+	vals, err := loadUserSettings(db, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(vals["newsletter"]) != "false" || len(vals) != 1 {
+		t.Errorf("Expected only the newsletter setting stored, got %v", vals)
+	}
+
+	if err := deleteUser(db, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if vals, _ := loadUserSettings(db, u.ID); len(vals) != 0 {
+		t.Errorf("Expected settings to be deleted with the user")
+	}
+}
+
+func TestRegisterSettingPanics(t *testing.T) {
+	am := AccountManager{settings: settings{}}
+	am.RegisterSetting(Setting{Key: "a", Default: ""})
+	for _, s := range []Setting{{Key: "a", Default: ""}, {Key: "b", Default: []int{}}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected registering %v to panic", s.Key)
+				}
+			}()
+			am.RegisterSetting(s)
+		}()
+	}
+}
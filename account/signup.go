@@ -3,7 +3,6 @@ package account
 import (
 	"database/sql"
 	"net/http"
-	"net/mail"
 
 	"github.com/gorilla/schema"
 	"github.com/gorilla/sessions"
@@ -13,41 +12,71 @@ import (
 const MIN_PASS_LEN = 4
 
 type signupPostHandler struct {
-	db *sql.DB
-	s  sessions.Store
+	db     *sql.DB
+	s      sessions.Store
+	hooks  hooks
+	policy SignupPolicy
 }
 
 type signupForm struct {
 	Email     string
+	Username  string
 	Password  string
 	Password2 string
+	Invite    string
 	Errors    map[string]string
 	Token     string `schema:"csrf_token"`
 }
 
 type signupContext struct {
-	PassLen int
-	Form    *signupForm
+	PassLen    int
+	InviteOnly bool
+	// Waitlist is set when visitors without an invitation may only join the
+	// waitlist.
+	Waitlist bool
+	Closed   bool
+	Message  string
+	Form     *signupForm
 }
 
-func newSignupPostHandler(db *sql.DB, s sessions.Store) *signupPostHandler {
-	return &signupPostHandler{db, s}
+func newSignupPostHandler(db *sql.DB, s sessions.Store, hs hooks, p SignupPolicy) *signupPostHandler {
+	return &signupPostHandler{db, s, hs, p}
 }
 
 func newSignupForm() *signupForm {
 	return &signupForm{Errors: make(map[string]string)}
 }
 
-func newSignupContext() *signupContext {
+func newSignupContext(p SignupPolicy) *signupContext {
 	return &signupContext{
-		Form:    newSignupForm(),
-		PassLen: MIN_PASS_LEN}
+		Form:       newSignupForm(),
+		InviteOnly: p.needsInvitation(),
+		Waitlist:   p.Mode == SignupWaitlist,
+		Closed:     p.Mode == SignupClosed,
+		PassLen:    MIN_PASS_LEN}
 }
 
 func (c *signupContext) setToken(t string) {
 	c.Form.Token = t
 }
 
+// signupGetHandler shows the signup form.  The invitation of a signup link
+// is filled in, and kept in the session in case the visitor signs up
+// through a provider instead.
+func signupGetHandler(store sessions.Store, p SignupPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := newSignupContext(p)
+		if c.Form.Invite = r.URL.Query().Get("invite"); c.Form.Invite != "" {
+			c.Waitlist = false
+			if err := rememberInvitation(store, w, r, c.Form.Invite); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		templateHandler("signup.html", c, w, r)
+	}
+}
+
 func (su signupPostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
@@ -56,41 +85,57 @@ func (su signupPostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	decoder := schema.NewDecoder()
-	c := newSignupContext()
+	c := newSignupContext(su.policy)
 	err = decoder.Decode(c.Form, r.PostForm)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	c.Waitlist = c.Waitlist && c.Form.Invite == ""
 
-	if !c.Form.validate() {
-		err = templates.ExecuteTemplate(w, "signup.html", c)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	if !c.Form.validate() || !su.policy.checkForm(c.Form) {
+		pageHandler("signup.html", c, w, r)
 		return
 	}
 
 	u, err := c.Form.createUser(su.db)
 	if err != nil {
+		if err == errUsernameTaken {
+			c.Form.Errors["Username"] = "That username is taken"
+			pageHandler("signup.html", c, w, r)
+			return
+		}
 		if isExistingUserError(err) {
 			c.Form.Errors["Email"] = "User already exists"
-			if err := templates.ExecuteTemplate(w, "signup.html", c); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			}
+			pageHandler("signup.html", c, w, r)
 			return
 		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if err = u.saveToSession(su.s, w, r); err != nil {
+	audit(su.db, r, u.ID, u.ID, auditSignup, nil)
+	r = withInvitation(r, c.Form.Invite)
+	if err := su.hooks.run(signupHook, u, r); err != nil {
+		if err := undoSignup(su.db, u.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c.Form.Errors["Signup"] = err.Error()
+		pageHandler("signup.html", c, w, r)
+		return
+	}
+	su.hooks.notify(afterSignupHook, u, r)
+	if err = u.saveToSession(su.db, su.s, w, r); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 	redirectAfterLogin(su.s, w, r)
 }
 
 func isExistingUserError(err error) bool {
+	if err == errEmailInUse {
+		return true
+	}
 	if sqliteErr, ok := err.(sqlite.Error); ok {
 		if sqliteErr.Code == sqlite.ErrConstraint {
 			return true
@@ -100,11 +145,19 @@ func isExistingUserError(err error) bool {
 }
 
 func (f *signupForm) validate() bool {
-	_, err := mail.ParseAddress(f.Email)
+	email, err := normalizeEmail(f.Email)
 	if err != nil {
 		f.Errors["Email"] = "Invalid email address"
 		return false
 	}
+	f.Email = email
+
+	if f.Username != "" {
+		if msg := validateUsername(f.Username); len(msg) != 0 {
+			f.Errors["Username"] = msg
+			return false
+		}
+	}
 
 	if len(f.Password) < MIN_PASS_LEN {
 		f.Errors["Password"] = "Passwords is too short"
@@ -118,8 +171,19 @@ func (f *signupForm) validate() bool {
 	return true
 }
 
+// createUser inserts the user the form describes, failing with
+// errUsernameTaken if they chose a username someone else has.
 func (f *signupForm) createUser(db *sql.DB) (*User, error) {
+	if f.Username != "" {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM Users WHERE username = ?", f.Username).Scan(&n); err != nil {
+			return nil, err
+		} else if n != 0 {
+			return nil, errUsernameTaken
+		}
+	}
 	u := newUser(f.Email)
+	u.Username = f.Username
 
 	if err := u.setPassword(f.Password); err != nil {
 		return nil, err
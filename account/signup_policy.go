@@ -0,0 +1,185 @@
+package account
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// SignupMode decides who may create an account.
+type SignupMode int
+
+const (
+	// SignupOpen lets anyone sign up.
+	SignupOpen SignupMode = iota
+	// SignupInviteOnly requires a valid invitation to sign up, with a
+	// password, through the API or through a provider.
+	SignupInviteOnly
+	// SignupWaitlist lets visitors join a waitlist.  Admins approve them,
+	// which mails them an invitation.
+	SignupWaitlist
+	// SignupClosed refuses all signups.
+	SignupClosed
+)
+
+var errSignupClosed = errors.New("signup is closed")
+
+// SignupPolicy decides who may create an account: how signup works, and
+// which email domains may be used.  Domains match their subdomains too.
+type SignupPolicy struct {
+	Mode SignupMode
+	// AllowedDomains, if any, are the only domains that may sign up.
+	AllowedDomains []string
+	// BlockedDomains may not sign up.
+	BlockedDomains []string
+	// BlockDisposable refuses addresses of known disposable email
+	// services.
+	BlockDisposable bool
+}
+
+// SetSignupPolicy changes who may sign up.  Signup is open to all by
+// default.  It must be called before CreateRoutes.
+func (am *AccountManager) SetSignupPolicy(p SignupPolicy) {
+	am.signupPolicy = p
+}
+
+// SetSignupMode changes how signup works, keeping the domain rules.  It
+// must be called before CreateRoutes.
+func (am *AccountManager) SetSignupMode(m SignupMode) {
+	am.signupPolicy.Mode = m
+}
+
+// needsInvitation reports whether signing up takes an invitation.
+func (p *SignupPolicy) needsInvitation() bool {
+	return p.Mode == SignupInviteOnly || p.Mode == SignupWaitlist
+}
+
+// matchDomain reports whether domain is one of ds or a subdomain of one.
+func matchDomain(domain string, ds []string) bool {
+	for _, d := range ds {
+		d = strings.ToLower(strings.TrimPrefix(d, "@"))
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEmail returns why the normalized address email may not sign up, or
+// the empty string if it may.
+func (p *SignupPolicy) checkEmail(email string) string {
+	domain := email[strings.LastIndex(email, "@")+1:]
+	if len(p.AllowedDomains) != 0 && !matchDomain(domain, p.AllowedDomains) {
+		return "Signup is not open to addresses at " + domain
+	}
+	if matchDomain(domain, p.BlockedDomains) {
+		return "Signup is not open to addresses at " + domain
+	}
+	if p.BlockDisposable && isDisposableDomain(domain) {
+		return "Disposable email addresses can't be used to sign up"
+	}
+	return ""
+}
+
+// checkForm reports whether the policy lets the validated form sign up,
+// setting its errors if not.
+func (p *SignupPolicy) checkForm(f *signupForm) bool {
+	if p.Mode == SignupClosed {
+		f.Errors["Signup"] = "Signup is closed"
+		return false
+	}
+	if msg := p.checkEmail(f.Email); len(msg) != 0 {
+		f.Errors["Email"] = msg
+		return false
+	}
+	return true
+}
+
+// policyHook vetoes signups the policy doesn't allow.  Signups through the
+// form and the API are checked before the user is created as well; this
+// catches those through a provider.
+func policyHook(p SignupPolicy) Hook {
+	return func(u *User, r *http.Request) error {
+		if p.Mode == SignupClosed {
+			return errSignupClosed
+		}
+		if msg := p.checkEmail(u.Email); len(msg) != 0 {
+			return errors.New(msg)
+		}
+		return nil
+	}
+}
+
+// isDisposableDomain reports whether domain, or a domain it is under,
+// belongs to a known disposable email service.
+func isDisposableDomain(domain string) bool {
+	for {
+		if disposableDomains[domain] {
+			return true
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return false
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// disposableDomains are well known throwaway email services.
+var disposableDomains = map[string]bool{
+	"10minutemail.com":       true,
+	"10minutemail.net":       true,
+	"20minutemail.com":       true,
+	"33mail.com":             true,
+	"anonbox.net":            true,
+	"burnermail.io":          true,
+	"discard.email":          true,
+	"dispostable.com":        true,
+	"dropmail.me":            true,
+	"emailondeck.com":        true,
+	"fakeinbox.com":          true,
+	"fakemail.net":           true,
+	"getairmail.com":         true,
+	"getnada.com":            true,
+	"guerrillamail.biz":      true,
+	"guerrillamail.com":      true,
+	"guerrillamail.de":       true,
+	"guerrillamail.info":     true,
+	"guerrillamail.net":      true,
+	"guerrillamail.org":      true,
+	"guerrillamailblock.com": true,
+	"harakirimail.com":       true,
+	"incognitomail.org":      true,
+	"jetable.org":            true,
+	"mailcatch.com":          true,
+	"maildrop.cc":            true,
+	"mailinator.com":         true,
+	"mailinator.net":         true,
+	"mailnesia.com":          true,
+	"mailsac.com":            true,
+	"mintemail.com":          true,
+	"mohmal.com":             true,
+	"moakt.com":              true,
+	"mytemp.email":           true,
+	"mytrashmail.com":        true,
+	"nada.email":             true,
+	"sharklasers.com":        true,
+	"spam4.me":               true,
+	"spambox.us":             true,
+	"spamgourmet.com":        true,
+	"spamex.com":             true,
+	"tempail.com":            true,
+	"tempinbox.com":          true,
+	"tempmail.net":           true,
+	"tempmailo.com":          true,
+	"temp-mail.io":           true,
+	"temp-mail.org":          true,
+	"tempr.email":            true,
+	"throwawaymail.com":      true,
+	"trashmail.com":          true,
+	"trashmail.de":           true,
+	"trashmail.net":          true,
+	"yopmail.com":            true,
+	"yopmail.fr":             true,
+	"yopmail.net":            true,
+}
@@ -0,0 +1,81 @@
+package account
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+func TestSignupPolicyCheckEmail(t *testing.T) {
+	p := &SignupPolicy{
+		AllowedDomains:  []string{"example.com", "mailinator.com"},
+		BlockedDomains:  []string{"contractors.example.com"},
+		BlockDisposable: true}
+	for email, ok := range map[string]bool{
+		"a@example.com":               true,
+		"a@eu.example.com":            true,
+		"a@notexample.com":            false,
+		"a@contractors.example.com":   false,
+		"a@mailinator.com":            false,
+		"a@other.org":                 false,
+		"a@x.contractors.example.com": false,
+		"a@sub.example.com.evil.org":  false,
+	} {
+		if msg := p.checkEmail(email); (msg == "") != ok {
+			t.Errorf("checkEmail(%v) = %q, want allowed %v", email, msg, ok)
+		}
+	}
+
+	p = &SignupPolicy{BlockDisposable: true}
+	if msg := p.checkEmail("a@mx.yopmail.com"); msg == "" {
+		t.Errorf("Expected subdomains of disposable services to be refused")
+	}
+	if msg := p.checkEmail("a@gmail.com"); msg != "" {
+		t.Errorf("Expected gmail.com to be allowed, got %q", msg)
+	}
+}
+
+func TestSignupPolicyCheckForm(t *testing.T) {
+	f := newSignupForm()
+	f.Email = "a@b.com"
+	p := &SignupPolicy{Mode: SignupClosed}
+	if p.checkForm(f) || f.Errors["Signup"] == "" {
+		t.Errorf("Expected closed signup to refuse the form")
+	}
+	f = newSignupForm()
+	f.Email = "a@b.com"
+	p = &SignupPolicy{BlockedDomains: []string{"b.com"}}
+	if p.checkForm(f) || f.Errors["Email"] == "" {
+		t.Errorf("Expected blocked domain to refuse the form")
+	}
+}
+
+func TestPolicyHookRunsFirst(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	am := NewAccountManager(sessions.NewCookieStore([]byte("secret")), db,
+		"http://localhost", NewFacebookClient("", ""))
+	am.SetSignupPolicy(SignupPolicy{BlockedDomains: []string{"b.com"}})
+	hooked := false
+	am.OnSignup(func(u *User, r *http.Request) error {
+		hooked = true
+		return nil
+	})
+	if err := am.CreateRoutes(mux.NewRouter().PathPrefix("/account").Subrouter()); err != nil {
+		t.Fatal(err)
+	}
+	// Provider signups don't go through the form checks.
+	if err := am.hooks.run(signupHook, newUser("a@b.com"), httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Errorf("Expected the blocked domain to be vetoed")
+	}
+	if hooked {
+		t.Errorf("Expected the host hook not to run for a refused signup")
+	}
+}
@@ -0,0 +1,119 @@
+package account
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+// Suspension blocks a user from logging in without deleting their data.
+// Suspensions with an Until time lift themselves once it passes.
+type Suspension struct {
+	Reason  string
+	ActorID int64
+	Until   time.Time
+}
+
+// Indefinite reports whether the suspension lasts until lifted by an admin.
+func (s *Suspension) Indefinite() bool {
+	return s.Until.IsZero()
+}
+
+const suspensionColumns = "suspended, suspension_reason, suspended_by, suspended_until"
+
+// suspensionRow holds the suspension columns of a Users row as scanned.
+type suspensionRow struct {
+	suspended bool
+	reason    string
+	actorID   int64
+	until     int64
+}
+
+// suspension returns the suspension in force, or nil if there is none or it
+// has run out.
+func (sr suspensionRow) suspension() *Suspension {
+	if !sr.suspended {
+		return nil
+	}
+	s := &Suspension{Reason: sr.reason, ActorID: sr.actorID}
+	if sr.until != 0 {
+		s.Until = time.Unix(sr.until, 0)
+		if !time.Now().Before(s.Until) {
+			return nil
+		}
+	}
+	return s
+}
+
+// Suspension returns the suspension in force for the user, or nil.
+func (u *User) Suspension() *Suspension {
+	return u.suspension
+}
+
+func (u *User) Suspended() bool {
+	return u.suspension != nil
+}
+
+// suspendUser suspends the user until the given time, or indefinitely for a
+// zero time, and logs them out everywhere.
+func suspendUser(db *sql.DB, userID, actorID int64, reason string, until time.Time) error {
+	var u int64
+	if !until.IsZero() {
+		u = until.Unix()
+	}
+	_, err := db.Exec(
+		"UPDATE Users SET suspended = 1, suspension_reason = ?, suspended_by = ?, suspended_until = ? WHERE id = ?",
+		reason, actorID, u, userID)
+	if err != nil {
+		return err
+	}
+	return deleteUserSessions(db, userID)
+}
+
+func liftSuspension(db *sql.DB, userID int64) error {
+	_, err := db.Exec(
+		"UPDATE Users SET suspended = 0, suspension_reason = '', suspended_by = 0, suspended_until = 0 WHERE id = ?",
+		userID)
+	return err
+}
+
+// MigrateDisabledUsers carries databases from before suspensions, when
+// users were disabled, over to suspensions as a one off migration.  The
+// disabled column becomes the suspended one, so disabled users stay
+// suspended until an admin lifts it.  It reports whether there was anything
+// to migrate, and changes nothing unless every step succeeds.
+func MigrateDisabledUsers(db *sql.DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	var n int
+	err = tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info('Users') WHERE name = 'disabled'").Scan(&n)
+	if err != nil || n == 0 {
+		tx.Rollback()
+		return false, err
+	}
+	for _, q := range []string{
+		"ALTER TABLE Users RENAME COLUMN disabled TO suspended",
+		"ALTER TABLE Users ADD COLUMN suspension_reason TEXT DEFAULT ''",
+		"ALTER TABLE Users ADD COLUMN suspended_by INTEGER DEFAULT 0",
+		"ALTER TABLE Users ADD COLUMN suspended_until INTEGER DEFAULT 0",
+	} {
+		if _, err := tx.Exec(q); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+type suspendedContext struct {
+	Suspension *Suspension
+}
+
+// renderSuspended answers a request by a suspended user with a page
+// explaining why and for how long.
+func renderSuspended(w http.ResponseWriter, r *http.Request, s *Suspension) {
+	w.WriteHeader(http.StatusForbidden)
+	pageHandler("suspended.html", &suspendedContext{s}, w, r)
+}
@@ -0,0 +1,208 @@
+package account
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var errInvalidRefreshToken = errors.New("invalid or expired refresh token")
+
+type tokenRequest struct {
+	GrantType    string `json:"grant_type"`
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// SetSigningKeys configures the keys access tokens are signed with.  The
+// first key signs, the rest remain valid for verification until removed.
+func (am *AccountManager) SetSigningKeys(keys ...*rsa.PrivateKey) {
+	am.keys.set(keys)
+}
+
+func newRefreshToken(db *sql.DB, userID int64) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	_, err := db.Exec(
+		"INSERT INTO RefreshTokens (user_id, token_hash, expiration) VALUES ($1, $2, $3)",
+		userID,
+		hashSecret(secret),
+		time.Now().Add(refreshTokenTTL).Unix())
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// useRefreshToken consumes a refresh token, returning the user it belongs to.
+// Refresh tokens are single use; the caller issues a replacement.
+func useRefreshToken(db *sql.DB, secret string) (*User, error) {
+	var userID, expiration int64
+	h := hashSecret(secret)
+	err := db.QueryRow(
+		"SELECT user_id, expiration FROM RefreshTokens WHERE token_hash = ?", h).
+		Scan(&userID, &expiration)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidRefreshToken
+	} else if err != nil {
+		return nil, err
+	}
+	r, err := db.Exec("DELETE FROM RefreshTokens WHERE token_hash = ?", h)
+	if err != nil {
+		return nil, err
+	}
+	// A concurrent request may have used the token first.
+	if n, err := r.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 || time.Now().Unix() >= expiration {
+		return nil, errInvalidRefreshToken
+	}
+	return loadUserByID(db, userID)
+}
+
+func (am AccountManager) issueTokens(u *User) (*tokenResponse, error) {
+	at, err := am.keys.newAccessToken(am.serverAddr, u)
+	if err != nil {
+		return nil, err
+	}
+	rt, err := newRefreshToken(am.db, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenResponse{
+		AccessToken:  at,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(accessTokenTTL / time.Second),
+		RefreshToken: rt}, nil
+}
+
+// apiToken exchanges either credentials or a refresh token for a new access
+// and refresh token pair.
+func (am AccountManager) apiToken(w http.ResponseWriter, r *http.Request) {
+	req := &tokenRequest{}
+	if !decodeJSON(w, r, req) {
+		return
+	}
+
+	var u *User
+	var err error
+	switch req.GrantType {
+	case "password":
+		u, err = loadUserByLogin(am.db, req.Email)
+		if err != nil {
+			audit(am.db, r, 0, 0, auditLoginFailed, map[string]string{"email": req.Email})
+			writeJSONError(w, http.StatusUnauthorized, "Invalid username/password", nil)
+			return
+		}
+		cp, err := u.isCorrectPassword(am.db, req.Password)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+			return
+		}
+		if !cp {
+			audit(am.db, r, 0, u.ID, auditLoginFailed, nil)
+			writeJSONError(w, http.StatusUnauthorized, "Invalid username/password", nil)
+			return
+		}
+		if u.Suspended() {
+			audit(am.db, r, u.ID, u.ID, auditLoginBlocked, nil)
+			writeJSONError(w, http.StatusForbidden, "This account has been suspended", nil)
+			return
+		}
+		if err := am.hooks.run(loginHook, u, r); err != nil {
+			writeJSONError(w, http.StatusForbidden, err.Error(), nil)
+			return
+		}
+		if err := cancelDeletion(am.db, r, u); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+			return
+		}
+		audit(am.db, r, u.ID, u.ID, auditLogin, map[string]string{"method": "token"})
+	case "refresh_token":
+		u, err = useRefreshToken(am.db, req.RefreshToken)
+		if err == nil && u.Suspended() {
+			err = errInvalidRefreshToken
+		}
+		if err == errInvalidRefreshToken {
+			writeJSONError(w, http.StatusUnauthorized, err.Error(), nil)
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusBadRequest, "unsupported grant_type", nil)
+		return
+	}
+
+	tr, err := am.issueTokens(u)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, tr)
+}
+
+func (am AccountManager) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := am.keys.jwks()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// RequireAccessTokenMiddleware is RequireUserMiddleware for native clients.
+// Requests must carry an access token from the token endpoint in the
+// Authorization header; anything else, or a token of a suspended user, is
+// answered with 401.
+func (am AccountManager) RequireAccessTokenMiddleware() func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, err := am.userFromAccessToken(bearerToken(r))
+			if err == nil && u.Suspended() {
+				err = errAccountSuspended
+			}
+			if err == errInvalidAccessToken || err == errAccountSuspended {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			h.ServeHTTP(w, withUser(r, u))
+		})
+	}
+}
+
+func (am AccountManager) userFromAccessToken(tok string) (*User, error) {
+	if tok == "" {
+		return nil, errInvalidAccessToken
+	}
+	id, err := am.keys.parseAccessToken(am.serverAddr, tok)
+	if err != nil {
+		return nil, err
+	}
+	u, err := loadUserByID(am.db, id)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidAccessToken
+	}
+	return u, err
+}
@@ -0,0 +1,133 @@
+package account
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessTokenRotation(t *testing.T) {
+	k1, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := &keySet{}
+	ks.set([]*rsa.PrivateKey{k1})
+	u := &User{ID: 7, Email: "a@b.com"}
+	tok, err := ks.newAccessToken("http://localhost", u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := ks.parseAccessToken("http://localhost", tok); err != nil || id != 7 {
+		t.Errorf("Expected token for user 7, got %v %v", id, err)
+	}
+	if _, err := ks.parseAccessToken("http://other", tok); err != errInvalidAccessToken {
+		t.Errorf("Expected wrong issuer to be rejected, got %v", err)
+	}
+	if _, err := ks.parseAccessToken("http://localhost", tok[:len(tok)-2]); err != errInvalidAccessToken {
+		t.Errorf("Expected bad signature to be rejected, got %v", err)
+	}
+
+	// ID tokens are signed with the same keys but aren't access tokens.
+	idTok, err := ks.sign(&idClaims{Issuer: "http://localhost", Subject: "7", Audience: "client",
+		ExpiresAt: time.Now().Add(time.Minute).Unix(), Nonce: "n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.parseAccessToken("http://localhost", idTok); err != errInvalidAccessToken {
+		t.Errorf("Expected ID token to be rejected, got %v", err)
+	}
+
+	// Rotating in a new key keeps old tokens valid until the old key goes.
+	ks.set([]*rsa.PrivateKey{k2, k1})
+	if _, err := ks.parseAccessToken("http://localhost", tok); err != nil {
+		t.Errorf("Expected token signed by old key to verify, got %v", err)
+	}
+	if s, _ := ks.jwks(); len(s.Keys) != 2 {
+		t.Errorf("Expected both keys published, got %v", len(s.Keys))
+	}
+	ks.set([]*rsa.PrivateKey{k2})
+	if _, err := ks.parseAccessToken("http://localhost", tok); err != errInvalidAccessToken {
+		t.Errorf("Expected token signed by removed key to fail, got %v", err)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("some@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal("Failed to insert user")
+	}
+	rt, err := newRefreshToken(db, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := useRefreshToken(db, rt)
+	if err != nil || u2.ID != u.ID {
+		t.Fatalf("Expected refresh token user, got %v %v", u2, err)
+	}
+	if _, err := useRefreshToken(db, rt); err != errInvalidRefreshToken {
+		t.Errorf("Expected refresh token to be single use, got %v", err)
+	}
+}
+
+func TestRequireAccessTokenMiddleware(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("some@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal("Failed to insert user")
+	}
+	am := NewAccountManager(nil, db, "http://localhost", NewFacebookClient("", ""))
+	tr, err := am.issueTokens(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := am.RequireAccessTokenMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ru, _ := UserFromRequest(nil, r); ru == nil || ru.ID != u.ID {
+			t.Errorf("Expected token user in request, got %v", ru)
+		}
+	}))
+
+	r := httptest.NewRequest("GET", "/private", nil)
+	r.Header.Set("Authorization", "Bearer "+tr.AccessToken)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/private", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %v", w.Code)
+	}
+
+	if err := suspendUser(db, u.ID, u.ID, "spam", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for suspended user, got %v", w.Code)
+	}
+}
@@ -1,10 +1,12 @@
 package account
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/gob"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"time"
 
@@ -17,6 +19,22 @@ const (
 	UserKey = "USER"
 )
 
+var (
+	errAccountSuspended = errors.New("account suspended")
+	errEmailUnverified  = errors.New("an account was registered with this address without verifying it, so it can not be logged in to through a provider")
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	scopesContextKey
+	oauthClientContextKey
+	impersonatorContextKey
+	invitationContextKey
+	orgContextKey
+)
+
 // TODO: make hash and algo private
 // Add field to keep track if user was loaded from db.
 // loading user from session sets field to false and fields lazy loaded
@@ -24,9 +42,15 @@ const (
 type User struct {
 	ID               int64
 	Email            string
+	Username         string
+	EmailVerified    bool
+	suspension       *Suspension
+	deletionDue      time.Time
 	passwordHash     []byte
 	passwordAlgo     string
 	isPasswordLoaded bool
+
+	Profile
 }
 
 type authUser struct {
@@ -36,6 +60,10 @@ type authUser struct {
 	authType        string
 	token           string
 	tokenExpiration time.Time
+	// linked is set when the identity was linked to the user by this login,
+	// and created when the user was created by it too.
+	linked  bool
+	created bool
 }
 
 func newUser(email string) *User {
@@ -51,15 +79,40 @@ func newAuthUser(user *User, authID int64, authType, token string, tokenExpirati
 		tokenExpiration: tokenExpiration}
 }
 
+// loadUserByEmail returns the user with the given primary address, or with
+// it among their verified addresses.
 func loadUserByEmail(db *sql.DB, email string) (*User, error) {
-	u := newUser(email)
-	err := db.QueryRow(
-		"SELECT id, password_hash, password_algo FROM Users WHERE email = ?",
-		email).
-		Scan(&u.ID, &u.passwordHash, &u.passwordAlgo)
+	return loadUserByAddress(db, email, "email = ?")
+}
+
+// loadUserByVerifiedEmail is loadUserByEmail for logins that trust the
+// address, such as through a provider, which must not be handed accounts
+// that registered it without verifying it.
+func loadUserByVerifiedEmail(db *sql.DB, email string) (*User, error) {
+	return loadUserByAddress(db, email, "(email = ? AND email_verified = 1)")
+}
+
+func loadUserByAddress(db *sql.DB, email, primary string) (*User, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	u := &User{}
+	var sr suspensionRow
+	var deletion int64
+	err = db.QueryRow(
+		"SELECT id, email, IFNULL(username, ''), email_verified, password_hash, password_algo, deletion_scheduled, "+
+			suspensionColumns+", "+profileColumns+
+			" FROM Users WHERE "+primary+" OR id = (SELECT user_id FROM UserEmails WHERE email = ? AND verified = 1)",
+		email, email).
+		Scan(&u.ID, &u.Email, &u.Username, &u.EmailVerified, &u.passwordHash, &u.passwordAlgo, &deletion,
+			&sr.suspended, &sr.reason, &sr.actorID, &sr.until,
+			&u.DisplayName, &u.AvatarURL, &u.Locale, &u.Timezone, &u.Bio)
 	if err != nil {
 		return nil, err
 	}
+	u.suspension = sr.suspension()
+	u.setDeletionScheduled(deletion)
 	u.isPasswordLoaded = true
 	return u, nil
 }
@@ -67,13 +120,20 @@ func loadUserByEmail(db *sql.DB, email string) (*User, error) {
 func loadUserByID(db *sql.DB, id int64) (*User, error) {
 	u := &User{}
 	u.ID = id
+	var sr suspensionRow
+	var deletion int64
 	err := db.QueryRow(
-		"SELECT email, password_hash, password_algo FROM Users WHERE id = ?",
+		"SELECT email, IFNULL(username, ''), email_verified, password_hash, password_algo, deletion_scheduled, "+
+			suspensionColumns+", "+profileColumns+" FROM Users WHERE id = ?",
 		id).
-		Scan(&u.Email, &u.passwordHash, &u.passwordAlgo)
+		Scan(&u.Email, &u.Username, &u.EmailVerified, &u.passwordHash, &u.passwordAlgo, &deletion,
+			&sr.suspended, &sr.reason, &sr.actorID, &sr.until,
+			&u.DisplayName, &u.AvatarURL, &u.Locale, &u.Timezone, &u.Bio)
 	if err != nil {
 		return nil, err
 	}
+	u.suspension = sr.suspension()
+	u.setDeletionScheduled(deletion)
 	u.isPasswordLoaded = true
 	return u, nil
 }
@@ -99,35 +159,72 @@ func loadUserByAuth(db *sql.DB, authID int64, authType string) (*authUser, error
 	return au, nil
 }
 
-func createUserByAuth(db *sql.DB, authID int64, authType, token, email string,
-	tokenExpiration time.Time) (*authUser, error) {
-	tx, err := db.Begin()
+// loadAuthUsers returns the external identities linked to u.
+func loadAuthUsers(db *sql.DB, u *User) ([]*authUser, error) {
+	rows, err := db.Query(
+		"SELECT id, auth_id, type, token, expiration FROM Auth WHERE user_id = ? ORDER BY id",
+		u.ID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+	var aus []*authUser
+	for rows.Next() {
+		au := &authUser{user: u}
+		var expiration int64
+		if err := rows.Scan(&au.id, &au.authID, &au.authType, &au.token, &expiration); err != nil {
+			return nil, err
+		}
+		au.tokenExpiration = time.Unix(expiration, 0)
+		aus = append(aus, au)
+	}
+	return aus, rows.Err()
+}
 
-	u, err := loadUserByEmail(db, email)
+func createUserByAuth(db *sql.DB, authID int64, authType, token, email string,
+	tokenExpiration time.Time) (*authUser, error) {
+	if n, err := normalizeEmail(email); err == nil {
+		email = n
+	}
+	created := false
+	u, err := loadUserByVerifiedEmail(db, email)
+	if err == sql.ErrNoRows {
+		if _, err := loadUserByEmail(db, email); err == nil {
+			return nil, errEmailUnverified
+		}
+	}
 	if err != nil {
 		u = newUser(email)
+		// The provider has already verified the address.
+		u.EmailVerified = true
 		err = u.insert(db)
 		if err != nil {
-			tx.Rollback()
 			return nil, err
 		}
+		created = true
 	}
 
 	au := newAuthUser(u, authID, authType, token, tokenExpiration)
 	err = au.insert(db)
 	if err != nil {
-		tx.Rollback()
+		if created {
+			deleteUser(db, u.ID)
+		}
 		return nil, err
 	}
+	au.linked = true
+	au.created = created
+	return au, nil
+}
 
-	err = tx.Commit()
-	if err != nil {
-		return nil, err
+// unlink undoes the login that linked the identity, deleting the user too if
+// the login created them.
+func (au *authUser) unlink(db *sql.DB) error {
+	if au.created {
+		return undoSignup(db, au.user.ID)
 	}
-	return au, nil
+	_, err := db.Exec("DELETE FROM Auth WHERE id = ?", au.id)
+	return err
 }
 
 func getOrInsertAuthUser(db *sql.DB, authID int64, authType, token, email string,
@@ -139,6 +236,12 @@ func getOrInsertAuthUser(db *sql.DB, authID int64, authType, token, email string
 }
 
 func UserFromRequest(store sessions.Store, r *http.Request) (*User, error) {
+	// Middleware attaches users authenticated by a bearer token, or whose
+	// session it checked against the database, to the request.  Suspended
+	// users are never attached, and suspending a user ends their sessions.
+	if u, ok := r.Context().Value(userContextKey).(*User); ok {
+		return u, nil
+	}
 	s, err := store.Get(r, Session)
 	if err != nil {
 		return nil, err
@@ -156,6 +259,18 @@ func UserFromRequest(store sessions.Store, r *http.Request) (*User, error) {
 	return u, nil
 }
 
+// withUser returns a copy of r carrying the user resolved by middleware, so
+// that later handlers need not authenticate the request again.
+func withUser(r *http.Request, u *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, u))
+}
+
+// withScopes returns a copy of r limited to the scopes granted to the token
+// that authenticated it.
+func withScopes(r *http.Request, scopes []string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), scopesContextKey, scopes))
+}
+
 func (au *authUser) insert(db *sql.DB) error {
 	r, err := db.Exec(
 		"INSERT INTO Auth (user_id, auth_id, type, token, expiration) VALUES ($1, $2, $3, $4, $5)",
@@ -174,29 +289,121 @@ func (au *authUser) insert(db *sql.DB) error {
 	return nil
 }
 
-func (u User) saveToSession(store sessions.Store, w http.ResponseWriter, r *http.Request) error {
+func (u User) saveToSession(db *sql.DB, store sessions.Store, w http.ResponseWriter, r *http.Request) error {
 	session, err := store.Get(r, Session)
 	if err != nil {
 		return err
 	}
+	us, err := newUserSession(db, &u, r)
+	if err != nil {
+		return err
+	}
 	session.Values[UserKey] = u
+	session.Values[sessionIDKey] = us.key
+	// A login ends any impersonation left behind in the cookie.
+	delete(session.Values, impersonatorKey)
+	delete(session.Values, impersonatorSIDKey)
 	return session.Save(r, w)
 }
 
 func (u *User) insert(db *sql.DB) error {
-	r, err := db.Exec(
-		"INSERT INTO Users (email, password_hash, password_algo) VALUES ($1, $2, $3)",
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	r, err := tx.Exec(
+		"INSERT INTO Users (email, username, email_verified, password_hash, password_algo) VALUES ($1, $2, $3, $4, $5)",
 		u.Email,
+		sql.NullString{String: u.Username, Valid: u.Username != ""},
+		u.EmailVerified,
 		u.passwordHash,
 		u.passwordAlgo)
 
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if u.ID, err = r.LastInsertId(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	// The address may already be another user's secondary one.
+	if err := insertUserEmail(tx, u); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func setEmailVerified(db *sql.DB, userID int64) error {
+	_, err := db.Exec("UPDATE Users SET email_verified = 1 WHERE id = ?", userID)
 	if err != nil {
 		return err
 	}
-	u.ID, err = r.LastInsertId()
+	_, err = db.Exec(
+		"UPDATE UserEmails SET verified = 1, token_hash = NULL, expiration = 0 WHERE email = (SELECT email FROM Users WHERE id = ?)",
+		userID)
 	return err
 }
 
+// userAddresses selects every address the user $1 has been known by, lower
+// cased for matching audit metadata.
+const userAddresses = `SELECT lower(email) FROM Users WHERE id = $1
+	UNION SELECT lower(email) FROM UserEmails WHERE user_id = $1
+	UNION SELECT lower(old_email) FROM EmailChanges WHERE user_id = $1
+	UNION SELECT lower(new_email) FROM EmailChanges WHERE user_id = $1`
+
+// deleteUser removes the user and everything linked to them, including
+// OAuth clients they registered.  Audit events and webhook deliveries are
+// kept, but stripped of the user's addresses and where they connected from.
+func deleteUser(db *sql.DB, userID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, q := range []string{
+		"UPDATE AuditEvents SET ip = '', user_agent = '' WHERE user_id = $1 OR actor_id = $1",
+		// Failed logins are recorded against no user, with the address tried.
+		"UPDATE AuditEvents SET metadata = json_remove(metadata, '$.email'), ip = '', user_agent = '' WHERE user_id = $1 OR lower(trim(json_extract(metadata, '$.email'))) IN (" + userAddresses + ")",
+		"UPDATE WebhookDeliveries SET payload = json_remove(payload, '$.user.email', '$.user.username') WHERE json_extract(payload, '$.user.id') = $1",
+	} {
+		if _, err := tx.Exec(q, userID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, q := range []string{
+		"DELETE FROM OAuthTokens WHERE user_id = ? OR client_id IN (SELECT client_id FROM OAuthClients WHERE owner_id = ?)",
+		"DELETE FROM OAuthCodes WHERE user_id = ? OR client_id IN (SELECT client_id FROM OAuthClients WHERE owner_id = ?)",
+	} {
+		if _, err := tx.Exec(q, userID, userID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, q := range []string{
+		"DELETE FROM OAuthClients WHERE owner_id = ?",
+		"DELETE FROM Auth WHERE user_id = ?",
+		"DELETE FROM EmailChanges WHERE user_id = ?",
+		"DELETE FROM UserEmails WHERE user_id = ?",
+		"DELETE FROM ApiTokens WHERE user_id = ?",
+		"DELETE FROM RefreshTokens WHERE user_id = ?",
+		"DELETE FROM Sessions WHERE user_id = ?",
+		"DELETE FROM UserRoles WHERE user_id = ?",
+		"DELETE FROM UserSettings WHERE user_id = ?",
+		"DELETE FROM Invitations WHERE inviter_id = ?",
+		"DELETE FROM OrgMembers WHERE user_id = ?",
+		"DELETE FROM OrgJoinRequests WHERE user_id = ?",
+		"DELETE FROM Users WHERE id = ?",
+	} {
+		if _, err := tx.Exec(q, userID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (u *User) setPassword(password string) error {
 	ph, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -223,7 +430,6 @@ func (u *User) changePassword(db *sql.DB, p string) error {
 func (u *User) isCorrectPassword(db *sql.DB, p string) (bool, error) {
 	// For auth users with no set password, do not allow empty string comparison.
 	hp, err := u.HasPassword(db)
-	log.Printf("Has password %v %v", hp, err)
 	if err != nil {
 		return false, err
 	}
@@ -256,6 +462,31 @@ func (u *User) HasPassword(db *sql.DB) (bool, error) {
 	return true, nil
 }
 
+// cookieUser is what of a User goes into the session cookie.  The rest,
+// the profile especially, could overflow the cookie and is loaded from the
+// database by the middleware instead.
+type cookieUser struct {
+	ID            int64
+	Email         string
+	Username      string
+	EmailVerified bool
+}
+
+func (u User) GobEncode() ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(cookieUser{u.ID, u.Email, u.Username, u.EmailVerified})
+	return b.Bytes(), err
+}
+
+func (u *User) GobDecode(data []byte) error {
+	var su cookieUser
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&su); err != nil {
+		return err
+	}
+	*u = User{ID: su.ID, Email: su.Email, Username: su.Username, EmailVerified: su.EmailVerified}
+	return nil
+}
+
 func init() {
 	gob.Register(&User{})
 }
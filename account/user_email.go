@@ -0,0 +1,406 @@
+package account
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/schema"
+	"github.com/gorilla/sessions"
+)
+
+// emailVerificationTTL is how long a link verifying an address stays valid.
+const emailVerificationTTL = 24 * time.Hour
+
+var (
+	errInvalidEmailVerification = errors.New("invalid or expired verification link")
+	errEmailNotVerified         = errors.New("email address not verified")
+)
+
+// userEmail is one of the addresses of a user.  Users.email holds the
+// primary one, which notifications go to; every address, the primary
+// included, has a UserEmails row so addresses are unique across accounts.
+type userEmail struct {
+	Email    string
+	Verified bool
+	Primary  bool
+}
+
+// insertUserEmail records the primary address of a newly inserted user.
+func insertUserEmail(tx *sql.Tx, u *User) error {
+	if err := checkEmailReserved(tx, u.Email, u.ID); err != nil {
+		return err
+	}
+	if err := releaseUnverifiedEmail(tx, u.Email, u.ID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(
+		"INSERT INTO UserEmails (user_id, email, verified) VALUES ($1, $2, $3)",
+		u.ID, u.Email, u.EmailVerified)
+	return err
+}
+
+func loadUserEmails(db *sql.DB, userID int64) ([]*userEmail, error) {
+	rows, err := db.Query(
+		"SELECT e.email, e.verified, e.email = u.email FROM UserEmails e JOIN Users u ON u.id = e.user_id WHERE e.user_id = ? ORDER BY e.id",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var es []*userEmail
+	for rows.Next() {
+		e := &userEmail{}
+		if err := rows.Scan(&e.Email, &e.Verified, &e.Primary); err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+	}
+	return es, rows.Err()
+}
+
+// releaseUnverifiedEmail gives up email where others added it as an
+// unverified secondary address, so they can't keep whoever owns it from
+// using it.  Only the owner can verify it, so nothing of theirs is lost.
+func releaseUnverifiedEmail(q interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, email string, userID int64) error {
+	_, err := q.Exec(
+		"DELETE FROM UserEmails WHERE email = ? AND user_id != ? AND verified = 0 AND NOT EXISTS (SELECT 1 FROM Users WHERE Users.id = UserEmails.user_id AND Users.email = UserEmails.email)",
+		email, userID)
+	return err
+}
+
+// addUserEmail adds an unverified address to the user and returns the secret
+// verifying it.  Others' unverified claims to the address are given up, as
+// is the user's own once its link expired.
+func addUserEmail(db *sql.DB, userID int64, email string) (string, error) {
+	secret, err := randomSecret("")
+	if err != nil {
+		return "", err
+	}
+	if err := releaseUnverifiedEmail(db, email, userID); err != nil {
+		return "", err
+	}
+	_, err = db.Exec(
+		"DELETE FROM UserEmails WHERE user_id = ? AND email = ? AND verified = 0 AND expiration != 0 AND expiration < ?",
+		userID, email, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	if err := checkEmailReserved(db, email, userID); err != nil {
+		return "", err
+	}
+	_, err = db.Exec(
+		"INSERT INTO UserEmails (user_id, email, token_hash, expiration) VALUES ($1, $2, $3, $4)",
+		userID, email, hashSecret(secret), time.Now().Add(emailVerificationTTL).Unix())
+	if isExistingUserError(err) {
+		return "", errEmailInUse
+	} else if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// renewEmailVerification returns a new secret verifying one of the user's
+// unverified addresses.  It doesn't extend the time an added address has to
+// be verified in; once that passes the address has to be added again.  An
+// unverified primary address, which has no such time, is given one.
+func renewEmailVerification(db *sql.DB, userID int64, email string) (string, error) {
+	secret, err := randomSecret("")
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	r, err := db.Exec(
+		"UPDATE UserEmails SET token_hash = ?, expiration = CASE expiration WHEN 0 THEN ? ELSE expiration END WHERE user_id = ? AND email = ? AND verified = 0 AND (expiration = 0 OR expiration > ?)",
+		hashSecret(secret), now.Add(emailVerificationTTL).Unix(), userID, email, now.Unix())
+	if err != nil {
+		return "", err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		return "", sql.ErrNoRows
+	}
+	return secret, nil
+}
+
+// verifyUserEmail marks the address secret was sent to as verified,
+// returning the user it belongs to.
+func verifyUserEmail(db *sql.DB, secret string) (int64, string, error) {
+	var userID, expiration int64
+	var email string
+	err := db.QueryRow(
+		"SELECT user_id, email, expiration FROM UserEmails WHERE token_hash = ? AND verified = 0",
+		hashSecret(secret)).Scan(&userID, &email, &expiration)
+	if err == sql.ErrNoRows || (err == nil && time.Now().After(time.Unix(expiration, 0))) {
+		return 0, "", errInvalidEmailVerification
+	} else if err != nil {
+		return 0, "", err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	_, err = tx.Exec(
+		"UPDATE UserEmails SET verified = 1, token_hash = NULL, expiration = 0 WHERE user_id = ? AND email = ?",
+		userID, email)
+	if err != nil {
+		tx.Rollback()
+		return 0, "", err
+	}
+	_, err = tx.Exec("UPDATE Users SET email_verified = 1 WHERE id = ? AND email = ?", userID, email)
+	if err != nil {
+		tx.Rollback()
+		return 0, "", err
+	}
+	return userID, email, tx.Commit()
+}
+
+// setPrimaryEmail makes one of the user's verified addresses their primary.
+// Like a change of address it may be reverted from the old primary until
+// the change expires, and is refused while an earlier change can still be
+// reverted.  It returns the change and the secret reverting it.
+func setPrimaryEmail(db *sql.DB, u *User, email string) (*emailChange, string, error) {
+	if rc, err := loadRevertableEmailChange(db, u.ID); err != nil {
+		return nil, "", err
+	} else if rc != nil {
+		return nil, "", errEmailChangedRecently
+	}
+	revert, err := randomSecret("")
+	if err != nil {
+		return nil, "", err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	r, err := tx.Exec(
+		"UPDATE Users SET email = ?, email_verified = 1 WHERE id = ? AND email = ? AND EXISTS (SELECT 1 FROM UserEmails WHERE user_id = ? AND email = ? AND verified = 1)",
+		email, u.ID, u.Email, u.ID, email)
+	if isExistingUserError(err) {
+		tx.Rollback()
+		return nil, "", errEmailInUse
+	} else if err != nil {
+		tx.Rollback()
+		return nil, "", err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		tx.Rollback()
+		return nil, "", err
+	} else if n == 0 {
+		tx.Rollback()
+		return nil, "", errEmailNotVerified
+	}
+	c := &emailChange{UserID: u.ID, OldEmail: u.Email, NewEmail: email,
+		Expiration: time.Now().Add(emailRevertTTL)}
+	r, err = tx.Exec(
+		"INSERT INTO EmailChanges (user_id, old_email, new_email, revert_hash, confirmed, expiration) VALUES ($1, $2, $3, $4, 1, $5)",
+		c.UserID, c.OldEmail, c.NewEmail, hashSecret(revert), c.Expiration.Unix())
+	if err != nil {
+		tx.Rollback()
+		return nil, "", err
+	}
+	if c.ID, err = r.LastInsertId(); err != nil {
+		tx.Rollback()
+		return nil, "", err
+	}
+	return c, revert, tx.Commit()
+}
+
+// removeUserEmail removes one of the user's addresses other than the
+// primary.
+func removeUserEmail(db *sql.DB, userID int64, email string) error {
+	_, err := db.Exec(
+		"DELETE FROM UserEmails WHERE user_id = ? AND email = ? AND email != (SELECT email FROM Users WHERE id = ?)",
+		userID, email, userID)
+	return err
+}
+
+type userEmailsForm struct {
+	Email    string
+	Action   string
+	Password string
+	Token    string `schema:"csrf_token"`
+}
+
+type userEmailsContext struct {
+	Form        *userEmailsForm
+	Emails      []*userEmail
+	HasPassword bool
+	Error       string
+	Message     string
+}
+
+func (c *userEmailsContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+type userEmailsHandler struct {
+	db     *sql.DB
+	s      sessions.Store
+	mailer Mailer
+	// base is the absolute url of the account routes, for links in emails.
+	base string
+}
+
+func newUserEmailsHandler(db *sql.DB, s sessions.Store, m Mailer, base string) *userEmailsHandler {
+	return &userEmailsHandler{db, s, m, base}
+}
+
+func (h userEmailsHandler) render(w http.ResponseWriter, r *http.Request, u *User, errMsg, msg string) {
+	es, err := loadUserEmails(h.db, u.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hp, err := u.HasPassword(h.db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateHandler("emails.html", &userEmailsContext{
+		Form:        &userEmailsForm{},
+		Emails:      es,
+		HasPassword: hp,
+		Error:       errMsg,
+		Message:     msg}, w, r)
+}
+
+func (h userEmailsHandler) get(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	h.render(w, r, u, "", "")
+}
+
+func (h userEmailsHandler) sendVerification(email, secret string) error {
+	return h.mailer.SendMail(email, "Verify your email address",
+		"Follow this link within a day to add this address to your account:\n\n"+
+			h.base+"/verify_email?token="+url.QueryEscape(secret)+"\n")
+}
+
+func (h userEmailsHandler) post(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	f := &userEmailsForm{}
+	if err := schema.NewDecoder().Decode(f, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var errMsg, msg string
+	if f.Action == "primary" || f.Action == "remove" {
+		// As for a change of address, whoever holds the session must know
+		// the password.
+		if errMsg, err = checkPassword(h.db, u, f.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if len(errMsg) != 0 {
+			h.render(w, r, u, errMsg, "")
+			return
+		}
+	}
+	switch f.Action {
+	case "add":
+		email, nerr := normalizeEmail(f.Email)
+		if nerr != nil {
+			errMsg = "Invalid email address"
+			break
+		}
+		var secret string
+		secret, err = addUserEmail(h.db, u.ID, email)
+		if err == errEmailInUse {
+			errMsg, err = "Email address already in use", nil
+			break
+		} else if err != nil {
+			break
+		}
+		if err = h.sendVerification(email, secret); err != nil {
+			break
+		}
+		audit(h.db, r, u.ID, u.ID, auditEmailAdded, map[string]string{"email": email})
+		msg = "We sent a verification link to " + email
+	case "verify":
+		var secret string
+		secret, err = renewEmailVerification(h.db, u.ID, f.Email)
+		if err == sql.ErrNoRows {
+			errMsg, err = "That address is already verified or its link expired, add it again", nil
+			break
+		} else if err != nil {
+			break
+		}
+		if err = h.sendVerification(f.Email, secret); err != nil {
+			break
+		}
+		msg = "We sent a verification link to " + f.Email
+	case "primary":
+		var c *emailChange
+		var revert string
+		c, revert, err = setPrimaryEmail(h.db, u, f.Email)
+		if err == errEmailNotVerified {
+			errMsg, err = "Verify the address before making it your primary", nil
+			break
+		} else if err == errEmailChangedRecently {
+			errMsg, err = "Your email address was changed recently, try again later", nil
+			break
+		} else if err != nil {
+			break
+		}
+		audit(h.db, r, u.ID, u.ID, auditEmailPrimary, map[string]string{"email": f.Email})
+		msg = f.Email + " is now your primary address"
+		if merr := h.mailer.SendMail(c.OldEmail, "Your primary email address was changed",
+			"Email about your account will now be sent to "+c.NewEmail+".\n"+
+				"If it wasn't you, follow this link within a week to undo it:\n\n"+
+				h.base+"/revert_email?token="+url.QueryEscape(revert)+"\n"); merr != nil {
+			log.Printf("unable to send primary email change revert link to user %v: %v", u.ID, merr)
+		}
+	case "remove":
+		if err = removeUserEmail(h.db, u.ID, f.Email); err != nil {
+			break
+		}
+		audit(h.db, r, u.ID, u.ID, auditEmailRemoved, map[string]string{"email": f.Email})
+		msg = f.Email + " was removed"
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.render(w, r, u, errMsg, msg)
+}
+
+// verify handles the link sent to a new address.  It needs no login, as the
+// address may be opened on another device.
+func (h userEmailsHandler) verify(w http.ResponseWriter, r *http.Request) {
+	userID, email, err := verifyUserEmail(h.db, r.URL.Query().Get("token"))
+	if err == errInvalidEmailVerification {
+		w.WriteHeader(http.StatusBadRequest)
+		pageHandler("email_change_result.html", &emailChangeResultContext{Error: err.Error()}, w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.db, r, userID, userID, auditEmailVerified, map[string]string{"email": email})
+	if err := joinClaimedOrganizations(h.db, r, userID); err != nil {
+		log.Printf("unable to join user %v to organizations by domain: %v", userID, err)
+	}
+	pageHandler("email_change_result.html", &emailChangeResultContext{
+		Message: email + " has been verified"}, w, r)
+}
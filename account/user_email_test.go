@@ -0,0 +1,96 @@
+package account
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestUserEmails(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("work@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := addUserEmail(db, u.ID, "home@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadUserByEmail(db, "home@email.com"); err == nil {
+		t.Error("Expected unverified address not to identify the user")
+	}
+	if _, _, err := setPrimaryEmail(db, u, "home@email.com"); err != errEmailNotVerified {
+		t.Errorf("Expected unverified address not to become primary, got %v", err)
+	}
+	if id, _, err := verifyUserEmail(db, secret); err != nil || id != u.ID {
+		t.Fatalf("Expected address to be verified, got %v %v", id, err)
+	}
+	if u2, err := loadUserByEmail(db, "home@email.com"); err != nil || u2.ID != u.ID || u2.Email != "work@email.com" {
+		t.Errorf("Expected verified address to identify the user, got %v %v", u2, err)
+	}
+
+	other := newUser("home@email.com")
+	if err := other.insert(db); !isExistingUserError(err) {
+		t.Errorf("Expected address to be taken, got %v", err)
+	}
+
+	c, revert, err := setPrimaryEmail(db, u, "home@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.OldEmail != "work@email.com" || len(revert) == 0 {
+		t.Errorf("Expected primary change to be revertable, got %+v", c)
+	}
+	u, _ = loadUserByID(db, u.ID)
+	if _, _, err := setPrimaryEmail(db, u, "work@email.com"); err != errEmailChangedRecently {
+		t.Errorf("Expected further changes to wait, got %v", err)
+	}
+	if err := removeUserEmail(db, u.ID, "home@email.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeUserEmail(db, u.ID, "work@email.com"); err != nil {
+		t.Fatal(err)
+	}
+	es, err := loadUserEmails(db, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 || es[0].Email != "home@email.com" || !es[0].Primary {
+		t.Errorf("Expected only the primary address to be kept, got %v", es)
+	}
+}
+
+func TestUnverifiedEmailDoesNotBlockOwner(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	squatter := newUser("squatter@email.com")
+	if err := squatter.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := addUserEmail(db, squatter.ID, "owner@email.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE UserEmails SET expiration = 1 WHERE email = 'owner@email.com'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renewEmailVerification(db, squatter.ID, "owner@email.com"); err != sql.ErrNoRows {
+		t.Errorf("Expected resending not to extend an expired address, got %v", err)
+	}
+
+	owner := newUser("owner@email.com")
+	if err := owner.insert(db); err != nil {
+		t.Fatalf("Expected owner to sign up, got %v", err)
+	}
+	es, err := loadUserEmails(db, squatter.ID)
+	if err != nil || len(es) != 1 {
+		t.Errorf("Expected the unverified claim to be given up, got %v %v", es, err)
+	}
+}
@@ -3,15 +3,19 @@ package account
 import (
 	"database/sql"
 	"io/ioutil"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/sessions"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func TestSchema(t *testing.T) {
 	db, err := setupDB()
 	if err != nil {
-		t.Fatal("Failed to setup db schema %v", err)
+		t.Fatalf("Failed to setup db schema %v", err)
 	}
 	defer db.Close()
 }
@@ -35,7 +39,7 @@ func TestUserPassword(t *testing.T) {
 func TestSaveAndLoadUser(t *testing.T) {
 	db, err := setupDB()
 	if err != nil {
-		t.Fatal("Failed to setup db schema %v", err)
+		t.Fatalf("Failed to setup db schema %v", err)
 	}
 
 	u := newUser("some@email.com")
@@ -62,6 +66,58 @@ func TestSaveAndLoadUser(t *testing.T) {
 	}
 }
 
+func TestCreateUserByAuthNeedsVerifiedEmail(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("victim@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createUserByAuth(db, 42, "facebook", "token", "victim@email.com", time.Now()); err != errEmailUnverified {
+		t.Errorf("Expected an unverified account not to be linked, got %v", err)
+	}
+	if err := setEmailVerified(db, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	au, err := createUserByAuth(db, 42, "facebook", "token", "victim@email.com", time.Now())
+	if err != nil || au.created || au.user.ID != u.ID {
+		t.Errorf("Expected the verified account to be linked, got %v %v", au, err)
+	}
+}
+
+func TestSessionCookieLeavesProfileOut(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	store := sessions.NewCookieStore([]byte("secret"))
+	am := NewAccountManager(store, db, "http://localhost", NewFacebookClient("", ""))
+	u := newUser("some@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	u.Bio = strings.Repeat("x", 5000)
+
+	w := httptest.NewRecorder()
+	if err := u.saveToSession(db, store, w, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatalf("Expected a long profile to fit the cookie, got %v", err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	su, _, err := am.authenticate(r)
+	if err != nil || su == nil || su.ID != u.ID || su.Email != u.Email {
+		t.Fatalf("Expected the session to log the user in, got %v %v", su, err)
+	}
+}
+
 func setupDB() (*sql.DB, error) {
 	schema, err := ioutil.ReadFile("../db.schema")
 	if err != nil {
@@ -80,3 +136,48 @@ func setupDB() (*sql.DB, error) {
 	}
 	return db, nil
 }
+
+func TestDeleteUserScrubsPersonalData(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("Some@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal("Failed to insert user")
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "test")
+	audit(db, r, 0, 0, auditLoginFailed, map[string]string{"email": " some@EMAIL.com"})
+	audit(db, r, 0, 0, auditLoginFailed, map[string]string{"email": "other@email.com"})
+	audit(db, r, u.ID, u.ID, auditLogin, map[string]string{"method": "password"})
+	q := newWebhookQueue(db)
+	q.add(&WebhookEndpoint{URL: "http://localhost/hook"})
+	if err := q.enqueue(WebhookUserSignup, u); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deleteUser(db, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	es, _, err := loadAuditEvents(db, &auditQuery{Type: auditLoginFailed})
+	if err != nil || len(es) != 2 {
+		t.Fatalf("Expected failed logins to be kept, got %v %v", len(es), err)
+	}
+	if e := es[1]; e.Metadata["email"] != "" || e.IP != "" || e.UserAgent != "" {
+		t.Errorf("Expected the user's failed login to be scrubbed, got %+v", e)
+	}
+	if e := es[0]; e.Metadata["email"] != "other@email.com" || e.IP == "" {
+		t.Errorf("Expected other failed logins to be kept as they were, got %+v", e)
+	}
+	es, _, _ = loadAuditEvents(db, &auditQuery{UserID: u.ID})
+	if len(es) != 1 || es[0].Metadata["method"] != "password" || es[0].IP != "" {
+		t.Errorf("Expected the user's login to be kept without the ip, got %+v", es)
+	}
+	ds, _ := loadWebhookDeliveries(db, "")
+	if len(ds) != 1 || strings.Contains(ds[0].Payload, "email") {
+		t.Errorf("Expected the delivery to be kept without the address, got %+v", ds)
+	}
+}
@@ -0,0 +1,152 @@
+package account
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/schema"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	minUsernameLen = 3
+	maxUsernameLen = 32
+)
+
+var errUsernameTaken = errors.New("username taken")
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// reservedUsernames can't be chosen, as they would read as the site itself
+// or clash with paths the host may serve under a handle.
+var reservedUsernames = map[string]bool{
+	"about": true, "account": true, "admin": true, "administrator": true,
+	"api": true, "help": true, "login": true, "logout": true, "me": true,
+	"moderator": true, "oauth": true, "official": true, "root": true,
+	"security": true, "settings": true, "signup": true, "staff": true,
+	"support": true, "system": true, "user": true, "users": true,
+	"webmaster": true, "www": true,
+}
+
+// validateUsername returns why name can't be a username, or the empty
+// string if it can.
+func validateUsername(name string) string {
+	if len(name) < minUsernameLen || len(name) > maxUsernameLen {
+		return "Usernames are 3 to 32 characters long"
+	}
+	if !usernamePattern.MatchString(name) {
+		return "Usernames start with a letter and contain only letters, digits, _ and -"
+	}
+	if reservedUsernames[strings.ToLower(name)] {
+		return "That username is reserved"
+	}
+	return ""
+}
+
+// setUsername gives the user a username, which is unique regardless of
+// case.  errUsernameTaken is returned if another user has it.
+func setUsername(db *sql.DB, userID int64, name string) error {
+	_, err := db.Exec("UPDATE Users SET username = ? WHERE id = ?", name, userID)
+	if isExistingUserError(err) {
+		return errUsernameTaken
+	}
+	return err
+}
+
+// loadUserByLogin returns the user identified by what they typed into a
+// login form: an email address if it has an @, a username otherwise.
+func loadUserByLogin(db *sql.DB, login string) (*User, error) {
+	login = strings.TrimSpace(login)
+	if strings.Contains(login, "@") {
+		return loadUserByEmail(db, login)
+	}
+	var id int64
+	if err := db.QueryRow("SELECT id FROM Users WHERE username = ?", login).Scan(&id); err != nil {
+		return nil, err
+	}
+	return loadUserByID(db, id)
+}
+
+type usernameForm struct {
+	Username string
+	Token    string `schema:"csrf_token"`
+}
+
+type usernameContext struct {
+	Form    *usernameForm
+	Current string
+	// Welcome is set when the user just signed up through a provider.
+	Welcome bool
+	Error   string
+	Message string
+}
+
+func (c *usernameContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+type usernameHandler struct {
+	db *sql.DB
+	s  sessions.Store
+}
+
+func newUsernameHandler(db *sql.DB, s sessions.Store) *usernameHandler {
+	return &usernameHandler{db, s}
+}
+
+func (h usernameHandler) get(w http.ResponseWriter, r *http.Request) {
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	templateHandler("username.html", &usernameContext{
+		Form:    &usernameForm{},
+		Current: u.Username,
+		Welcome: r.URL.Query().Get("welcome") != ""}, w, r)
+}
+
+func (h usernameHandler) post(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := UserFromRequest(h.s, r)
+	if err != nil || u == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	c := &usernameContext{
+		Form:    &usernameForm{},
+		Current: u.Username,
+		Welcome: r.URL.Query().Get("welcome") != ""}
+	if err := schema.NewDecoder().Decode(c.Form, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Form.Username = strings.TrimSpace(c.Form.Username)
+	if c.Error = validateUsername(c.Form.Username); len(c.Error) != 0 {
+		templateHandler("username.html", c, w, r)
+		return
+	}
+	if err := setUsername(h.db, u.ID, c.Form.Username); err == errUsernameTaken {
+		c.Error = "That username is taken"
+		templateHandler("username.html", c, w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.db, r, u.ID, u.ID, auditUsernameChange,
+		map[string]string{"old": u.Username, "new": c.Form.Username})
+	if c.Welcome {
+		redirectAfterLogin(h.s, w, r)
+		return
+	}
+	c.Current = c.Form.Username
+	c.Message = "Username changed"
+	templateHandler("username.html", c, w, r)
+}
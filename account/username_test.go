@@ -0,0 +1,49 @@
+package account
+
+import (
+	"testing"
+)
+
+func TestValidateUsername(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"bob":         true,
+		"Bob_Smith-2": true,
+		"bo":          false,
+		"2bob":        false,
+		"bob smith":   false,
+		"bob@home":    false,
+		"Admin":       false,
+	} {
+		if msg := validateUsername(name); (msg == "") != ok {
+			t.Errorf("validateUsername(%q) = %q", name, msg)
+		}
+	}
+}
+
+func TestLoginByUsername(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	u := newUser("bob@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	other := newUser("alice@email.com")
+	if err := other.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := setUsername(db, u.ID, "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setUsername(db, other.ID, "bob"); err != errUsernameTaken {
+		t.Errorf("Expected username to be taken regardless of case, got %v", err)
+	}
+	for _, login := range []string{"bob", " BOB ", "bob@email.com"} {
+		if u2, err := loadUserByLogin(db, login); err != nil || u2.ID != u.ID || u2.Username != "Bob" {
+			t.Errorf("Expected %q to log in as bob, got %v %v", login, u2, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package account
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/schema"
+	"github.com/gorilla/sessions"
+)
+
+// waitlistInvitationTTL is how long people approved off the waitlist have
+// to sign up.
+const waitlistInvitationTTL = 14 * 24 * time.Hour
+
+// waitlistEntry is someone waiting to be let in while signup goes through
+// the waitlist.
+type waitlistEntry struct {
+	ID    int64
+	Email string
+	// Approved is zero until an admin approves the entry.
+	Approved   time.Time
+	ApprovedBy int64
+	Created    time.Time
+}
+
+// joinWaitlist adds email to the waitlist, if it isn't on it already.
+func joinWaitlist(db *sql.DB, email string) error {
+	_, err := db.Exec("INSERT OR IGNORE INTO Waitlist (email) VALUES (?)", email)
+	return err
+}
+
+func loadWaitlist(db *sql.DB, query string, args ...interface{}) ([]*waitlistEntry, error) {
+	rows, err := db.Query("SELECT id, email, approved, approved_by, created FROM Waitlist "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var es []*waitlistEntry
+	for rows.Next() {
+		e := &waitlistEntry{}
+		var approved int64
+		if err := rows.Scan(&e.ID, &e.Email, &approved, &e.ApprovedBy, &e.Created); err != nil {
+			return nil, err
+		}
+		if approved != 0 {
+			e.Approved = time.Unix(approved, 0)
+		}
+		es = append(es, e)
+	}
+	return es, rows.Err()
+}
+
+// approveWaitlistEntry lets the person waiting in, mailing them an
+// invitation bound to their address.  The entry is only marked approved once
+// the mail went out, so a failed send can be retried.
+func approveWaitlistEntry(db *sql.DB, m Mailer, base string, id int64, admin *User) (*waitlistEntry, error) {
+	es, err := loadWaitlist(db, "WHERE id = ? AND approved = 0", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(es) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	e := es[0]
+	secret, err := createInvitation(db, admin.ID, e.Email, 1, waitlistInvitationTTL)
+	if err != nil {
+		return nil, err
+	}
+	err = m.SendMail(e.Email, "You can now sign up",
+		"You are off the waitlist.  Follow this link within two weeks to create your account:\n\n"+
+			base+"/signup?invite="+url.QueryEscape(secret)+"\n")
+	if err != nil {
+		db.Exec("DELETE FROM Invitations WHERE token_hash = ?", hashSecret(secret))
+		return nil, err
+	}
+	e.Approved = time.Now()
+	e.ApprovedBy = admin.ID
+	_, err = db.Exec("UPDATE Waitlist SET approved = ?, approved_by = ? WHERE id = ?",
+		e.Approved.Unix(), admin.ID, e.ID)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func removeWaitlistEntry(db *sql.DB, id int64) error {
+	_, err := db.Exec("DELETE FROM Waitlist WHERE id = ?", id)
+	return err
+}
+
+type waitlistForm struct {
+	Email string
+	Token string `schema:"csrf_token"`
+}
+
+type adminWaitlistContext struct {
+	Form    *waitlistForm
+	Entries []*waitlistEntry
+	Message string
+}
+
+func (c *adminWaitlistContext) setToken(t string) {
+	c.Form.Token = t
+}
+
+type waitlistHandler struct {
+	db     *sql.DB
+	s      sessions.Store
+	mailer Mailer
+	policy SignupPolicy
+	// base is the absolute url of the account routes, for the signup links.
+	base string
+}
+
+func newWaitlistHandler(db *sql.DB, s sessions.Store, m Mailer, p SignupPolicy, base string) *waitlistHandler {
+	return &waitlistHandler{db, s, m, p, base}
+}
+
+// join puts the visitor on the waitlist, after the same email checks as a
+// signup.
+func (h waitlistHandler) join(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c := newSignupContext(h.policy)
+	email, err := normalizeEmail(r.PostForm.Get("email"))
+	if err != nil {
+		c.Form.Errors["Email"] = "Invalid email address"
+		templateHandler("signup.html", c, w, r)
+		return
+	}
+	c.Form.Email = email
+	if msg := h.policy.checkEmail(email); len(msg) != 0 {
+		c.Form.Errors["Email"] = msg
+		templateHandler("signup.html", c, w, r)
+		return
+	}
+	if err := joinWaitlist(h.db, email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Message = "You are on the waitlist, we will email you when you can sign up"
+	templateHandler("signup.html", c, w, r)
+}
+
+func (h waitlistHandler) renderAdmin(w http.ResponseWriter, r *http.Request, msg string) {
+	es, err := loadWaitlist(h.db, "WHERE approved = 0 ORDER BY id LIMIT ?", adminPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateHandler("admin_waitlist.html", &adminWaitlistContext{
+		Form: &waitlistForm{}, Entries: es, Message: msg}, w, r)
+}
+
+// adminList shows who has waited longest.
+func (h waitlistHandler) adminList(w http.ResponseWriter, r *http.Request) {
+	h.renderAdmin(w, r, "")
+}
+
+// adminAction approves or removes the entry given by the id field.
+func (h waitlistHandler) adminAction(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	admin, err := UserFromRequest(h.s, r)
+	if err != nil || admin == nil {
+		http.Error(w, "user not logged in", http.StatusUnauthorized)
+		return
+	}
+	f := &struct {
+		ID     int64
+		Action string
+	}{}
+	d := schema.NewDecoder()
+	d.IgnoreUnknownKeys(true)
+	if err := d.Decode(f, r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var msg string
+	switch f.Action {
+	case "approve":
+		e, err := approveWaitlistEntry(h.db, h.mailer, h.base, f.ID, admin)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(h.db, r, admin.ID, 0, auditWaitlistApproved, map[string]string{"email": e.Email})
+		msg = "Invitation sent to " + e.Email
+	case "remove":
+		if err := removeWaitlistEntry(h.db, f.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		msg = "Removed entry " + strconv.FormatInt(f.ID, 10)
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	h.renderAdmin(w, r, msg)
+}
@@ -0,0 +1,87 @@
+package account
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testMailer struct {
+	to, body []string
+	// err is returned instead of sending when set.
+	err error
+}
+
+func (m *testMailer) SendMail(to, subject, body string) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.to = append(m.to, to)
+	m.body = append(m.body, body)
+	return nil
+}
+
+func TestWaitlist(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	admin := newUser("admin@email.com")
+	if err := admin.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		// Joining twice keeps a single entry.
+		if err := joinWaitlist(db, "wait@email.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	es, err := loadWaitlist(db, "WHERE approved = 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 {
+		t.Fatalf("Expected one waitlist entry, got %v", len(es))
+	}
+
+	m := &testMailer{err: errors.New("mail server down")}
+	if _, err := approveWaitlistEntry(db, m, "http://localhost/account", es[0].ID, admin); err == nil {
+		t.Fatalf("Expected the failed mail to be reported")
+	}
+	if es, _ := loadWaitlist(db, "WHERE approved = 0"); len(es) != 1 {
+		t.Fatalf("Expected the entry to wait until the mail goes out, got %v", len(es))
+	}
+	if n, _ := countUnusedInvitations(db, admin.ID); n != 0 {
+		t.Errorf("Expected the unsent invitation to be dropped, got %v", n)
+	}
+
+	m.err = nil
+	if _, err := approveWaitlistEntry(db, m, "http://localhost/account", es[0].ID, admin); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.to) != 1 || m.to[0] != "wait@email.com" {
+		t.Fatalf("Expected the approved address to be mailed, got %v", m.to)
+	}
+	i := strings.Index(m.body[0], "invite=")
+	if i < 0 {
+		t.Fatalf("Expected a signup link, got %v", m.body[0])
+	}
+	secret := strings.TrimSpace(m.body[0][i+len("invite="):])
+
+	u := newUser("wait@email.com")
+	if err := u.insert(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := redeemInvitation(db, secret, u); err != nil {
+		t.Errorf("Expected the mailed invitation to work, got %v", err)
+	}
+
+	if _, err := approveWaitlistEntry(db, m, "http://localhost/account", es[0].ID, admin); err == nil {
+		t.Errorf("Expected approving twice to fail")
+	}
+	if es, _ := loadWaitlist(db, "WHERE approved = 0"); len(es) != 0 {
+		t.Errorf("Expected nobody left waiting, got %v", len(es))
+	}
+}
@@ -0,0 +1,316 @@
+package account
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhook events.
+const (
+	WebhookUserSignup  = "user.signup"
+	WebhookUserDeleted = "user.deleted"
+)
+
+// Webhook requests carry the event and delivery id in headers, and are
+// signed with HMAC-SHA256 over "<timestamp>.<body>" using the endpoint's
+// secret:
+//
+//	X-Webhook-Signature: t=1500000000,v1=<hex signature>
+//
+// Receivers should check the signature and reject stale timestamps.
+const (
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	webhookMaxAttempts  = 10
+	webhookBaseBackoff  = 30 * time.Second
+	webhookMaxBackoff   = 6 * time.Hour
+	webhookPollInterval = 10 * time.Second
+	webhookBatchSize    = 20
+)
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// WebhookEndpoint receives account events as signed JSON POSTs.
+type WebhookEndpoint struct {
+	URL    string
+	Secret string
+	// Events limits the endpoint to the named events, all of them when
+	// empty.
+	Events []string
+}
+
+func (e *WebhookEndpoint) wants(event string) bool {
+	return len(e.Events) == 0 || containsString(e.Events, event)
+}
+
+type webhookPayload struct {
+	Event   string    `json:"event"`
+	Created time.Time `json:"created"`
+	User    *apiUser  `json:"user"`
+}
+
+// webhookDelivery is one event queued for one endpoint.  The row doubles
+// as the delivery log.
+type webhookDelivery struct {
+	ID           int64
+	URL          string
+	Event        string
+	Payload      string
+	Status       string
+	Attempts     int
+	NextAttempt  time.Time
+	ResponseCode int
+	Error        string
+	Created      time.Time
+}
+
+// webhookQueue persists events for the configured endpoints and delivers
+// them, retrying failures with exponential backoff.
+type webhookQueue struct {
+	db     *sql.DB
+	client *http.Client
+
+	mu        sync.RWMutex
+	endpoints []*WebhookEndpoint
+}
+
+func newWebhookQueue(db *sql.DB) *webhookQueue {
+	return &webhookQueue{db: db, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (q *webhookQueue) add(e *WebhookEndpoint) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.endpoints = append(q.endpoints, e)
+}
+
+func (q *webhookQueue) endpoint(url string) *WebhookEndpoint {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	for _, e := range q.endpoints {
+		if e.URL == url {
+			return e
+		}
+	}
+	return nil
+}
+
+// enqueue queues event about u for every endpoint that wants it.
+func (q *webhookQueue) enqueue(event string, u *User) error {
+	p, err := json.Marshal(&webhookPayload{Event: event, Created: time.Now().UTC(), User: newAPIUser(u)})
+	if err != nil {
+		return err
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	for _, e := range q.endpoints {
+		if !e.wants(event) {
+			continue
+		}
+		_, err := q.db.Exec(
+			"INSERT INTO WebhookDeliveries (url, event, payload, next_attempt) VALUES ($1, $2, $3, $4)",
+			e.URL, event, string(p), time.Now().Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hook returns a Hook queueing event for the user it is called with.
+func (q *webhookQueue) hook(event string) Hook {
+	return func(u *User, r *http.Request) error {
+		return q.enqueue(event, u)
+	}
+}
+
+// signWebhook returns the signature header value for body sent at t.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	m := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(m, ts+".")
+	m.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(m.Sum(nil))
+}
+
+// webhookBackoff is how long to wait after the given number of failed
+// attempts.
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookBaseBackoff
+	for i := 1; i < attempts && d < webhookMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > webhookMaxBackoff {
+		d = webhookMaxBackoff
+	}
+	return d
+}
+
+// send makes one attempt at delivering d, returning the response code.
+func (q *webhookQueue) send(d *webhookDelivery) (int, error) {
+	e := q.endpoint(d.URL)
+	if e == nil {
+		return 0, fmt.Errorf("endpoint %v is no longer configured", d.URL)
+	}
+	body := []byte(d.Payload)
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(d.ID, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(e.Secret, time.Now(), body))
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %v", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliver attempts d and records the outcome, scheduling a retry or giving
+// up after webhookMaxAttempts.
+func (q *webhookQueue) deliver(d *webhookDelivery, now time.Time) error {
+	code, err := q.send(d)
+	d.Attempts++
+	d.ResponseCode = code
+	d.Error = ""
+	switch {
+	case err == nil:
+		d.Status = deliveryDelivered
+	case d.Attempts >= webhookMaxAttempts:
+		d.Status = deliveryFailed
+		d.Error = err.Error()
+	default:
+		d.NextAttempt = now.Add(webhookBackoff(d.Attempts))
+		d.Error = err.Error()
+	}
+	_, err = q.db.Exec(
+		`UPDATE WebhookDeliveries SET status = ?, attempts = ?, next_attempt = ?, response_code = ?,
+		error = ?, updated = CURRENT_TIMESTAMP WHERE id = ?`,
+		d.Status, d.Attempts, d.NextAttempt.Unix(), d.ResponseCode, d.Error, d.ID)
+	return err
+}
+
+func scanWebhookDelivery(row interface {
+	Scan(...interface{}) error
+}) (*webhookDelivery, error) {
+	d := &webhookDelivery{}
+	var next int64
+	err := row.Scan(&d.ID, &d.URL, &d.Event, &d.Payload, &d.Status, &d.Attempts, &next,
+		&d.ResponseCode, &d.Error, &d.Created)
+	if err != nil {
+		return nil, err
+	}
+	d.NextAttempt = time.Unix(next, 0)
+	return d, nil
+}
+
+const webhookDeliveryColumns = "id, url, event, payload, status, attempts, next_attempt, response_code, error, created"
+
+func loadWebhookDeliveries(db *sql.DB, query string, args ...interface{}) ([]*webhookDelivery, error) {
+	rows, err := db.Query("SELECT "+webhookDeliveryColumns+" FROM WebhookDeliveries "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ds []*webhookDelivery
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, rows.Err()
+}
+
+// deliverDue attempts the deliveries due by now, oldest first, returning how
+// many it attempted.
+func (q *webhookQueue) deliverDue(now time.Time) (int, error) {
+	ds, err := loadWebhookDeliveries(q.db, "WHERE status = ? AND next_attempt <= ? ORDER BY id LIMIT ?",
+		deliveryPending, now.Unix(), webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range ds {
+		if err := q.deliver(d, now); err != nil {
+			return 0, err
+		}
+	}
+	return len(ds), nil
+}
+
+// run delivers queued webhooks until stop is closed.
+func (q *webhookQueue) run(stop <-chan struct{}) {
+	t := time.NewTicker(webhookPollInterval)
+	defer t.Stop()
+	for {
+		// Keep going while there is a backlog.
+		for {
+			n, err := q.deliverDue(time.Now())
+			if err != nil {
+				log.Print("unable to deliver webhooks ", err)
+			}
+			if err != nil || n < webhookBatchSize {
+				break
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// AddWebhook registers an endpoint for account events.  Like hooks, webhooks
+// must be added before serving requests.
+func (am AccountManager) AddWebhook(e WebhookEndpoint) {
+	am.webhooks.add(&e)
+}
+
+// RunWebhooks delivers queued webhooks until stop is closed.  Deliveries are
+// kept in the database, so events queued while it is not running are sent
+// once it is.
+func (am AccountManager) RunWebhooks(stop <-chan struct{}) {
+	am.webhooks.run(stop)
+}
+
+type adminWebhooksContext struct {
+	Deliveries []*webhookDelivery
+}
+
+func (a adminHandler) webhooks(w http.ResponseWriter, r *http.Request) {
+	ds, err := loadWebhookDeliveries(a.db, "ORDER BY id DESC LIMIT ?", adminPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pageHandler("admin_webhooks.html", &adminWebhooksContext{ds}, w, r)
+}
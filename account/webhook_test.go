@@ -0,0 +1,79 @@
+package account
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatalf("Failed to setup db schema %v", err)
+	}
+	defer db.Close()
+
+	var got []*webhookPayload
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		sig := r.Header.Get(webhookSignatureHeader)
+		ts := strings.TrimPrefix(strings.Split(sig, ",")[0], "t=")
+		n, _ := strconv.ParseInt(ts, 10, 64)
+		if sig != signWebhook("secret", time.Unix(n, 0), body) {
+			t.Errorf("Bad signature %v", sig)
+		}
+		p := &webhookPayload{}
+		json.Unmarshal(body, p)
+		got = append(got, p)
+	}))
+	defer srv.Close()
+
+	q := newWebhookQueue(db)
+	q.add(&WebhookEndpoint{URL: srv.URL, Secret: "secret", Events: []string{WebhookUserSignup}})
+	u := &User{ID: 7, Email: "a@b.com"}
+	if err := q.enqueue(WebhookUserSignup, u); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.enqueue(WebhookUserDeleted, u); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if n, err := q.deliverDue(now); err != nil || n != 1 {
+		t.Fatalf("Expected one delivery for the subscribed event, got %v %v", n, err)
+	}
+	ds, _ := loadWebhookDeliveries(db, "")
+	if d := ds[0]; d.Status != deliveryPending || d.Attempts != 1 || d.ResponseCode != 503 ||
+		d.NextAttempt.Unix() != now.Add(webhookBaseBackoff).Unix() {
+		t.Errorf("Expected failed attempt to be retried later, got %+v", d)
+	}
+	if n, _ := q.deliverDue(now); n != 0 {
+		t.Errorf("Expected no retry before the backoff, got %v", n)
+	}
+
+	fail = false
+	if n, err := q.deliverDue(now.Add(webhookBaseBackoff)); err != nil || n != 1 {
+		t.Fatalf("Expected retry after the backoff, got %v %v", n, err)
+	}
+	if len(got) != 1 || got[0].Event != WebhookUserSignup || got[0].User.ID != 7 {
+		t.Errorf("Expected signup payload, got %v", got)
+	}
+	ds, _ = loadWebhookDeliveries(db, "")
+	if ds[0].Status != deliveryDelivered || ds[0].Attempts != 2 {
+		t.Errorf("Expected delivery to be logged, got %+v", ds[0])
+	}
+
+	if webhookBackoff(3) != 4*webhookBaseBackoff || webhookBackoff(50) != webhookMaxBackoff {
+		t.Errorf("Unexpected backoff %v %v", webhookBackoff(3), webhookBackoff(50))
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"crypto/rsa"
 	"database/sql"
 	"encoding/json"
+	"html/template"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/smtp"
 	"os"
 	"strconv"
-	"text/template"
 
 	"github.com/bjschnei/goweb/account"
 	"github.com/gorilla/handlers"
@@ -25,6 +29,11 @@ var (
 	configFile = flag.String("config", "config.json",
 		"file containing configuration parameters in json")
 	port = flag.Int("port", 80, "Port web server listens on")
+
+	normalizeEmails = flag.Bool("normalize_emails", false,
+		"normalize stored email addresses, report addresses shared by several users and exit")
+	migrateDisabled = flag.Bool("migrate_disabled_users", false,
+		"turn users disabled before suspensions existed into suspended users and exit")
 )
 
 type config struct {
@@ -34,20 +43,65 @@ type config struct {
 	}
 	DomainName   string
 	CookieSecret []byte
+	// PEM encoded RSA keys for signing access tokens, newest first.
+	SigningKeyFiles []string
+	// Endpoints notified of account events such as signups.
+	Webhooks []account.WebhookEndpoint
+	// SMTP server for email sent to users.  Without one messages are only
+	// logged.
+	SMTP struct {
+		Addr     string
+		From     string
+		Username string
+		Password string
+	}
+	// Directory uploaded avatars are kept in, "blobs" by default.
+	BlobDir string
+	// Who may sign up.  Mode is one of open, invite_only, waitlist and
+	// closed, open by default.
+	Signup struct {
+		Mode            string
+		AllowedDomains  []string
+		BlockedDomains  []string
+		BlockDisposable bool
+	}
+}
+
+var signupModes = map[string]account.SignupMode{
+	"":            account.SignupOpen,
+	"open":        account.SignupOpen,
+	"invite_only": account.SignupInviteOnly,
+	"waitlist":    account.SignupWaitlist,
+	"closed":      account.SignupClosed,
 }
 
 type homeContext struct {
-	U *account.User
+	// Base is the path of the account routes.
+	Base         string
+	U            *account.User
+	Perms        account.Permissions
+	Impersonator *account.User
 }
 
-func homepageHandler(w http.ResponseWriter, r *http.Request, store sessions.Store) {
-	u, err := account.UserFromRequest(store, r)
+func homepageHandler(w http.ResponseWriter, r *http.Request, am *account.AccountManager) {
+	u, err := am.CurrentUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	err = templates.ExecuteTemplate(w, "index.html", &homeContext{U: u})
+	c := &homeContext{Base: am.BasePath(), U: u}
+	if u != nil {
+		if c.Perms, err = am.UserPermissions(u); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if c.Impersonator, err = am.Impersonator(r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	err = templates.ExecuteTemplate(w, "index.html", c)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -65,6 +119,22 @@ func readConfig(filename string) (*config, error) {
 	return c, err
 }
 
+func readSigningKeys(filenames []string) ([]*rsa.PrivateKey, error) {
+	var keys []*rsa.PrivateKey
+	for _, fn := range filenames {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		k, err := account.ParseSigningKey(b)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
 func main() {
 	flag.Parse()
 	log.SetOutput(os.Stderr)
@@ -74,6 +144,28 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if *normalizeEmails {
+		dups, err := account.NormalizeStoredEmails(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, d := range dups {
+			log.Printf("%v is shared by users %v", d.Email, d.UserIDs)
+		}
+		log.Printf("%v duplicate addresses", len(dups))
+		return
+	}
+	if *migrateDisabled {
+		migrated, err := account.MigrateDisabledUsers(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !migrated {
+			log.Printf("no disabled column, nothing to migrate")
+		}
+		return
+	}
+
 	cfg, err := readConfig(*configFile)
 	if err != nil {
 		log.Fatal(err)
@@ -98,9 +190,44 @@ func main() {
 
 	am := account.NewAccountManager(store, db, addr,
 		account.NewFacebookClient(cfg.OauthFB.ID, cfg.OauthFB.Secret))
+	if len(cfg.SigningKeyFiles) != 0 {
+		keys, err := readSigningKeys(cfg.SigningKeyFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		am.SetSigningKeys(keys...)
+	}
+	if cfg.SMTP.Addr != "" {
+		m := &account.SMTPMailer{Addr: cfg.SMTP.Addr, From: cfg.SMTP.From}
+		if cfg.SMTP.Username != "" {
+			host, _, err := net.SplitHostPort(cfg.SMTP.Addr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			m.Auth = smtp.PlainAuth("", cfg.SMTP.Username, cfg.SMTP.Password, host)
+		}
+		am.SetMailer(m)
+	}
+	mode, ok := signupModes[cfg.Signup.Mode]
+	if !ok {
+		log.Fatalf("unknown signup mode %q", cfg.Signup.Mode)
+	}
+	am.SetSignupPolicy(account.SignupPolicy{
+		Mode:            mode,
+		AllowedDomains:  cfg.Signup.AllowedDomains,
+		BlockedDomains:  cfg.Signup.BlockedDomains,
+		BlockDisposable: cfg.Signup.BlockDisposable})
+	if cfg.BlobDir != "" {
+		am.SetBlobStore(&account.DirBlobStore{Dir: cfg.BlobDir})
+	}
+	for _, wh := range cfg.Webhooks {
+		am.AddWebhook(wh)
+	}
+	go am.RunWebhooks(nil)
+	go am.RunScheduledDeletions(nil)
 	mx := mux.NewRouter()
 	mx.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		homepageHandler(w, r, store)
+		homepageHandler(w, r, am)
 	})
 
 	asr := mx.PathPrefix("/account").Subrouter()